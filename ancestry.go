@@ -0,0 +1,226 @@
+package main
+
+// ancestry module verifies that commits of image requests are reachable
+// from protected branches of service repositories
+//
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// BranchPolicy represents protected branch policy of the service
+type BranchPolicy struct {
+	Branches []string `json:"branches"` // protected branch patterns, e.g. main or release/*
+	Mirror   string   `json:"mirror"`   // path to local mirror (git clone --mirror) used instead of provider API
+}
+
+// AncestryProvider represents source provider which can check ancestry of commits
+type AncestryProvider interface {
+	Branches(repo string) ([]string, error)            // names of repository branches
+	DefaultBranch(repo string) (string, error)         // name of default branch of the repository
+	IsAncestor(repo, sha, branch string) (bool, error) // check if commit is reachable from the branch
+}
+
+// max number of pages of branch listing
+const maxBranchPages = 10
+
+// helper function to check if branch name contains glob pattern
+func isPattern(branch string) bool {
+	return strings.ContainsAny(branch, "*?[")
+}
+
+// helper function to return branches matching patterns of the policy
+func (b *BranchPolicy) match(branches []string) []string {
+	var out []string
+	for _, branch := range branches {
+		for _, pat := range b.Branches {
+			if ok, _ := path.Match(pat, branch); ok {
+				out = append(out, branch)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// helper function to return protected branches of the repository, branches
+// are listed only if policy uses patterns
+func (b *BranchPolicy) protected(list func() ([]string, error)) ([]string, error) {
+	var patterns bool
+	for _, pat := range b.Branches {
+		if isPattern(pat) {
+			patterns = true
+		}
+	}
+	if !patterns {
+		return b.Branches, nil
+	}
+	branches, err := list()
+	if err != nil {
+		return nil, err
+	}
+	return b.match(branches), nil
+}
+
+// helper function to check that commit of the request is reachable from
+// protected branches of service policy
+func checkAncestry(r Request, policy ServicePolicy) error {
+	bp := policy.Protected
+	if bp == nil || len(bp.Branches) == 0 {
+		return nil
+	}
+	var list func() ([]string, error)
+	var isAncestor func(branch string) (bool, error)
+	if bp.Mirror != "" {
+		unlock := lockDir(bp.Mirror)
+		defer unlock()
+		if _, err := git(bp.Mirror, "fetch", "--prune", "origin"); err != nil {
+			return err
+		}
+		list = func() ([]string, error) { return mirrorBranches(bp.Mirror) }
+		isAncestor = func(branch string) (bool, error) { return mirrorIsAncestor(bp.Mirror, r.Commit, branch) }
+	} else {
+		src, err := sourceProvider(r, policy)
+		if err != nil {
+			return err
+		}
+		provider, ok := src.(AncestryProvider)
+		if !ok {
+			return fmt.Errorf("source provider of %s does not support ancestry check, please use local mirror", r.Repository)
+		}
+		list = func() ([]string, error) { return provider.Branches(r.Repository) }
+		isAncestor = func(branch string) (bool, error) { return provider.IsAncestor(r.Repository, r.Commit, branch) }
+	}
+	branches, err := bp.protected(list)
+	if err != nil {
+		return err
+	}
+	for _, branch := range branches {
+		ok, err := isAncestor(branch)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("commit %s of %s is not reachable from protected branches %s", r.Commit, r.Repository, strings.Join(bp.Branches, ", "))
+}
+
+// helper function to list branches of local mirror
+func mirrorBranches(dir string) ([]string, error) {
+	out, err := git(dir, "for-each-ref", "--format=%(refname:short)", "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(out), nil
+}
+
+// helper function to check if commit is ancestor of branch in local mirror
+func mirrorIsAncestor(dir, sha, branch string) (bool, error) {
+	_, err := git(dir, "merge-base", "--is-ancestor", sha, fmt.Sprintf("refs/heads/%s", branch))
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Branches implements AncestryProvider interface
+func (p *GitHubProvider) Branches(repo string) ([]string, error) {
+	c := p.github()
+	var out []string
+	for page := 1; page <= maxBranchPages; page++ {
+		var rec []struct {
+			Name string `json:"name"`
+		}
+		rurl := fmt.Sprintf("%s/repos/%s/branches?per_page=100&page=%d", c.api(), repo, page)
+		if err := c.get(rurl, &rec); err != nil {
+			return nil, err
+		}
+		for _, b := range rec {
+			out = append(out, b.Name)
+		}
+		if len(rec) < 100 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// DefaultBranch implements AncestryProvider interface
+func (p *GitHubProvider) DefaultBranch(repo string) (string, error) {
+	c := p.github()
+	var rec struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := c.get(fmt.Sprintf("%s/repos/%s", c.api(), repo), &rec); err != nil {
+		return "", err
+	}
+	return rec.DefaultBranch, nil
+}
+
+// IsAncestor implements AncestryProvider interface, the commit is reachable
+// from the branch if it is identical to or behind the branch head
+func (p *GitHubProvider) IsAncestor(repo, sha, branch string) (bool, error) {
+	c := p.github()
+	var rec struct {
+		Status string `json:"status"`
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/compare/%s...%s", c.api(), repo, url.PathEscape(branch), sha)
+	if err := c.get(rurl, &rec); err != nil {
+		return false, err
+	}
+	return rec.Status == "behind" || rec.Status == "identical", nil
+}
+
+// Branches implements AncestryProvider interface
+func (p *GitLabProvider) Branches(repo string) ([]string, error) {
+	var out []string
+	for page := 1; page <= maxBranchPages; page++ {
+		var rec []GitLabRef
+		rurl := fmt.Sprintf("%s/repository/branches?per_page=100&page=%d", p.project(repo), page)
+		if err := p.client.get(rurl, &rec); err != nil {
+			return nil, err
+		}
+		for _, b := range rec {
+			out = append(out, b.Name)
+		}
+		if len(rec) < 100 {
+			break
+		}
+	}
+	return out, nil
+}
+
+// DefaultBranch implements AncestryProvider interface
+func (p *GitLabProvider) DefaultBranch(repo string) (string, error) {
+	var rec struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := p.client.get(p.project(repo), &rec); err != nil {
+		return "", err
+	}
+	return rec.DefaultBranch, nil
+}
+
+// IsAncestor implements AncestryProvider interface, the commit is reachable
+// from the branch if it is the merge base of both; merge base is full commit
+// SHA while given commit may be its short form
+func (p *GitLabProvider) IsAncestor(repo, sha, branch string) (bool, error) {
+	var rec GitLabCommit
+	query := url.Values{"refs[]": []string{sha, branch}}
+	rurl := fmt.Sprintf("%s/repository/merge_base?%s", p.project(repo), query.Encode())
+	if err := p.client.get(rurl, &rec); err != nil {
+		return false, err
+	}
+	return sha != "" && strings.HasPrefix(strings.ToLower(rec.ID), strings.ToLower(sha)), nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMirrorAncestry
+func TestMirrorAncestry(t *testing.T) {
+	bare := testBareRepo(t, map[string]string{"README": "init\n"})
+	seed := filepath.Join(t.TempDir(), "seed")
+	cmds := [][]string{
+		{"clone", bare, seed},
+		{"-C", seed, "checkout", "-b", "release/1.0"},
+		{"-C", seed, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--allow-empty", "-m", "release"},
+		{"-C", seed, "push", "origin", "release/1.0"},
+		{"-C", seed, "checkout", "-b", "feature", "main"},
+		{"-C", seed, "-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "--allow-empty", "-m", "feature"},
+		{"-C", seed, "push", "origin", "feature"},
+	}
+	for _, args := range cmds {
+		if _, err := git("", args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mirror := filepath.Join(t.TempDir(), "mirror.git")
+	if _, err := git("", "clone", "--mirror", bare, mirror); err != nil {
+		t.Fatal(err)
+	}
+	sha := func(ref string) string {
+		out, _ := git(bare, "rev-parse", ref)
+		return strings.TrimSpace(out)
+	}
+	tests := []struct {
+		ref      string
+		branches []string
+		fail     bool
+	}{
+		{ref: "main", branches: []string{"main"}},
+		{ref: "release/1.0", branches: []string{"main", "release/*"}},
+		{ref: "release/1.0", branches: []string{"main"}, fail: true},
+		{ref: "feature", branches: []string{"main", "release/*"}, fail: true},
+	}
+	for _, tt := range tests {
+		r := Request{Service: "srv", Repository: "org/srv", Commit: sha(tt.ref)}
+		policy := ServicePolicy{Protected: &BranchPolicy{Branches: tt.branches, Mirror: mirror}}
+		err := checkAncestry(r, policy)
+		if tt.fail && (err == nil || !strings.Contains(err.Error(), "not reachable")) {
+			t.Errorf("Fail TestMirrorAncestry, commit of %s wrong error %v\n", tt.ref, err)
+		}
+		if !tt.fail && err != nil {
+			t.Errorf("Fail TestMirrorAncestry, commit of %s: %v\n", tt.ref, err)
+		}
+	}
+}
+
+// TestGitHubAncestry
+func TestGitHubAncestry(t *testing.T) {
+	fakeGitHub(t, map[string]string{
+		"/repos/org/srv/branches":                  `[{"name": "main"}, {"name": "release/1.0"}, {"name": "feature"}]`,
+		"/repos/org/srv/compare/main...abc":        `{"status": "diverged"}`,
+		"/repos/org/srv/compare/release/1.0...abc": `{"status": "behind"}`,
+		"/repos/org/srv/compare/main...def":        `{"status": "ahead"}`,
+		"/repos/org/srv/compare/release/1.0...def": `{"status": "ahead"}`,
+	})
+	policy := ServicePolicy{Protected: &BranchPolicy{Branches: []string{"main", "release/*"}}}
+	if err := checkAncestry(Request{Repository: "org/srv", Commit: "abc"}, policy); err != nil {
+		t.Errorf("Fail TestGitHubAncestry, %v\n", err)
+	}
+	if err := checkAncestry(Request{Repository: "org/srv", Commit: "def"}, policy); err == nil {
+		t.Errorf("Fail TestGitHubAncestry, commit outside of protected branches is accepted\n")
+	}
+}
+
+// TestGitLabAncestry
+func TestGitLabAncestry(t *testing.T) {
+	sha := "4c2d1a0f6b8e9d7c5a3b1f2e0d9c8b7a6f5e4d3c"
+	gitlab := fakeSource(t, map[string]string{
+		"/api/v4/projects/group%2Fsrv":                       `{"id": 1, "default_branch": "main"}`,
+		"/api/v4/projects/group%2Fsrv/repository/merge_base": `{"id": "` + sha + `"}`,
+	})
+	p, err := newSourceProvider(SourceConfig{Type: "gitlab", URL: gitlab.URL + "/api/v4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := p.(AncestryProvider)
+	if branch, err := provider.DefaultBranch("group/srv"); err != nil || branch != "main" {
+		t.Errorf("Fail TestGitLabAncestry, default branch %s %v\n", branch, err)
+	}
+	for _, commit := range []string{sha, sha[:7], strings.ToUpper(sha[:7])} {
+		if ok, err := provider.IsAncestor("group/srv", commit, "main"); err != nil || !ok {
+			t.Errorf("Fail TestGitLabAncestry, commit %s is not reachable %v\n", commit, err)
+		}
+	}
+	if ok, _ := provider.IsAncestor("group/srv", "0a1b2c3", "main"); ok {
+		t.Errorf("Fail TestGitLabAncestry, commit outside of branch is reachable\n")
+	}
+}
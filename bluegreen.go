@@ -0,0 +1,365 @@
+package main
+
+// bluegreen module provides blue/green deployment strategy based on switching
+// of k8s service selectors between colour deployments of the service
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// annotations of k8s service used to track blue/green state
+const (
+	previousColourAnnotation = "imagebot.io/previous-colour"
+	switchedAnnotation       = "imagebot.io/switched-at"
+)
+
+// maintenance actions of blue/green deployments executed as jobs
+const (
+	actionSwitchBack = "switchback"
+	actionScaleDown  = "scaledown"
+)
+
+// BlueGreenStrategy represents configuration of blue/green deployment strategy
+type BlueGreenStrategy struct {
+	Service   string   `json:"service"`   // k8s service name, default service name
+	Label     string   `json:"label"`     // service selector label holding the colour, default color
+	Colours   []string `json:"colours"`   // colours of deployments, default blue and green
+	Timeout   int      `json:"timeout"`   // rollout timeout of idle deployment in seconds, default 300
+	Hold      int      `json:"hold"`      // period in seconds old colour is kept for switch-back, default 600
+	ScaleDown bool     `json:"scaleDown"` // scale down old colour deployment after hold period
+}
+
+// BlueGreenState represents blue/green state of the service
+type BlueGreenState struct {
+	Service   string `json:"service"`    // k8s service name
+	Namespace string `json:"namespace"`  // k8s namespace
+	Active    string `json:"active"`     // colour receiving the traffic
+	Previous  string `json:"previous"`   // colour available for switch-back
+	Switched  int64  `json:"switched"`   // timestamp of last switch
+	HoldUntil int64  `json:"hold_until"` // timestamp until switch-back is possible
+}
+
+// helper function to return k8s service name
+func (b *BlueGreenStrategy) service(r Request) string {
+	if b.Service != "" {
+		return b.Service
+	}
+	return r.Service
+}
+
+// helper function to return selector label holding the colour
+func (b *BlueGreenStrategy) label() string {
+	if b.Label != "" {
+		return b.Label
+	}
+	return "color"
+}
+
+// helper function to return colours of deployments
+func (b *BlueGreenStrategy) colours() []string {
+	if len(b.Colours) == 2 {
+		return b.Colours
+	}
+	return []string{"blue", "green"}
+}
+
+// helper function to return rollout timeout in seconds
+func (b *BlueGreenStrategy) timeout() int {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return 300
+}
+
+// helper function to return hold period
+func (b *BlueGreenStrategy) hold() time.Duration {
+	if b.Hold > 0 {
+		return time.Duration(b.Hold) * time.Second
+	}
+	return 600 * time.Second
+}
+
+// helper function to return deployment name of given colour
+func (b *BlueGreenStrategy) deployment(r Request, colour string) string {
+	return fmt.Sprintf("%s-%s", r.Service, colour)
+}
+
+// helper function to return colour other than given one
+func (b *BlueGreenStrategy) other(colour string) string {
+	colours := b.colours()
+	if colour == colours[0] {
+		return colours[1]
+	}
+	return colours[0]
+}
+
+// helper function to get blue/green state of the service
+func (b *BlueGreenStrategy) state(r Request) (BlueGreenState, error) {
+	name := b.service(r)
+	state := BlueGreenState{Service: name, Namespace: r.Namespace}
+	svc, err := serviceInfo(name, r.Namespace)
+	if err != nil {
+		return state, err
+	}
+	state.Active = svc.Spec.Selector[b.label()]
+	if state.Active == "" {
+		return state, fmt.Errorf("service %s has no %s selector", name, b.label())
+	}
+	state.Previous = svc.Metadata.Annotations[previousColourAnnotation]
+	if v, ok := svc.Metadata.Annotations[switchedAnnotation]; ok {
+		state.Switched, _ = strconv.ParseInt(v, 10, 64)
+		state.HoldUntil = state.Switched + int64(b.hold().Seconds())
+	}
+	return state, nil
+}
+
+// helper function to switch service selector to given colour
+func (b *BlueGreenStrategy) switchTo(r Request, colour, previous string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				previousColourAnnotation: previous,
+				switchedAnnotation:       fmt.Sprintf("%d", time.Now().Unix()),
+			},
+		},
+		"spec": map[string]interface{}{
+			"selector": map[string]string{b.label(): colour},
+		},
+	}
+	return patchObject("service", b.service(r), r.Namespace, patch)
+}
+
+// helper function to schedule scale down of idle colour deployment after hold
+// period, the scale down is persisted as scheduled job of the job manager
+func (b *BlueGreenStrategy) scheduleScaleDown(r Request) {
+	if jobManager == nil {
+		return
+	}
+	if !b.ScaleDown {
+		jobManager.Cancel(r.workload(), actionScaleDown)
+		return
+	}
+	job := newJob(r)
+	job.Action = actionScaleDown
+	job.NotBefore = time.Now().Add(b.hold()).Unix()
+	jobManager.Schedule(job)
+}
+
+// helper function to scale down idle colour deployment once hold period of
+// the last switch is expired
+func scaleDown(r Request, b *BlueGreenStrategy, job *Job) error {
+	if b == nil {
+		b = &BlueGreenStrategy{}
+	}
+	state, err := b.state(r)
+	if err != nil {
+		return err
+	}
+	if time.Now().Unix() < state.HoldUntil {
+		job.Logf("hold period of colour %s is not expired, scale down is skipped", state.Previous)
+		return nil
+	}
+	name := b.deployment(r, b.other(state.Active))
+	if err := scaleDeployment(name, r.Namespace, 0); err != nil {
+		return err
+	}
+	job.Logf("deployment %s is scaled down after hold period", name)
+	return nil
+}
+
+// helper function to execute scale down job
+func scaleDownJob(job *Job) error {
+	return scaleDown(job.Request, findPolicy(job.Request).BlueGreen, job)
+}
+
+// helper function to deploy request via blue/green strategy, the new image is
+// deployed to idle colour and service selector is switched to it once it is ready
+func bluegreenDeploy(r Request, b *BlueGreenStrategy, job *Job) error {
+	if b == nil {
+		b = &BlueGreenStrategy{}
+	}
+	state, err := b.state(r)
+	if err != nil {
+		return err
+	}
+	active := state.Active
+	idle := b.other(active)
+	activeName := b.deployment(r, active)
+	idleName := b.deployment(r, idle)
+
+	job.Stage("deploy", "started", fmt.Sprintf("set image %s on idle deployment %s", imageRef(r.Image, r.Tag), idleName))
+	activeInfo, err := deploymentInfo(activeName, r.Namespace)
+	if err != nil {
+		job.Stage("deploy", "failed", err.Error())
+		return err
+	}
+	prev, err := deploymentImage(activeName, r)
+	if err != nil {
+		job.Stage("deploy", "failed", err.Error())
+		return err
+	}
+	ref := imageRef(r.Image, pinnedTag(r, job))
+	job.update(func(j *Job) {
+		j.PreviousImage = prev
+		j.NewImage = ref
+	})
+	if _, err := patchDeployment(idleName, r, job); err != nil {
+		job.Stage("deploy", "failed", err.Error())
+		return err
+	}
+	idleInfo, err := deploymentInfo(idleName, r.Namespace)
+	if err == nil && idleInfo.Spec.Replicas == 0 {
+		err = scaleDeployment(idleName, r.Namespace, activeInfo.Spec.Replicas)
+	}
+	if err != nil {
+		job.Stage("deploy", "failed", err.Error())
+		return err
+	}
+	job.Stage("deploy", "succeeded", "")
+
+	job.Stage("ready", "started", fmt.Sprintf("wait for deployment %s", idleName))
+	err = waitRollout(idleName, r.Namespace, b.timeout())
+	if err == nil {
+		if idleInfo, err = deploymentInfo(idleName, r.Namespace); err == nil && !idleInfo.ready() {
+			err = fmt.Errorf("deployment %s is not ready, %d/%d replicas ready", idleName, idleInfo.Status.ReadyReplicas, idleInfo.Spec.Replicas)
+		}
+	}
+	if err != nil {
+		job.Stage("ready", "failed", err.Error())
+		return err
+	}
+	job.Stage("ready", "succeeded", "")
+
+	job.Stage("switch", "started", fmt.Sprintf("switch service %s from %s to %s", b.service(r), active, idle))
+	if err := b.switchTo(r, idle, active); err != nil {
+		job.Stage("switch", "failed", err.Error())
+		return err
+	}
+	job.Stage("switch", "succeeded", fmt.Sprintf("colour %s is available for switch-back during %v", active, b.hold()))
+	b.scheduleScaleDown(r)
+	return nil
+}
+
+// helper function to switch service back to previous colour within hold period
+func switchBack(r Request, b *BlueGreenStrategy, job *Job) (BlueGreenState, error) {
+	if b == nil {
+		b = &BlueGreenStrategy{}
+	}
+	state, err := b.state(r)
+	if err != nil {
+		return state, err
+	}
+	if state.Previous == "" || state.Previous == state.Active {
+		return state, errors.New("no previous colour to switch back to")
+	}
+	if time.Now().Unix() > state.HoldUntil {
+		return state, fmt.Errorf("hold period of colour %s expired", state.Previous)
+	}
+	info, err := deploymentInfo(b.deployment(r, state.Previous), r.Namespace)
+	if err != nil {
+		return state, err
+	}
+	if info.Spec.Replicas == 0 || !info.ready() {
+		return state, fmt.Errorf("deployment of colour %s is not ready", state.Previous)
+	}
+	if prev, err := deploymentImage(b.deployment(r, state.Active), r); err == nil {
+		job.update(func(j *Job) { j.PreviousImage = prev })
+	}
+	if img, err := deploymentImage(b.deployment(r, state.Previous), r); err == nil {
+		job.update(func(j *Job) { j.NewImage = img })
+	}
+	if err := b.switchTo(r, state.Previous, state.Active); err != nil {
+		return state, err
+	}
+	// keep the colour we switch from available for another switch-back
+	b.scheduleScaleDown(r)
+	job.Logf("service %s/%s switched back from %s to %s", r.Namespace, b.service(r), state.Active, state.Previous)
+	return b.state(r)
+}
+
+// helper function to execute switch-back job
+func switchBackJob(job *Job) error {
+	_, err := switchBack(job.Request, findPolicy(job.Request).BlueGreen, job)
+	return err
+}
+
+// helper function to get image of the request used by given deployment
+func deploymentImage(name string, r Request) (string, error) {
+	out, err := runCommand("kubectl", "get", "deployment", name, "-n", r.Namespace, "-o", "yaml")
+	if err != nil {
+		return "", err
+	}
+	return currentImage(string(out), r), nil
+}
+
+// SwitchBackHandler represents switch-back API of blue/green deployments
+func SwitchBackHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	start := time.Now()
+	defer logRequest(w, r, start, &status)
+	if r.Method != "POST" {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		return
+	}
+	defer r.Body.Close()
+	var imgRequest = Request{}
+	data, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(data, &imgRequest)
+	}
+	if err != nil {
+		status = http.StatusBadRequest
+		log.Println("unable to read request", string(data), err)
+		w.WriteHeader(status)
+		return
+	}
+	// switch-back restores already deployed image, therefore only the token
+	// is verified while deployment checks are skipped to not block it
+	tokenRequest, ok := authToken(r, imgRequest)
+	if !ok {
+		status = http.StatusUnauthorized
+		log.Println("unauthorized access")
+		w.WriteHeader(status)
+		return
+	}
+	imgRequest = tokenRequest
+	policy := findPolicy(imgRequest)
+	if policy.Strategy != "bluegreen" {
+		status = http.StatusBadRequest
+		log.Printf("service %s does not use bluegreen strategy", imgRequest.Service)
+		w.WriteHeader(status)
+		return
+	}
+	job := newJob(imgRequest)
+	job.Action = actionSwitchBack
+	job.Caller = caller(r)
+	job.TokenID = tokenID(bearerToken(r))
+	if err := jobManager.Run(job); err != nil {
+		status = http.StatusConflict
+		log.Printf("unable to switch back %s, error %v", imgRequest.workload(), err)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b := policy.BlueGreen
+	if b == nil {
+		b = &BlueGreenStrategy{}
+	}
+	state, err := b.state(imgRequest)
+	if err != nil {
+		status = http.StatusInternalServerError
+		log.Printf("unable to get state of %s, error %v", imgRequest.workload(), err)
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, state)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function to fake kubectl commands of blue/green deployment
+func fakeBlueGreen(t *testing.T) *[]string {
+	colour := "blue"
+	annotations := map[string]string{}
+	return fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get service srv"):
+			rec := map[string]interface{}{
+				"metadata": map[string]interface{}{"annotations": annotations},
+				"spec":     map[string]interface{}{"selector": map[string]string{"app": "srv", "color": colour}},
+			}
+			return json.Marshal(rec)
+		case strings.HasPrefix(cmd, "kubectl patch service srv"):
+			var patch struct {
+				Metadata struct{ Annotations map[string]string }
+				Spec     struct{ Selector map[string]string }
+			}
+			arr := strings.SplitN(cmd, "-p ", 2)
+			if err := json.Unmarshal([]byte(arr[1]), &patch); err != nil {
+				return nil, err
+			}
+			colour = patch.Spec.Selector["color"]
+			annotations = patch.Metadata.Annotations
+			return []byte("patched"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment") && strings.HasSuffix(cmd, "-o yaml"):
+			return []byte("spec:\n  containers:\n  - image: repo/srv:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment"):
+			return []byte(`{"spec": {"replicas": 2}, "status": {"replicas": 2, "readyReplicas": 2, "updatedReplicas": 2}}`), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"), strings.HasPrefix(cmd, "kubectl rollout status"), strings.HasPrefix(cmd, "kubectl scale"):
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+}
+
+// TestBlueGreenDeploy
+func TestBlueGreenDeploy(t *testing.T) {
+	calls := fakeBlueGreen(t)
+	b := &BlueGreenStrategy{}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	if err := bluegreenDeploy(r, b, job); err != nil {
+		t.Fatal(err)
+	}
+	if !InList("kubectl get deployment srv-green -n test -o yaml", *calls) {
+		t.Errorf("Fail TestBlueGreenDeploy, idle deployment is not updated %v\n", *calls)
+	}
+	state, err := b.state(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Active != "green" || state.Previous != "blue" {
+		t.Errorf("Fail TestBlueGreenDeploy, wrong state %+v\n", state)
+	}
+	if job.PreviousImage != "repo/srv:0.1" {
+		t.Errorf("Fail TestBlueGreenDeploy, wrong previous image %s\n", job.PreviousImage)
+	}
+
+	// switch back to previous colour
+	state, err = switchBack(r, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Active != "blue" || state.Previous != "green" {
+		t.Errorf("Fail TestBlueGreenDeploy, wrong state after switch-back %+v\n", state)
+	}
+}
+
+// TestBlueGreenHoldExpired
+func TestBlueGreenHoldExpired(t *testing.T) {
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		rec := fmt.Sprintf(`{"metadata": {"annotations": {"%s": "green", "%s": "1000"}}, "spec": {"selector": {"color": "blue"}}}`,
+			previousColourAnnotation, switchedAnnotation)
+		return []byte(rec), nil
+	})
+	r := Request{Service: "srv", Namespace: "test"}
+	if _, err := switchBack(r, &BlueGreenStrategy{Hold: 60}, nil); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Fail TestBlueGreenHoldExpired, wrong error %v\n", err)
+	}
+}
+
+// TestBlueGreenScaleDown
+func TestBlueGreenScaleDown(t *testing.T) {
+	fakeBlueGreen(t)
+	mgr := jobManager
+	defer func() { jobManager = mgr }()
+	store := filepath.Join(t.TempDir(), "jobs.json")
+	var err error
+	jobManager, err = newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &BlueGreenStrategy{ScaleDown: true, Hold: 60}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	if err := bluegreenDeploy(r, b, newJob(r)); err != nil {
+		t.Fatal(err)
+	}
+	defer jobManager.Cancel(r.workload(), actionScaleDown)
+
+	// scheduled scale down should survive server restart
+	restored, err := newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := restored.Jobs()
+	if len(jobs) != 1 || jobs[0].Action != actionScaleDown || jobs[0].State != JobQueued || len(restored.queue) != 0 {
+		t.Fatalf("Fail TestBlueGreenScaleDown, wrong restored jobs %+v\n", jobs)
+	}
+	restored.Cancel(r.workload(), actionScaleDown)
+	if jobs[0].state() != JobSkipped {
+		t.Errorf("Fail TestBlueGreenScaleDown, scale down is not cancelled %s\n", jobs[0].state())
+	}
+
+	// scale down within hold period should be skipped
+	job := newJob(r)
+	if err := scaleDown(r, b, job); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(job.Logs, "\n"), "skipped") {
+		t.Errorf("Fail TestBlueGreenScaleDown, scale down is not skipped %v\n", job.Logs)
+	}
+
+	// idle colour should be scaled down once hold period is expired
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		rec := fmt.Sprintf(`{"metadata": {"annotations": {"%s": "blue", "%s": "1000"}}, "spec": {"selector": {"color": "green"}}}`,
+			previousColourAnnotation, switchedAnnotation)
+		return []byte(rec), nil
+	})
+	if err := scaleDown(r, b, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !InList("kubectl scale deployment/srv-blue -n test --replicas=0", *calls) {
+		t.Errorf("Fail TestBlueGreenScaleDown, idle colour is not scaled down %v\n", *calls)
+	}
+}
+
+// TestSwitchBackJob
+func TestSwitchBackJob(t *testing.T) {
+	fakeBlueGreen(t)
+	policies := Config.Policies
+	history := deployHistory
+	defer func() { Config.Policies = policies; deployHistory = history }()
+	Config.Policies = []ServicePolicy{{Service: "srv", Strategy: "bluegreen"}}
+	deployHistory, _ = newHistoryStore("")
+	mgr, err := newJobManager("", 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	if err := bluegreenDeploy(r, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	job := newJob(r)
+	job.Action = actionSwitchBack
+	if err := mgr.Run(job); err != nil {
+		t.Fatal(err)
+	}
+	out, total := deployHistory.Query(HistoryFilter{Service: "srv"})
+	if total != 1 || out[0].Action != actionSwitchBack || out[0].Outcome != JobSucceeded || out[0].PreviousImage != "repo/srv:0.1" {
+		t.Errorf("Fail TestSwitchBackJob, wrong history %+v\n", out)
+	}
+}
+
+// TestSwitchBackHandler
+func TestSwitchBackHandler(t *testing.T) {
+	fakeBlueGreen(t)
+	policies, mgr := Config.Policies, jobManager
+	defer func() { Config.Policies, jobManager = policies, mgr }()
+	// deployment checks, e.g. signature policy, do not block switch-back
+	Config.Policies = []ServicePolicy{{Service: "srv", Strategy: "bluegreen", Signature: &SignaturePolicy{Required: true}}}
+	var err error
+	if jobManager, err = newJobManager("", 1, 10, 100); err != nil {
+		t.Fatal(err)
+	}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv", Repository: "org/srv", Commit: "abc"}
+	if err := bluegreenDeploy(r, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	post := func(token Request) int {
+		r.Expire = token.Expire
+		data, _ := json.Marshal(r)
+		auth, _ := genToken(token)
+		req := httptest.NewRequest("POST", "/switchback", bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+auth)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(SwitchBackHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+	expired := r
+	expired.Expire = time.Now().Unix() - 1
+	if code := post(expired); code != http.StatusUnauthorized {
+		t.Errorf("Fail TestSwitchBackHandler, expired token is accepted with %d\n", code)
+	}
+	other := r
+	other.Tag = "0.3"
+	other.Expire = time.Now().Unix() + 60
+	if code := post(other); code != http.StatusUnauthorized {
+		t.Errorf("Fail TestSwitchBackHandler, token of other request is accepted with %d\n", code)
+	}
+	valid := r
+	valid.Expire = time.Now().Unix() + 60
+	if code := post(valid); code != http.StatusOK {
+		t.Errorf("Fail TestSwitchBackHandler, wrong status %d\n", code)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+// canary module provides canary deployment strategy with automatic promotion
+//
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// CanaryStrategy represents configuration of canary deployment strategy
+type CanaryStrategy struct {
+	Deployment  string `json:"deployment"`  // canary deployment name, default <service>-canary
+	Bake        int    `json:"bake"`        // bake period in seconds, default 300
+	Interval    int    `json:"interval"`    // interval between canary health checks in seconds, default 10
+	Timeout     int    `json:"timeout"`     // rollout timeout of canary deployment in seconds, default 300
+	MaxRestarts int    `json:"maxRestarts"` // max number of container restarts allowed during bake period
+	HealthURL   string `json:"healthURL"`   // optional HTTP health URL of canary deployment
+}
+
+// helper function to return canary deployment name
+func (c *CanaryStrategy) deployment(r Request) string {
+	if c.Deployment != "" {
+		return c.Deployment
+	}
+	return fmt.Sprintf("%s-canary", r.Service)
+}
+
+// helper function to return duration of bake period
+func (c *CanaryStrategy) bake() time.Duration {
+	if c.Bake > 0 {
+		return time.Duration(c.Bake) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// helper function to return interval between health checks
+func (c *CanaryStrategy) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// helper function to return rollout timeout in seconds
+func (c *CanaryStrategy) timeout() int {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 300
+}
+
+// helper function to check health URL
+func checkHealthURL(rurl string) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(rurl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check %s returned status %d", rurl, resp.StatusCode)
+	}
+	return nil
+}
+
+// helper function to watch canary deployment during bake period, it checks
+// readiness of canary pods, their restart counts and optional health URL
+func (c *CanaryStrategy) watch(name, ns string, job *Job) error {
+	if err := waitRollout(name, ns, c.timeout()); err != nil {
+		return err
+	}
+	info, err := deploymentInfo(name, ns)
+	if err != nil {
+		return err
+	}
+	selector := info.selector()
+	pods, err := selectPods(selector, ns)
+	if err != nil {
+		return err
+	}
+	restarts := restartCount(pods)
+	deadline := time.Now().Add(c.bake())
+	for {
+		info, err := deploymentInfo(name, ns)
+		if err != nil {
+			return err
+		}
+		if !info.ready() {
+			return fmt.Errorf("canary deployment %s is not ready, %d/%d replicas ready", name, info.Status.ReadyReplicas, info.Spec.Replicas)
+		}
+		pods, err := selectPods(selector, ns)
+		if err != nil {
+			return err
+		}
+		if n := restartCount(pods) - restarts; n > c.MaxRestarts {
+			return fmt.Errorf("canary deployment %s containers restarted %d times", name, n)
+		}
+		if c.HealthURL != "" {
+			if err := checkHealthURL(c.HealthURL); err != nil {
+				return err
+			}
+		}
+		if !time.Now().Before(deadline) {
+			job.Logf("canary deployment %s is healthy after bake period", name)
+			return nil
+		}
+		time.Sleep(c.interval())
+	}
+}
+
+// helper function to deploy request via canary deployment, the new image is
+// set on canary deployment first and promoted to main deployment after bake period
+func canaryDeploy(r Request, c *CanaryStrategy, job *Job) error {
+	if c == nil {
+		c = &CanaryStrategy{}
+	}
+	name := c.deployment(r)
+	job.Stage("canary", "started", fmt.Sprintf("set image %s on deployment %s", imageRef(r.Image, r.Tag), name))
+	prev, err := patchDeployment(name, r, job)
+	if err != nil {
+		job.Stage("canary", "failed", err.Error())
+		return err
+	}
+	job.Stage("canary", "succeeded", "")
+
+	job.Stage("bake", "started", fmt.Sprintf("watch deployment %s for %v", name, c.bake()))
+	if err := c.watch(name, r.Namespace, job); err != nil {
+		job.Stage("bake", "failed", err.Error())
+		job.Stage("revert", "started", fmt.Sprintf("restore image %s on deployment %s", prev, name))
+		if prev == "" {
+			job.Stage("revert", "failed", "unknown previous image")
+			return fmt.Errorf("canary failed: %v, unable to revert canary deployment with unknown previous image", err)
+		}
+		if rerr := restoreDeployment(name, r, prev, job); rerr != nil {
+			job.Stage("revert", "failed", rerr.Error())
+			return fmt.Errorf("canary failed: %v, unable to revert canary deployment: %v", err, rerr)
+		}
+		job.Stage("revert", "succeeded", "")
+		return fmt.Errorf("%w, canary failed: %v", errRolledBack, err)
+	}
+	job.Stage("bake", "succeeded", "")
+
+	job.Stage("promote", "started", fmt.Sprintf("set image %s on deployment %s", imageRef(r.Image, r.Tag), r.Service))
+	if err := kubectlDeploy(r, job); err != nil {
+		job.Stage("promote", "failed", err.Error())
+		return err
+	}
+	job.Stage("promote", "succeeded", "")
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// helper function to fake kubectl commands of canary deployment with given restart count of canary pods
+func fakeCanary(t *testing.T, restarts *int) *[]string {
+	images := map[string]string{"srv": "repo/srv:0.1", "srv-canary": "repo/srv:0.1"}
+	return fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment") && strings.HasSuffix(cmd, "-o yaml"):
+			name := strings.Split(cmd, " ")[3]
+			return []byte(fmt.Sprintf("spec:\n  containers:\n  - image: %s\n", images[name])), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			return []byte("configured"), nil
+		case strings.HasPrefix(cmd, "kubectl rollout status"):
+			return []byte("successfully rolled out"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment srv-canary"):
+			return []byte(`{"spec": {"replicas": 1, "selector": {"matchLabels": {"app": "srv-canary"}}},
+				"status": {"replicas": 1, "readyReplicas": 1, "updatedReplicas": 1}}`), nil
+		case strings.HasPrefix(cmd, "kubectl get pods -n test -l app=srv-canary"):
+			rec := fmt.Sprintf(`{"items": [{"status": {"containerStatuses": [{"restartCount": %d}]}}]}`, *restarts)
+			*restarts += 2
+			return []byte(rec), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+}
+
+// TestCanaryDeploy
+func TestCanaryDeploy(t *testing.T) {
+	restarts := 0
+	calls := fakeCanary(t, &restarts)
+	c := &CanaryStrategy{Bake: 1, Interval: 1, MaxRestarts: 10}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	if err := canaryDeploy(r, c, job); err != nil {
+		t.Fatal(err)
+	}
+	var stages []string
+	for _, s := range job.Stages {
+		stages = append(stages, s.Name+":"+s.Status)
+	}
+	expect := "canary:started canary:succeeded bake:started bake:succeeded promote:started promote:succeeded"
+	if strings.Join(stages, " ") != expect {
+		t.Errorf("Fail TestCanaryDeploy, wrong stages %v\n", stages)
+	}
+	if !InList("kubectl get deployment srv -n test -o yaml", *calls) {
+		t.Errorf("Fail TestCanaryDeploy, main deployment is not promoted %v\n", *calls)
+	}
+}
+
+// TestCanaryRevert
+func TestCanaryRevert(t *testing.T) {
+	restarts := 0
+	calls := fakeCanary(t, &restarts)
+	c := &CanaryStrategy{Bake: 1, Interval: 1}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	err := canaryDeploy(r, c, job)
+	if !errors.Is(err, errRolledBack) {
+		t.Fatalf("Fail TestCanaryRevert, wrong error %v\n", err)
+	}
+	last := job.Stages[len(job.Stages)-1]
+	if last.Name != "revert" || last.Status != "succeeded" {
+		t.Errorf("Fail TestCanaryRevert, wrong last stage %+v\n", last)
+	}
+	if InList("kubectl get deployment srv -n test -o yaml", *calls) {
+		t.Errorf("Fail TestCanaryRevert, main deployment should not be changed %v\n", *calls)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+// changelog module collects changes between deployed and requested versions
+// of the service
+//
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Changelog represents changes between deployed and requested versions
+type Changelog struct {
+	From      string            `json:"from"`                // tag deployed before the request
+	To        string            `json:"to"`                  // requested tag
+	Commits   []ChangelogCommit `json:"commits"`             // commits between the tags
+	Truncated bool              `json:"truncated,omitempty"` // changelog is truncated
+}
+
+// ChangelogCommit represents commit of the changelog
+type ChangelogCommit struct {
+	Sha         string `json:"sha"`                    // commit SHA
+	Message     string `json:"message"`                // first line of commit message
+	Author      string `json:"author"`                 // commit author
+	PullRequest int    `json:"pull_request,omitempty"` // number of merged pull request
+	Title       string `json:"title,omitempty"`        // title of merged pull request
+}
+
+// ChangelogProvider represents source provider which can compare repository refs
+type ChangelogProvider interface {
+	Compare(repo, from, to string) ([]ChangelogCommit, error) // commits between given refs
+}
+
+// PullRequestProvider represents source provider which reports pull requests of commits
+type PullRequestProvider interface {
+	PullRequest(repo, sha string) (int, string, error) // number and title of merged pull request of the commit
+}
+
+// max number of commits kept in changelog
+const maxChangelogCommits = 100
+
+// helper function to create changelog commit from full commit message
+func newChangelogCommit(sha, message, author string) ChangelogCommit {
+	arr := strings.SplitN(strings.TrimSpace(message), "\n", 2)
+	return ChangelogCommit{Sha: sha, Message: strings.TrimSpace(arr[0]), Author: author}
+}
+
+// helper function to find image of the service deployed before the request,
+// image of k8s deployment is read from the cluster while images of other
+// targets are taken from the last successful deployment of the service
+func deployedImage(r Request, policy ServicePolicy) string {
+	if (policy.Target == "" || policy.Target == "kubectl") && policy.Strategy != "bluegreen" {
+		out, err := runCommand("kubectl", "get", "deployment", r.Service, "-n", r.Namespace, "-o", "yaml")
+		if err != nil {
+			return ""
+		}
+		return currentImage(string(out), r)
+	}
+	if deployHistory == nil {
+		return ""
+	}
+	recs, _ := deployHistory.Query(HistoryFilter{Service: r.Service, Namespace: r.Namespace, Outcome: JobSucceeded})
+	for _, rec := range recs {
+		if rec.Action == "" && rec.NewImage != "" {
+			return rec.NewImage
+		}
+	}
+	return ""
+}
+
+// helper function to collect changelog between tag deployed before the
+// request and requested tag, it is collected before deployment so hooks and
+// records of failed deployments get it; failures are logged to the job only
+func collectChangelog(r Request, policy ServicePolicy, job *Job) {
+	if !policy.Changelog || job == nil {
+		return
+	}
+	prev := deployedImage(r, policy)
+	// images pinned to digest, e.g. 1.2@sha256:..., are compared by their tag
+	from := strings.SplitN(imageTag(prev, r.Image), "@", 2)[0]
+	if from == "" || from == prev || from == r.Tag || strings.HasPrefix(from, "sha256:") {
+		job.Logf("unable to determine deployed tag of %s from image %s, skip changelog", r.workload(), prev)
+		return
+	}
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		job.Logf("unable to collect changelog, error %v", err)
+		return
+	}
+	provider, ok := src.(ChangelogProvider)
+	if !ok {
+		job.Logf("source provider of %s does not support changelog", r.Repository)
+		return
+	}
+	commits, err := provider.Compare(r.Repository, from, r.Tag)
+	if err != nil {
+		job.Logf("unable to collect changelog %s...%s, error %v", from, r.Tag, err)
+		return
+	}
+	cl := &Changelog{From: from, To: r.Tag, Commits: commits}
+	if len(cl.Commits) > maxChangelogCommits {
+		cl.Commits = cl.Commits[len(cl.Commits)-maxChangelogCommits:]
+		cl.Truncated = true
+	}
+	if pp, ok := src.(PullRequestProvider); ok {
+		for i, c := range cl.Commits {
+			number, title, err := pp.PullRequest(r.Repository, c.Sha)
+			if err != nil {
+				job.Logf("unable to get pull request of commit %s, error %v", c.Sha, err)
+				break
+			}
+			cl.Commits[i].PullRequest = number
+			cl.Commits[i].Title = title
+		}
+	}
+	job.update(func(j *Job) { j.Changelog = cl })
+	job.Logf("changelog %s...%s contains %d commits", from, r.Tag, len(commits))
+}
+
+// GitHubCompare represents response of GitHub and Gitea compare API
+type GitHubCompare struct {
+	Commits []struct {
+		Sha    string `json:"sha"`
+		Commit struct {
+			Message string       `json:"message"`
+			Author  GitHubAuthor `json:"author"`
+		} `json:"commit"`
+	} `json:"commits"`
+}
+
+// helper function to convert compare response into changelog commits
+func (c GitHubCompare) changelog() []ChangelogCommit {
+	var out []ChangelogCommit
+	for _, rec := range c.Commits {
+		out = append(out, newChangelogCommit(rec.Sha, rec.Commit.Message, rec.Commit.Author.Name))
+	}
+	return out
+}
+
+// Compare implements ChangelogProvider interface
+func (p *GitHubProvider) Compare(repo, from, to string) ([]ChangelogCommit, error) {
+	c := p.github()
+	var rec GitHubCompare
+	rurl := fmt.Sprintf("%s/repos/%s/compare/%s...%s", c.api(), repo, url.PathEscape(from), url.PathEscape(to))
+	if err := c.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	return rec.changelog(), nil
+}
+
+// PullRequest implements PullRequestProvider interface
+func (p *GitHubProvider) PullRequest(repo, sha string) (int, string, error) {
+	c := p.github()
+	var rec []struct {
+		Number   int    `json:"number"`
+		Title    string `json:"title"`
+		MergedAt string `json:"merged_at"`
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/commits/%s/pulls", c.api(), repo, sha)
+	if err := c.get(rurl, &rec); err != nil {
+		if errors.Is(err, errNotFound) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	for _, pr := range rec {
+		if pr.MergedAt != "" {
+			return pr.Number, pr.Title, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// Compare implements ChangelogProvider interface
+func (p *GiteaProvider) Compare(repo, from, to string) ([]ChangelogCommit, error) {
+	var rec GitHubCompare
+	rurl := fmt.Sprintf("%s/repos/%s/compare/%s...%s", p.client.api(), repo, url.PathEscape(from), url.PathEscape(to))
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	return rec.changelog(), nil
+}
+
+// PullRequest implements PullRequestProvider interface
+func (p *GiteaProvider) PullRequest(repo, sha string) (int, string, error) {
+	var rec struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		Merged bool   `json:"merged"`
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/commits/%s/pull", p.client.api(), repo, url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		if errors.Is(err, errNotFound) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	if !rec.Merged {
+		return 0, "", nil
+	}
+	return rec.Number, rec.Title, nil
+}
+
+// Compare implements ChangelogProvider interface
+func (p *GitLabProvider) Compare(repo, from, to string) ([]ChangelogCommit, error) {
+	var rec struct {
+		Commits []struct {
+			ID         string `json:"id"`
+			Message    string `json:"message"`
+			AuthorName string `json:"author_name"`
+		} `json:"commits"`
+	}
+	query := url.Values{"from": []string{from}, "to": []string{to}}
+	rurl := fmt.Sprintf("%s/repository/compare?%s", p.project(repo), query.Encode())
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	var out []ChangelogCommit
+	for _, c := range rec.Commits {
+		out = append(out, newChangelogCommit(c.ID, c.Message, c.AuthorName))
+	}
+	return out, nil
+}
+
+// PullRequest implements PullRequestProvider interface, it reports merged merge request of the commit
+func (p *GitLabProvider) PullRequest(repo, sha string) (int, string, error) {
+	var rec []struct {
+		IID   int    `json:"iid"`
+		Title string `json:"title"`
+		State string `json:"state"`
+	}
+	rurl := fmt.Sprintf("%s/repository/commits/%s/merge_requests", p.project(repo), url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		if errors.Is(err, errNotFound) {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	for _, mr := range rec {
+		if mr.State == "merged" {
+			return mr.IID, mr.Title, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// ChangelogHandler provides changelog of given deployment job
+func ChangelogHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	start := time.Now()
+	defer logRequest(w, r, start, &status)
+	if r.Method != "GET" {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("%s/changelog", Config.Base))
+	id := strings.Trim(path, "/")
+	var cl *Changelog
+	found := false
+	if job, ok := jobManager.Get(id); ok {
+		cl = job.changelog()
+		found = true
+	} else if deployHistory != nil {
+		var rec DeployRecord
+		if rec, found = deployHistory.Get(id); found {
+			cl = rec.Changelog
+		}
+	}
+	if !found || cl == nil {
+		status = http.StatusNotFound
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, cl)
+}
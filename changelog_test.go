@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestNewChangelogCommit
+func TestNewChangelogCommit(t *testing.T) {
+	c := newChangelogCommit("a1", "Add history API (#15)\n\n* squashed", "user")
+	if c.PullRequest != 0 || c.Title != "" || c.Message != "Add history API (#15)" || c.Author != "user" {
+		t.Errorf("Fail TestNewChangelogCommit, wrong commit %+v\n", c)
+	}
+}
+
+// TestPullRequest
+func TestPullRequest(t *testing.T) {
+	gitlab := fakeSource(t, map[string]string{
+		"/api/v4/projects/group%2Fsrv/repository/commits/a1/merge_requests": `[{"iid": 7, "title": "Closed", "state": "closed"}, {"iid": 8, "title": "Add API", "state": "merged"}]`,
+		"/api/v4/projects/group%2Fsrv/repository/commits/a2/merge_requests": `[]`,
+	})
+	gitea := fakeSource(t, map[string]string{
+		"/api/v1/repos/group/srv/commits/a1/pull": `{"number": 8, "title": "Add API", "merged": true}`,
+	})
+	for _, config := range []SourceConfig{{Type: "gitlab", URL: gitlab.URL + "/api/v4"}, {Type: "gitea", URL: gitea.URL + "/api/v1"}} {
+		p, err := newSourceProvider(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pp := p.(PullRequestProvider)
+		if number, title, err := pp.PullRequest("group/srv", "a1"); err != nil || number != 8 || title != "Add API" {
+			t.Errorf("Fail TestPullRequest, %s pull request %d %s %v\n", config.Type, number, title, err)
+		}
+		if number, _, err := pp.PullRequest("group/srv", "a2"); err != nil || number != 0 {
+			t.Errorf("Fail TestPullRequest, %s commit without pull request %d %v\n", config.Type, number, err)
+		}
+	}
+}
+
+// TestCollectChangelog
+func TestCollectChangelog(t *testing.T) {
+	fakeGitHub(t, map[string]string{
+		"/repos/org/srv/compare/0.1...0.2": `{"commits": [
+			{"sha": "a1", "commit": {"message": "Add feature (#4)", "author": {"name": "Alice"}}},
+			{"sha": "a2", "commit": {"message": "Fix typo", "author": {"name": "Bob"}}}
+		]}`,
+		"/repos/org/srv/commits/a1/pulls": `[{"number": 4, "title": "Open", "merged_at": null}, {"number": 3, "title": "New feature", "merged_at": "2024-05-01T10:00:00Z"}]`,
+		"/repos/org/srv/commits/a2/pulls": `[]`,
+	})
+	fail := false
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment srv"):
+			return []byte("image: repo/srv:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			if fail {
+				return nil, errors.New("apply failed")
+			}
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	policies := Config.Policies
+	defer func() { Config.Policies = policies }()
+	Config.Policies = []ServicePolicy{{Service: "srv", Changelog: true}}
+
+	r := Request{Service: "srv", Namespace: "prod", Tag: "0.2", Image: "repo/srv", Repository: "org/srv", Commit: "abc"}
+	job := newJob(r)
+	if err := exeRequest(r, job); err != nil {
+		t.Fatal(err)
+	}
+	cl := job.Changelog
+	if cl == nil || cl.From != "0.1" || cl.To != "0.2" || len(cl.Commits) != 2 {
+		t.Fatalf("Fail TestCollectChangelog, wrong changelog %+v\n", cl)
+	}
+	if cl.Commits[0].PullRequest != 3 || cl.Commits[0].Title != "New feature" || cl.Commits[1].PullRequest != 0 || cl.Commits[1].Author != "Bob" {
+		t.Errorf("Fail TestCollectChangelog, wrong commits %+v\n", cl.Commits)
+	}
+	if rec := job.record(); rec.Changelog != cl {
+		t.Errorf("Fail TestCollectChangelog, changelog is not recorded %+v\n", rec)
+	}
+
+	// changelog is collected before deployment
+	fail = true
+	job = newJob(r)
+	if err := exeRequest(r, job); err == nil {
+		t.Fatal("Fail TestCollectChangelog, failed deployment succeeded")
+	}
+	if cl := job.changelog(); cl == nil || len(cl.Commits) != 2 {
+		t.Errorf("Fail TestCollectChangelog, wrong changelog of failed deployment %+v\n", cl)
+	}
+}
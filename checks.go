@@ -0,0 +1,280 @@
+package main
+
+// checks module gates deployments on CI checks and commit statuses of
+// request commit
+//
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ChecksPolicy represents CI checks required before deployment of the service
+type ChecksPolicy struct {
+	Required []string `json:"required"` // names of required check runs or commit status contexts
+	Timeout  int      `json:"timeout"`  // time in seconds pending checks are waited for, default 600
+}
+
+// states of CI checks
+const (
+	checkSuccess = "success"
+	checkPending = "pending"
+	checkFailure = "failure"
+	checkMissing = "missing"
+)
+
+// ChecksProvider represents source provider which reports CI checks of commits
+type ChecksProvider interface {
+	Checks(repo, sha string) (map[string]string, error) // states of checks by their names
+}
+
+// checksPollInterval defines how often pending checks are polled
+var checksPollInterval = 15 * time.Second
+
+// max number of pages of check runs
+const maxCheckPages = 10
+
+// helper function to return checks timeout
+func (c *ChecksPolicy) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Second
+	}
+	return 600 * time.Second
+}
+
+// helper function to evaluate required checks, it returns checks which are
+// not successful and whether any of them is still pending
+func (c *ChecksPolicy) evaluate(states map[string]string) (map[string]string, bool) {
+	bad := make(map[string]string)
+	pending := false
+	for _, name := range c.Required {
+		state, ok := states[name]
+		if !ok {
+			state = checkMissing
+		}
+		if state == checkSuccess {
+			continue
+		}
+		if state == checkPending || state == checkMissing {
+			pending = true
+		}
+		bad[name] = state
+	}
+	return bad, pending
+}
+
+// helper function to format checks and their states
+func formatChecks(checks map[string]string) string {
+	var out []string
+	for name, state := range checks {
+		out = append(out, fmt.Sprintf("%s (%s)", name, state))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ", ")
+}
+
+// helper function to wait for required checks of the request commit, pending
+// or missing checks are polled until policy timeout counted from job creation,
+// failed checks reject deployment. If requeue function is given pending checks
+// are not polled inline, instead the function is called after poll interval
+// and false is returned, so the caller does not hold its worker meanwhile
+func waitChecks(r Request, policy ServicePolicy, job *Job, requeue func()) (bool, error) {
+	cp := policy.Checks
+	if cp == nil || len(cp.Required) == 0 {
+		return true, nil
+	}
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		return false, err
+	}
+	provider, ok := src.(ChecksProvider)
+	if !ok {
+		return false, fmt.Errorf("source provider of %s does not report CI checks", r.Repository)
+	}
+	var created int64
+	started := false
+	job.update(func(j *Job) {
+		created = j.Created
+		for _, s := range j.Stages {
+			started = started || s.Name == "checks"
+		}
+	})
+	if !started {
+		job.Stage("checks", "started", fmt.Sprintf("wait for checks %s of commit %s", strings.Join(cp.Required, ", "), r.Commit))
+	}
+	deadline := time.Unix(created, 0).Add(cp.timeout())
+	for {
+		states, err := provider.Checks(r.Repository, r.Commit)
+		if err != nil {
+			job.Stage("checks", "failed", err.Error())
+			return false, err
+		}
+		bad, pending := cp.evaluate(states)
+		if len(bad) == 0 {
+			job.Stage("checks", "succeeded", "")
+			return true, nil
+		}
+		if !pending || time.Now().After(deadline) {
+			err := fmt.Errorf("required checks are not successful: %s", formatChecks(bad))
+			job.Stage("checks", "failed", err.Error())
+			return false, err
+		}
+		job.Logf("waiting for checks %s", formatChecks(bad))
+		if requeue != nil {
+			time.AfterFunc(checksPollInterval, requeue)
+			return false, nil
+		}
+		time.Sleep(checksPollInterval)
+	}
+}
+
+// helper function to merge check state, failed state takes precedence over
+// pending and pending over successful one
+func mergeCheck(states map[string]string, name, state string) {
+	rank := map[string]int{checkSuccess: 0, checkPending: 1, checkFailure: 2}
+	if prev, ok := states[name]; ok && rank[prev] >= rank[state] {
+		return
+	}
+	states[name] = state
+}
+
+// Checks implements ChecksProvider interface, it combines check runs and commit statuses
+func (p *GitHubProvider) Checks(repo, sha string) (map[string]string, error) {
+	c := p.github()
+	states := make(map[string]string)
+	rurl := fmt.Sprintf("%s/repos/%s/commits/%s/check-runs?per_page=100", c.api(), repo, sha)
+	for page := 1; rurl != ""; page++ {
+		if page > maxCheckPages {
+			return nil, fmt.Errorf("too many check runs of %s@%s", repo, sha)
+		}
+		var runs struct {
+			CheckRuns []struct {
+				Name       string `json:"name"`
+				Status     string `json:"status"`
+				Conclusion string `json:"conclusion"`
+			} `json:"check_runs"`
+		}
+		next, err := c.getPage(rurl, &runs)
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs.CheckRuns {
+			state := checkPending
+			if run.Status == "completed" {
+				switch run.Conclusion {
+				case "success", "neutral", "skipped":
+					state = checkSuccess
+				default:
+					state = checkFailure
+				}
+			}
+			mergeCheck(states, run.Name, state)
+		}
+		rurl = next
+	}
+	var status struct {
+		Statuses []struct {
+			Context string `json:"context"`
+			State   string `json:"state"`
+		} `json:"statuses"`
+	}
+	rurl = fmt.Sprintf("%s/repos/%s/commits/%s/status", c.api(), repo, sha)
+	if err := c.get(rurl, &status); err != nil {
+		return nil, err
+	}
+	for _, s := range status.Statuses {
+		state := checkFailure
+		switch s.State {
+		case "success":
+			state = checkSuccess
+		case "pending":
+			state = checkPending
+		}
+		mergeCheck(states, s.Context, state)
+	}
+	return states, nil
+}
+
+// Checks implements ChecksProvider interface
+func (p *GitLabProvider) Checks(repo, sha string) (map[string]string, error) {
+	var rec []struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+	}
+	rurl := fmt.Sprintf("%s/repository/commits/%s/statuses?per_page=100", p.project(repo), url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	states := make(map[string]string)
+	for _, s := range rec {
+		state := checkFailure
+		switch s.Status {
+		case "success", "skipped":
+			state = checkSuccess
+		case "created", "pending", "running", "waiting_for_resource", "preparing", "scheduled", "manual":
+			state = checkPending
+		}
+		mergeCheck(states, s.Name, state)
+	}
+	return states, nil
+}
+
+// Checks implements ChecksProvider interface
+func (p *GiteaProvider) Checks(repo, sha string) (map[string]string, error) {
+	var rec struct {
+		Statuses []struct {
+			Context string `json:"context"`
+			Status  string `json:"status"`
+		} `json:"statuses"`
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/commits/%s/status", p.client.api(), repo, url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	states := make(map[string]string)
+	for _, s := range rec.Statuses {
+		state := checkFailure
+		switch s.Status {
+		case "success", "warning":
+			state = checkSuccess
+		case "pending":
+			state = checkPending
+		}
+		mergeCheck(states, s.Context, state)
+	}
+	return states, nil
+}
+
+// Checks implements ChecksProvider interface
+func (p *BitbucketProvider) Checks(repo, sha string) (map[string]string, error) {
+	var rec struct {
+		Values []struct {
+			Key   string `json:"key"`
+			Name  string `json:"name"`
+			State string `json:"state"`
+		} `json:"values"`
+	}
+	rurl := fmt.Sprintf("%s/repositories/%s/commit/%s/statuses?pagelen=100", p.client.api(), repo, url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	states := make(map[string]string)
+	for _, s := range rec.Values {
+		state := checkFailure
+		switch s.State {
+		case "SUCCESSFUL":
+			state = checkSuccess
+		case "INPROGRESS":
+			state = checkPending
+		}
+		name := s.Name
+		if name == "" {
+			name = s.Key
+		}
+		mergeCheck(states, name, state)
+	}
+	return states, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWaitChecks
+func TestWaitChecks(t *testing.T) {
+	interval := checksPollInterval
+	defer func() { checksPollInterval = interval }()
+	checksPollInterval = 10 * time.Millisecond
+	polls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/org/srv/commits/abc/check-runs":
+			// check runs are paginated, next page is given by Link header
+			if r.URL.Query().Get("page") == "2" {
+				w.Write([]byte(`{"check_runs": [{"name": "e2e", "status": "completed", "conclusion": "success"}]}`))
+				return
+			}
+			next := fmt.Sprintf("http://%s%s?per_page=100&page=2", r.Host, r.URL.Path)
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", <%s>; rel="last"`, next, next))
+			w.Write([]byte(`{"check_runs": [{"name": "build", "status": "completed", "conclusion": "success"}, {"name": "lint", "status": "completed", "conclusion": "failure"}]}`))
+		case "/repos/org/srv/commits/abc/status":
+			polls++
+			if polls < 3 {
+				w.Write([]byte(`{"statuses": [{"context": "unit-tests", "state": "pending"}]}`))
+				return
+			}
+			w.Write([]byte(`{"statuses": [{"context": "unit-tests", "state": "success"}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	api := githubAPI
+	githubAPI = ts.URL
+	defer func() { githubAPI = api }()
+
+	r := Request{Service: "srv", Repository: "org/srv", Commit: "abc"}
+	job := newJob(r)
+	policy := ServicePolicy{Checks: &ChecksPolicy{Required: []string{"build", "unit-tests"}}}
+	if _, err := waitChecks(r, policy, job, nil); err != nil {
+		t.Fatalf("Fail TestWaitChecks, %v\n", err)
+	}
+	if polls != 3 {
+		t.Errorf("Fail TestWaitChecks, pending checks polled %d times\n", polls)
+	}
+
+	policy = ServicePolicy{Checks: &ChecksPolicy{Required: []string{"build", "e2e"}}}
+	if _, err := waitChecks(r, policy, newJob(r), nil); err != nil {
+		t.Errorf("Fail TestWaitChecks, check run of the next page, %v\n", err)
+	}
+
+	policy = ServicePolicy{Checks: &ChecksPolicy{Required: []string{"build", "lint"}}}
+	_, err := waitChecks(r, policy, newJob(r), nil)
+	if err == nil || !strings.Contains(err.Error(), "lint (failure)") {
+		t.Errorf("Fail TestWaitChecks, wrong error of failed check %v\n", err)
+	}
+
+	policy = ServicePolicy{Checks: &ChecksPolicy{Required: []string{"build", "deploy"}, Timeout: 1}}
+	checksPollInterval = 200 * time.Millisecond
+	_, err = waitChecks(r, policy, newJob(r), nil)
+	if err == nil || !strings.Contains(err.Error(), "deploy (missing)") {
+		t.Errorf("Fail TestWaitChecks, wrong error of missing check %v\n", err)
+	}
+}
+
+// TestQueuedChecks
+func TestQueuedChecks(t *testing.T) {
+	interval := checksPollInterval
+	defer func() { checksPollInterval = interval }()
+	checksPollInterval = 10 * time.Millisecond
+	fakeGitHub(t, map[string]string{
+		"/repos/org/srv/commits/abc/check-runs": `{"check_runs": []}`,
+		"/repos/org/srv/commits/abc/status":     `{"statuses": [{"context": "build", "state": "pending"}]}`,
+	})
+	policies := Config.Policies
+	defer func() { Config.Policies = policies }()
+	Config.Policies = []ServicePolicy{{Service: "srv", Checks: &ChecksPolicy{Required: []string{"build"}, Timeout: 1}}}
+
+	// queued job with pending checks is re-queued without taking its workload
+	mgr, err := newJobManager("", 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Request{Service: "srv", Namespace: "test", Repository: "org/srv", Commit: "abc"}
+	job := newJob(r)
+	mgr.add(job)
+	if err := mgr.run(job, false); err != nil || job.state() != JobQueued {
+		t.Fatalf("Fail TestQueuedChecks, job with pending checks state %s error %v\n", job.state(), err)
+	}
+	if mgr.slots.busy[r.workload()] {
+		t.Errorf("Fail TestQueuedChecks, job with pending checks holds its workload\n")
+	}
+	select {
+	case requeued := <-mgr.queue:
+		if requeued != job {
+			t.Errorf("Fail TestQueuedChecks, wrong job is re-queued\n")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Fail TestQueuedChecks, job with pending checks is not re-queued\n")
+	}
+
+	// checks pending after timeout fail the job
+	job.update(func(j *Job) { j.Created -= 10 })
+	if err := mgr.run(job, false); err == nil || job.state() != JobFailed || !strings.Contains(err.Error(), "build (pending)") {
+		t.Errorf("Fail TestQueuedChecks, wrong state %s of timed out job, error %v\n", job.state(), err)
+	}
+}
+
+// TestChecksAsync
+func TestChecksAsync(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+	fname := filepath.Join(t.TempDir(), "config.json")
+	policy := `"policies": [{"service": "srv", "checks": {"required": ["build"]}}]`
+	ioutil.WriteFile(fname, []byte(`{`+policy+`}`), 0644)
+	if err := parseConfig(fname); err == nil || !strings.Contains(err.Error(), "async") {
+		t.Errorf("Fail TestChecksAsync, checks policy is accepted in sync mode, error %v\n", err)
+	}
+	ioutil.WriteFile(fname, []byte(`{"async": true, `+policy+`}`), 0644)
+	if err := parseConfig(fname); err != nil {
+		t.Errorf("Fail TestChecksAsync, %v\n", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 )
@@ -23,6 +24,63 @@ type Configuration struct {
 	UTC           bool     `json:"utc"`           // use UTC for logging or not
 	MonitRecord   bool     `json:"monitRecord"`   // print on stdout monit record
 	TokenInterval int64    `json:"tokenInterval"` // token validity interval in seconds
+	Async         bool     `json:"async"`         // execute requests asynchronously and return job id
+	Workers       int      `json:"workers"`       // number of workers executing deployment jobs
+	QueueSize     int      `json:"queueSize"`     // max number of queued deployment jobs
+	MaxJobs       int      `json:"maxJobs"`       // max number of jobs to keep in job store
+	JobStore      string   `json:"jobStore"`      // path to file where jobs are persisted
+	HistoryStore  string   `json:"historyStore"`  // path to file where deployment records are stored
+	MaxHistory    int      `json:"maxHistory"`    // max number of deployment records to keep in history store
+
+	TrustedProxies []string `json:"trustedProxies"` // addresses or CIDRs of proxies trusted to set X-Forwarded-For
+
+	GitHub    GitHubConfig   `json:"github"`    // GitHub API client configuration
+	Providers []SourceConfig `json:"providers"` // source providers of service repositories
+	Registry  RegistryConfig `json:"registry"`  // default docker registry of images without registry host
+
+	Registries   []RegistryConfig `json:"registries"`   // docker registries of service images
+	DockerConfig string           `json:"dockerConfig"` // path to docker config.json or dockerconfigjson secret with registry credentials
+
+	Policies []ServicePolicy `json:"policies"` // deployment policies of services
+}
+
+// ServicePolicy represents deployment policy of the service
+type ServicePolicy struct {
+	Service   string             `json:"service"`   // service name
+	Namespace string             `json:"namespace"` // service namespace, empty value matches any namespace
+	Target    string             `json:"target"`    // deployment target: kubectl (default), gitops, helm or kustomize
+	GitOps    *GitOpsTarget      `json:"gitops"`    // gitops target configuration
+	Helm      *HelmTarget        `json:"helm"`      // helm target configuration
+	Kustomize *KustomizeTarget   `json:"kustomize"` // kustomize target configuration
+	Strategy  string             `json:"strategy"`  // deployment strategy of kubectl target: rolling (default), canary or bluegreen
+	Canary    *CanaryStrategy    `json:"canary"`    // canary strategy configuration
+	BlueGreen *BlueGreenStrategy `json:"bluegreen"` // blue/green strategy configuration
+	Hooks     *Hooks             `json:"hooks"`     // pre- and post-deploy hooks
+	Signature *SignaturePolicy   `json:"signature"` // signature policy of tags and commits
+	Protected *BranchPolicy      `json:"protected"` // protected branches request commit must be reachable from
+	Checks    *ChecksPolicy      `json:"checks"`    // CI checks required before deployment
+	Cosign    *CosignPolicy      `json:"cosign"`    // cosign signature policy of service images
+	SLSA      *SLSAPolicy        `json:"slsa"`      // build provenance policy of service images
+	Labels    *LabelPolicy       `json:"labels"`    // OCI labels policy of service images
+
+	Vulnerabilities *VulnPolicy `json:"vulnerabilities"` // vulnerability policy of service images
+
+	Deployments *GitHubDeployments `json:"githubDeployments"` // report deployments to GitHub Deployments API
+	Changelog   bool               `json:"changelog"`         // collect changelog between deployed and requested tags
+
+	AllowBranches bool   `json:"allowBranches"` // accept request tag matching a branch of source repository
+	AllowCommits  bool   `json:"allowCommits"`  // accept request commit existing in source repository without a ref
+	Provider      string `json:"provider"`      // name of source provider of service repository
+}
+
+// helper function to find deployment policy of given request
+func findPolicy(r Request) ServicePolicy {
+	for _, p := range Config.Policies {
+		if p.Service == r.Service && (p.Namespace == "" || p.Namespace == r.Namespace) {
+			return p
+		}
+	}
+	return ServicePolicy{Service: r.Service, Namespace: r.Namespace}
 }
 
 // Config variable represents configuration object
@@ -53,5 +111,24 @@ func parseConfig(configFile string) error {
 	if Config.WriteTimeout == 0 {
 		Config.WriteTimeout = 60
 	}
+	if Config.Workers == 0 {
+		Config.Workers = 4
+	}
+	if Config.QueueSize == 0 {
+		Config.QueueSize = 100
+	}
+	if Config.MaxJobs == 0 {
+		Config.MaxJobs = 1000
+	}
+	if Config.MaxHistory == 0 {
+		Config.MaxHistory = 10000
+	}
+	// pending CI checks are waited for up to their timeout which exceeds
+	// server write timeout of synchronous requests
+	for _, p := range Config.Policies {
+		if p.Checks != nil && len(p.Checks.Required) > 0 && !Config.Async {
+			return fmt.Errorf("checks policy of service %s requires async mode", p.Service)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,180 @@
+package main
+
+// cosign module provides verification of cosign signatures of service images
+//
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// CosignPolicy represents cosign signature policy of the service images
+type CosignPolicy struct {
+	Required bool     `json:"required"` // refuse deployment unless image is signed by trusted key
+	Keys     []string `json:"keys"`     // trusted public keys in PEM format or paths to them
+}
+
+// SimpleSigning represents payload of cosign signature
+type SimpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// cosign signature annotation and payload type
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignPayloadType         = "cosign container image signature"
+)
+
+// helper function to return tag of cosign artifact of given image digest and suffix,
+// e.g. sha256:abc becomes sha256-abc.sig
+func cosignTag(digest, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + "." + suffix
+}
+
+// helper function to parse public key given either in PEM format or as path to PEM file
+func parsePublicKey(key string) (interface{}, error) {
+	data := []byte(key)
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		var err error
+		if data, err = ioutil.ReadFile(key); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// helper function to verify signature of the payload with given public key,
+// ECDSA and RSA signatures are made over SHA256 digest of the payload
+func verifyPayload(key interface{}, payload, sig []byte) bool {
+	sum := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, sum[:], sig)
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) == nil {
+			return true
+		}
+		return rsa.VerifyPSS(k, crypto.SHA256, sum[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
+
+// helper function to fetch manifest of cosign artifact of given image digest
+func cosignArtifact(c *RegistryClient, name, digest, suffix string) (OCIManifest, error) {
+	var m OCIManifest
+	_, data, err := c.Manifest(name, cosignTag(digest, suffix))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// helper function to fetch blob of the layer and verify its digest
+func layerBlob(c *RegistryClient, name string, layer OCIDescriptor) ([]byte, error) {
+	data, err := c.Blob(name, layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if layer.Digest != "sha256:"+hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("digest mismatch of blob %s", layer.Digest)
+	}
+	return data, nil
+}
+
+// helper function to check cosign signature of requested image according to
+// service policy, digest of the image is resolved unless it is provided
+func checkCosign(r Request, policy ServicePolicy, digest string) error {
+	cp := policy.Cosign
+	if cp == nil || !cp.Required {
+		return nil
+	}
+	var keys []interface{}
+	for _, k := range cp.Keys {
+		key, err := parsePublicKey(k)
+		if err != nil {
+			return fmt.Errorf("invalid cosign key, error %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("no trusted cosign keys")
+	}
+	c, name := imageRegistry(r.Image)
+	if digest == "" {
+		var err error
+		if digest, err = c.ManifestDigest(name, r.Tag); err != nil {
+			return err
+		}
+	}
+	m, err := cosignArtifact(c, name, digest, "sig")
+	if errors.Is(err, errImageNotFound) {
+		return fmt.Errorf("image %s@%s is not signed", r.Image, digest)
+	}
+	if err != nil {
+		return err
+	}
+	var reasons []string
+	for _, layer := range m.Layers {
+		sig, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(sig) == 0 {
+			reasons = append(reasons, fmt.Sprintf("%s: no signature", layer.Digest))
+			continue
+		}
+		payload, err := layerBlob(c, name, layer)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", layer.Digest, err))
+			continue
+		}
+		verified := false
+		for _, key := range keys {
+			if verifyPayload(key, payload, sig) {
+				verified = true
+				break
+			}
+		}
+		if !verified {
+			reasons = append(reasons, fmt.Sprintf("%s: signature does not match trusted keys", layer.Digest))
+			continue
+		}
+		var ss SimpleSigning
+		if err := json.Unmarshal(payload, &ss); err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: invalid payload", layer.Digest))
+			continue
+		}
+		if ss.Critical.Type != cosignPayloadType || ss.Critical.Image.DockerManifestDigest != digest {
+			reasons = append(reasons, fmt.Sprintf("%s: payload signs %s", layer.Digest, ss.Critical.Image.DockerManifestDigest))
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid cosign signature of %s@%s (%s)", r.Image, digest, strings.Join(reasons, ", "))
+}
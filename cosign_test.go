@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// helper function to sign image digest with cosign simple signing payload,
+// it returns manifest of the signature artifact
+func cosignSignature(t *testing.T, reg *fakeRegistryServer, key *ecdsa.PrivateKey, image, digest string) OCIManifest {
+	payload := fmt.Sprintf(`{"critical": {"identity": {"docker-reference": "%s"}, "image": {"docker-manifest-digest": "%s"}, "type": "cosign container image signature"}, "optional": null}`, image, digest)
+	sum := sha256.Sum256([]byte(payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := reg.blob("application/vnd.dev.cosign.simplesigning.v1+json", []byte(payload))
+	layer.Annotations = map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)}
+	return OCIManifest{Config: reg.blob("application/vnd.oci.image.config.v1+json", []byte("{}")), Layers: []OCIDescriptor{layer}}
+}
+
+// helper function to generate ECDSA P-256 key, it returns key and PEM encoded public key
+func cosignKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// TestCheckCosign
+func TestCheckCosign(t *testing.T) {
+	reg := fakeRegistry(t)
+	key, pub := cosignKey(t)
+	other, _ := cosignKey(t)
+	image := reg.host + "/org/srv"
+	config := reg.blob("application/vnd.oci.image.config.v1+json", []byte(`{"config": {}}`))
+	signed := reg.manifest("org/srv", []string{"0.1"}, OCIManifest{Config: config})
+	reg.manifest("org/srv", []string{cosignTag(signed, "sig")}, cosignSignature(t, reg, key, image, signed))
+	reg.manifest("org/srv", []string{"0.2"}, OCIManifest{Config: config, Annotations: map[string]string{"v": "2"}})
+	forged := reg.manifest("org/srv", []string{"0.3"}, OCIManifest{Config: config, Annotations: map[string]string{"v": "3"}})
+	reg.manifest("org/srv", []string{cosignTag(forged, "sig")}, cosignSignature(t, reg, other, image, forged))
+	replayed := reg.manifest("org/srv", []string{"0.4"}, OCIManifest{Config: config, Annotations: map[string]string{"v": "4"}})
+	reg.manifest("org/srv", []string{cosignTag(replayed, "sig")}, cosignSignature(t, reg, key, image, signed))
+
+	policy := ServicePolicy{Service: "srv", Cosign: &CosignPolicy{Required: true, Keys: []string{pub}}}
+	r := Request{Service: "srv", Image: image, Tag: "0.1"}
+	if err := checkCosign(r, policy, ""); err != nil {
+		t.Errorf("Fail TestCheckCosign, signed image is refused, error %v\n", err)
+	}
+	tests := map[string]string{"0.2": "is not signed", "0.3": "does not match trusted keys", "0.4": "payload signs " + signed}
+	for tag, msg := range tests {
+		r.Tag = tag
+		if err := checkCosign(r, policy, ""); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Fail TestCheckCosign, tag %s, wrong error %v\n", tag, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+// deployments module reports imagebot deployments to GitHub Deployments API
+//
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// GitHubDeployments represents configuration of GitHub deployments of the service
+type GitHubDeployments struct {
+	Environment    string `json:"environment"`    // environment name, default request namespace
+	EnvironmentURL string `json:"environmentUrl"` // URL of deployed environment
+	LogURL         string `json:"logUrl"`         // base URL of imagebot, job URL is used as deployment log URL
+	Production     bool   `json:"production"`     // environment is production one
+}
+
+// GitHubDeployment represents GitHub deployment request
+type GitHubDeployment struct {
+	ID                    int64             `json:"id,omitempty"`
+	Ref                   string            `json:"ref"`
+	Environment           string            `json:"environment"`
+	Description           string            `json:"description"`
+	AutoMerge             bool              `json:"auto_merge"`
+	RequiredContexts      []string          `json:"required_contexts"`
+	ProductionEnvironment bool              `json:"production_environment"`
+	Payload               map[string]string `json:"payload"`
+}
+
+// GitHubDeploymentStatus represents GitHub deployment status
+type GitHubDeploymentStatus struct {
+	State          string `json:"state"`
+	Description    string `json:"description,omitempty"`
+	LogURL         string `json:"log_url,omitempty"`
+	EnvironmentURL string `json:"environment_url,omitempty"`
+	AutoInactive   bool   `json:"auto_inactive"`
+}
+
+// max length of deployment status description accepted by GitHub
+const maxDeploymentDescription = 140
+
+// helper function to return GitHub client and repository of the request
+func deploymentClient(r Request, policy ServicePolicy) (*GitHubClient, error) {
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := src.(*GitHubProvider)
+	if !ok {
+		return nil, fmt.Errorf("repository %s is not hosted on GitHub", r.Repository)
+	}
+	return p.github(), nil
+}
+
+// helper function to create GitHub deployment of the job, failures are
+// logged to the job and do not affect the deployment itself. Deployment of
+// the job re-queued e.g. after server restart is reused
+func startDeployment(r Request, policy ServicePolicy, job *Job) {
+	gd := policy.Deployments
+	if gd == nil || job == nil {
+		return
+	}
+	var id int64
+	job.update(func(j *Job) { id = j.DeploymentID })
+	if id != 0 {
+		job.Logf("reuse GitHub deployment %d of %s", id, r.Repository)
+		reportDeployment(r, policy, job, "in_progress", "deployment restarted")
+		return
+	}
+	c, err := deploymentClient(r, policy)
+	if err != nil {
+		job.Logf("unable to create GitHub deployment, error %v", err)
+		return
+	}
+	env := gd.Environment
+	if env == "" {
+		env = r.Namespace
+	}
+	dep := GitHubDeployment{
+		Ref:                   r.Commit,
+		Environment:           env,
+		Description:           fmt.Sprintf("imagebot deployment of %s to %s", imageRef(r.Image, r.Tag), r.workload()),
+		RequiredContexts:      []string{},
+		ProductionEnvironment: gd.Production,
+		Payload:               map[string]string{"job_id": job.ID, "image": imageRef(r.Image, r.Tag), "service": r.Service},
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/deployments", c.api(), r.Repository)
+	if err := c.post(rurl, dep, &dep); err != nil {
+		job.Logf("unable to create GitHub deployment, error %v", err)
+		return
+	}
+	job.update(func(j *Job) { j.DeploymentID = dep.ID })
+	job.Logf("created GitHub deployment %d of %s to environment %s", dep.ID, r.Repository, env)
+	reportDeployment(r, policy, job, "in_progress", "deployment started")
+}
+
+// helper function to post status of GitHub deployment of the job
+func reportDeployment(r Request, policy ServicePolicy, job *Job, state, desc string) {
+	gd := policy.Deployments
+	if gd == nil || job == nil {
+		return
+	}
+	var id int64
+	job.update(func(j *Job) { id = j.DeploymentID })
+	if id == 0 {
+		return
+	}
+	c, err := deploymentClient(r, policy)
+	if err != nil {
+		job.Logf("unable to report GitHub deployment status, error %v", err)
+		return
+	}
+	if len(desc) > maxDeploymentDescription {
+		desc = desc[:maxDeploymentDescription]
+	}
+	status := GitHubDeploymentStatus{
+		State:          state,
+		Description:    desc,
+		EnvironmentURL: gd.EnvironmentURL,
+		AutoInactive:   true,
+	}
+	if gd.LogURL != "" {
+		status.LogURL = fmt.Sprintf("%s/jobs/%s", strings.TrimSuffix(gd.LogURL, "/"), job.ID)
+	}
+	rurl := fmt.Sprintf("%s/repos/%s/deployments/%d/statuses", c.api(), r.Repository, id)
+	if err := c.post(rurl, status, nil); err != nil {
+		job.Logf("unable to report GitHub deployment status %s, error %v", state, err)
+		return
+	}
+	job.Logf("GitHub deployment %d status %s", id, state)
+}
+
+// helper function to report final status of GitHub deployment according to
+// outcome of the job: success, failure or inactive after rollback
+func finishDeployment(r Request, policy ServicePolicy, job *Job, err error) {
+	switch {
+	case err == nil:
+		reportDeployment(r, policy, job, "success", "deployment succeeded")
+	case errors.Is(err, errRolledBack):
+		reportDeployment(r, policy, job, "inactive", err.Error())
+	default:
+		reportDeployment(r, policy, job, "failure", err.Error())
+	}
+}
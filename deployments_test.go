@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestGitHubDeployments
+func TestGitHubDeployments(t *testing.T) {
+	var deployments []GitHubDeployment
+	var statuses []GitHubDeploymentStatus
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/repos/org/srv/deployments":
+			var dep GitHubDeployment
+			json.NewDecoder(r.Body).Decode(&dep)
+			deployments = append(deployments, dep)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 42}`))
+		case r.Method == "POST" && r.URL.Path == "/repos/org/srv/deployments/42/statuses":
+			var status GitHubDeploymentStatus
+			json.NewDecoder(r.Body).Decode(&status)
+			statuses = append(statuses, status)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": 1}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	api := githubAPI
+	githubAPI = ts.URL
+	defer func() { githubAPI = api }()
+
+	fail := false
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment srv"):
+			return []byte("image: repo/srv:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			if fail {
+				return nil, errors.New("apply failed")
+			}
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	policies := Config.Policies
+	defer func() { Config.Policies = policies }()
+	Config.Policies = []ServicePolicy{
+		{Service: "srv", Deployments: &GitHubDeployments{LogURL: "https://imagebot.test/"}},
+	}
+
+	r := Request{Service: "srv", Namespace: "prod", Tag: "0.2", Image: "repo/srv", Repository: "org/srv", Commit: "abc"}
+	job := newJob(r)
+	if err := exeRequest(r, job); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments) != 1 || deployments[0].Ref != "abc" || deployments[0].Environment != "prod" || deployments[0].Payload["job_id"] != job.ID {
+		t.Errorf("Fail TestGitHubDeployments, wrong deployment %+v\n", deployments)
+	}
+	if len(statuses) != 2 || statuses[0].State != "in_progress" || statuses[1].State != "success" {
+		t.Fatalf("Fail TestGitHubDeployments, wrong statuses %+v\n", statuses)
+	}
+	if statuses[1].LogURL != "https://imagebot.test/jobs/"+job.ID {
+		t.Errorf("Fail TestGitHubDeployments, wrong log url %s\n", statuses[1].LogURL)
+	}
+
+	fail = true
+	statuses = nil
+	if err := exeRequest(r, newJob(r)); err == nil {
+		t.Fatal("Fail TestGitHubDeployments, failed deployment succeeded")
+	}
+	if len(statuses) != 2 || statuses[1].State != "failure" || !strings.Contains(statuses[1].Description, "apply failed") {
+		t.Errorf("Fail TestGitHubDeployments, wrong statuses of failed deployment %+v\n", statuses)
+	}
+
+	statuses = nil
+	finishDeployment(r, Config.Policies[0], job, errRolledBack)
+	if len(statuses) != 1 || statuses[0].State != "inactive" {
+		t.Errorf("Fail TestGitHubDeployments, wrong status of rolled back deployment %+v\n", statuses)
+	}
+
+	// re-queued job reuses its deployment
+	deployments, statuses = nil, nil
+	startDeployment(r, Config.Policies[0], job)
+	if len(deployments) != 0 || len(statuses) != 1 || statuses[0].State != "in_progress" {
+		t.Errorf("Fail TestGitHubDeployments, deployment of re-queued job is not reused %+v %+v\n", deployments, statuses)
+	}
+}
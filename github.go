@@ -4,9 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
 )
 
 // GitHubObject represents response github object
@@ -24,30 +21,118 @@ type GitHubResponse struct {
 	Object GitHubObject `json:"object"`
 }
 
-// helper function to get commit of the request
-func getCommit(r Request) (string, error) {
+// GitHubTag represents github annotated tag object
+type GitHubTag struct {
+	Tag          string             `json:"tag"`
+	Sha          string             `json:"sha"`
+	Object       GitHubObject       `json:"object"`
+	Tagger       GitHubAuthor       `json:"tagger"`
+	Verification GitHubVerification `json:"verification"`
+}
+
+// GitHubCommit represents github commit
+type GitHubCommit struct {
+	Sha          string             `json:"sha"`
+	Committer    GitHubAuthor       `json:"committer"`
+	Verification GitHubVerification `json:"verification"`
+}
+
+// GitHubAuthor represents author, committer or tagger of github object
+type GitHubAuthor struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// GitHubVerification represents signature verification of github object
+type GitHubVerification struct {
+	Verified  bool   `json:"verified"`
+	Reason    string `json:"reason"`
+	Signature string `json:"signature"`
+	Payload   string `json:"payload"`
+}
+
+// githubAPI represents default GitHub API URL
+var githubAPI = "https://api.github.com"
+
+// errNotFound is returned when object does not exist in source repository
+var errNotFound = errors.New("not found")
+
+// max depth of nested annotated tags
+const maxTagDepth = 5
+
+// GitHubProvider represents GitHub source provider
+type GitHubProvider struct {
+	client *GitHubClient
+}
+
+// helper function to return GitHub client of the provider
+func (p *GitHubProvider) github() *GitHubClient {
+	if p.client != nil {
+		return p.client
+	}
+	return ghClient
+}
+
+// helper function to get object git reference of the repository points to
+func (p *GitHubProvider) refObject(repo, ref string) (GitHubObject, error) {
+	c := p.github()
 	// https://api.github.com/repos/<repo>/git/refs/tags/<tag>
-	rurl := fmt.Sprintf("https://api.github.com/repos/%s/git/refs/tags/%s", r.Repository, r.Tag)
-	resp, err := http.Get(rurl)
-	if err != nil {
-		return "", err
+	rurl := fmt.Sprintf("%s/repos/%s/git/refs/%s", c.api(), repo, ref)
+	var rec GitHubResponse
+	if err := c.get(rurl, &rec); err != nil {
+		// github returns list of refs matching given prefix if exact ref does not exist
+		var ute *json.UnmarshalTypeError
+		if errors.As(err, &ute) {
+			return GitHubObject{}, fmt.Errorf("refs/%s: %w", ref, errNotFound)
+		}
+		return GitHubObject{}, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if Config.Verbose > 0 {
-		log.Println("request", rurl, "response", string(body))
+	if rec.Ref != fmt.Sprintf("refs/%s", ref) {
+		return GitHubObject{}, fmt.Errorf("github ref does not match %s!=refs/%s", rec.Ref, ref)
 	}
+	return rec.Object, nil
+}
+
+// helper function to resolve git reference of the repository into commit SHA,
+// annotated tags are dereferenced to the commit they point to
+func (p *GitHubProvider) resolveRef(repo, ref string) (string, error) {
+	c := p.github()
+	obj, err := p.refObject(repo, ref)
 	if err != nil {
 		return "", err
 	}
-	var rec GitHubResponse
-	err = json.Unmarshal(body, &rec)
-	if err != nil {
-		return "", err
+	for i := 0; obj.Type == "tag"; i++ {
+		if i == maxTagDepth {
+			return "", fmt.Errorf("too many nested tags in refs/%s", ref)
+		}
+		var tag GitHubTag
+		turl := fmt.Sprintf("%s/repos/%s/git/tags/%s", c.api(), repo, obj.Sha)
+		if err := c.get(turl, &tag); err != nil {
+			return "", err
+		}
+		obj = tag.Object
 	}
-	if rec.URL != rurl {
-		msg := fmt.Sprintf("github url does not match %s!=%s", rec.URL, rurl)
-		return "", errors.New(msg)
+	if obj.Type != "" && obj.Type != "commit" {
+		return "", fmt.Errorf("refs/%s points to %s object", ref, obj.Type)
 	}
-	return rec.Object.Sha, nil
+	return obj.Sha, nil
+}
+
+// ResolveTag implements SourceProvider interface
+func (p *GitHubProvider) ResolveTag(repo, tag string) (string, error) {
+	return p.resolveRef(repo, fmt.Sprintf("tags/%s", tag))
+}
+
+// ResolveBranch implements SourceProvider interface
+func (p *GitHubProvider) ResolveBranch(repo, branch string) (string, error) {
+	return p.resolveRef(repo, fmt.Sprintf("heads/%s", branch))
+}
+
+// VerifyCommit implements SourceProvider interface
+func (p *GitHubProvider) VerifyCommit(repo, sha string) (string, error) {
+	c := p.github()
+	var rec GitHubCommit
+	rurl := fmt.Sprintf("%s/repos/%s/commits/%s", c.api(), repo, sha)
+	err := c.get(rurl, &rec)
+	return rec.Sha, err
 }
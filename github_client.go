@@ -0,0 +1,424 @@
+package main
+
+// github_client module provides authenticated GitHub API client with
+// conditional caching and rate limit handling
+//
+
+import (
+	"bytes"
+	"container/list"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitHubConfig represents configuration of GitHub API client
+type GitHubConfig struct {
+	URL            string `json:"url"`            // GitHub API URL, e.g. https://ghe.example.com/api/v3 for GitHub Enterprise
+	Token          string `json:"token"`          // personal access token
+	Username       string `json:"username"`       // user name for basic authentication with token as password
+	AppID          int64  `json:"appId"`          // GitHub App id
+	InstallationID int64  `json:"installationId"` // GitHub App installation id
+	PrivateKey     string `json:"privateKey"`     // path to GitHub App private key in PEM format
+	Timeout        int    `json:"timeout"`        // HTTP timeout in seconds, default 30
+	Retries        int    `json:"retries"`        // number of retries of rate limited or failed requests, default 3
+	MaxWait        int    `json:"maxWait"`        // max wait for rate limit reset in seconds, default 60
+}
+
+// GitHubClient represents GitHub API client
+type GitHubClient struct {
+	config      GitHubConfig
+	client      *http.Client
+	key         *rsa.PrivateKey
+	mu          sync.Mutex
+	cache       *githubCache
+	token       string    // installation token of GitHub App
+	tokenExpire time.Time // expiration time of installation token
+}
+
+// githubCacheEntry represents cached GitHub response
+type githubCacheEntry struct {
+	url    string
+	etag   string
+	header http.Header
+	body   []byte
+}
+
+// githubCache represents bounded LRU cache of GitHub responses,
+// it should be used with client lock held
+type githubCache struct {
+	size  int
+	order *list.List               // entries from most to least recently used
+	items map[string]*list.Element // entries by their URLs
+}
+
+// max number of cached GitHub responses
+const maxGitHubCache = 1000
+
+// helper function to create GitHub cache of given size
+func newGitHubCache(size int) *githubCache {
+	return &githubCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// helper function to get cached response of given URL
+func (c *githubCache) get(rurl string) (githubCacheEntry, bool) {
+	elem, ok := c.items[rurl]
+	if !ok {
+		return githubCacheEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(githubCacheEntry), true
+}
+
+// helper function to cache response of given URL, least recently used
+// responses are evicted once cache is full
+func (c *githubCache) add(entry githubCacheEntry) {
+	if elem, ok := c.items[entry.url]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[entry.url] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.items, elem.Value.(githubCacheEntry).url)
+	}
+}
+
+// githubSleep is used to wait between retries of GitHub requests
+var githubSleep = time.Sleep
+
+// ghClient represents GitHub client used by imagebot
+var ghClient, _ = newGitHubClient(GitHubConfig{})
+
+// helper function to create GitHub client with given configuration
+func newGitHubClient(config GitHubConfig) (*GitHubClient, error) {
+	timeout := 30 * time.Second
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	c := &GitHubClient{
+		config: config,
+		client: &http.Client{Timeout: timeout},
+		cache:  newGitHubCache(maxGitHubCache),
+	}
+	if config.AppID != 0 {
+		data, err := ioutil.ReadFile(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		c.key, err = parsePrivateKey(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// helper function to parse RSA private key in PKCS1 or PKCS8 PEM format
+func parsePrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if rkey, ok := key.(*rsa.PrivateKey); ok {
+		return rkey, nil
+	}
+	return nil, errors.New("private key is not RSA key")
+}
+
+// helper function to return copy of the client authenticated with given token
+func (c *GitHubClient) withToken(token string) *GitHubClient {
+	config := c.config
+	config.Token = token
+	config.AppID = 0
+	return &GitHubClient{config: config, client: c.client, cache: newGitHubCache(maxGitHubCache)}
+}
+
+// helper function to return GitHub API URL
+func (c *GitHubClient) api() string {
+	if c.config.URL != "" {
+		return strings.TrimSuffix(c.config.URL, "/")
+	}
+	return githubAPI
+}
+
+// helper function to return number of retries
+func (c *GitHubClient) retries() int {
+	if c.config.Retries > 0 {
+		return c.config.Retries
+	}
+	return 3
+}
+
+// helper function to return max wait for rate limit reset
+func (c *GitHubClient) maxWait() time.Duration {
+	if c.config.MaxWait > 0 {
+		return time.Duration(c.config.MaxWait) * time.Second
+	}
+	return 60 * time.Second
+}
+
+// helper function to create JWT of GitHub App signed by its private key
+func (c *GitHubClient) appJWT() (string, error) {
+	now := time.Now().Unix()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now - 60,
+		"exp": now + 540,
+		"iss": fmt.Sprintf("%d", c.config.AppID),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := fmt.Sprintf("%s.%s", header, base64.RawURLEncoding.EncodeToString(claims))
+	hash := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s", payload, base64.RawURLEncoding.EncodeToString(sig)), nil
+}
+
+// helper function to get installation token of GitHub App, the token is
+// cached until it is about to expire
+func (c *GitHubClient) installationToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Add(time.Minute).Before(c.tokenExpire) {
+		return c.token, nil
+	}
+	jwt, err := c.appJWT()
+	if err != nil {
+		return "", err
+	}
+	rurl := fmt.Sprintf("%s/app/installations/%d/access_tokens", c.api(), c.config.InstallationID)
+	req, err := http.NewRequest("POST", rurl, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwt))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unable to get installation token, status %d, response %s", resp.StatusCode, string(body))
+	}
+	var rec struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return "", err
+	}
+	c.token = rec.Token
+	c.tokenExpire = rec.ExpiresAt
+	return c.token, nil
+}
+
+// helper function to return authorization header of the client
+func (c *GitHubClient) authorization() (string, error) {
+	if c.config.AppID != 0 {
+		token, err := c.installationToken()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("token %s", token), nil
+	}
+	if c.config.Username != "" {
+		creds := fmt.Sprintf("%s:%s", c.config.Username, c.config.Token)
+		return fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(creds))), nil
+	}
+	if c.config.Token != "" {
+		return fmt.Sprintf("Bearer %s", c.config.Token), nil
+	}
+	return "", nil
+}
+
+// helper function to return time to wait before retry of rate limited response,
+// it returns false if response is not rate limited
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if sec, err := strconv.Atoi(v); err == nil {
+			return time.Duration(sec) * time.Second, true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return time.Minute, true
+		}
+		wait := time.Until(time.Unix(reset, 0))
+		if wait < time.Second {
+			wait = time.Second
+		}
+		return wait, true
+	}
+	return 0, resp.StatusCode == http.StatusTooManyRequests
+}
+
+// helper function to send request to GitHub API, GET responses are cached
+// by their ETag and rate limited requests are retried once the limit is reset.
+// Failed requests are retried with backoff only if they are idempotent, since
+// e.g. POST request may be processed even if its response is lost
+func (c *GitHubClient) do(method, rurl string, data []byte) (int, http.Header, []byte, error) {
+	auth, err := c.authorization()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	idempotent := method == "GET" || method == "HEAD"
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, rurl, bytes.NewBuffer(data))
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if data != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		c.mu.Lock()
+		entry, cached := c.cache.get(rurl)
+		c.mu.Unlock()
+		if method == "GET" && cached {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if idempotent && attempt < c.retries() {
+				log.Printf("github request %s failed, error %v, retry in %v", rurl, err, backoff)
+				githubSleep(backoff)
+				backoff *= 2
+				continue
+			}
+			return 0, nil, nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if Config.Verbose > 0 {
+			log.Println("request", method, rurl, "status", resp.StatusCode, "response", string(body))
+		}
+		if wait, limited := rateLimitWait(resp); limited {
+			if attempt >= c.retries() || wait > c.maxWait() {
+				return resp.StatusCode, resp.Header, body, fmt.Errorf("github rate limit exceeded for %s, reset in %v", rurl, wait.Round(time.Second))
+			}
+			if wait == 0 {
+				wait = backoff
+				backoff *= 2
+			}
+			log.Printf("github rate limit exceeded for %s, retry in %v", rurl, wait)
+			githubSleep(wait)
+			continue
+		}
+		if idempotent && resp.StatusCode >= 500 && attempt < c.retries() {
+			log.Printf("github request %s returned status %d, retry in %v", rurl, resp.StatusCode, backoff)
+			githubSleep(backoff)
+			backoff *= 2
+			continue
+		}
+		if method == "GET" && resp.StatusCode == http.StatusNotModified && cached {
+			return http.StatusOK, entry.header, entry.body, nil
+		}
+		if method == "GET" && resp.StatusCode == http.StatusOK {
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				c.mu.Lock()
+				c.cache.add(githubCacheEntry{url: rurl, etag: etag, header: resp.Header, body: body})
+				c.mu.Unlock()
+			}
+		}
+		return resp.StatusCode, resp.Header, body, nil
+	}
+}
+
+// helper function to get GitHub API end-point and decode its JSON response
+func (c *GitHubClient) get(rurl string, rec interface{}) error {
+	_, err := c.getPage(rurl, rec)
+	return err
+}
+
+// helper function to get page of GitHub API end-point and decode its JSON
+// response, it returns URL of the next page taken from Link header if any
+func (c *GitHubClient) getPage(rurl string, rec interface{}) (string, error) {
+	status, header, body, err := c.do("GET", rurl, nil)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusNotFound {
+		return "", fmt.Errorf("%s: %w", rurl, errNotFound)
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("%s returned status %d", rurl, status)
+	}
+	return nextLink(header.Get("Link")), json.Unmarshal(body, rec)
+}
+
+// helper function to parse URL of the next page from Link header, e.g.
+// <https://api.github.com/...&page=2>; rel="next", <...>; rel="last"
+func nextLink(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		arr := strings.Split(part, ";")
+		for _, param := range arr[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(arr[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+// helper function to post given object to GitHub API end-point and decode its JSON response
+func (c *GitHubClient) post(rurl string, obj, rec interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	status, _, body, err := c.do("POST", rurl, data)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("%s returned status %d, response %s", rurl, status, string(body))
+	}
+	if rec == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, rec)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGitHubClientCache
+func TestGitHubClientCache(t *testing.T) {
+	var auth []string
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		auth = append(auth, r.Header.Get("Authorization"))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"sha": "abc"}`))
+	}))
+	defer ts.Close()
+	c, err := newGitHubClient(GitHubConfig{URL: ts.URL + "/api/v3/", Token: "pat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.api() != ts.URL+"/api/v3" {
+		t.Errorf("Fail TestGitHubClientCache, wrong api %s\n", c.api())
+	}
+	for i := 0; i < 2; i++ {
+		var rec GitHubCommit
+		if err := c.get(c.api()+"/repos/org/srv/commits/abc", &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Sha != "abc" {
+			t.Errorf("Fail TestGitHubClientCache, wrong response %+v\n", rec)
+		}
+	}
+	if requests != 2 || auth[0] != "Bearer pat" || auth[1] != "Bearer pat" {
+		t.Errorf("Fail TestGitHubClientCache, wrong requests %d %v\n", requests, auth)
+	}
+}
+
+// TestGitHubClientRateLimit
+func TestGitHubClientRateLimit(t *testing.T) {
+	var waits []time.Duration
+	githubSleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { githubSleep = time.Sleep }()
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", time.Now().Add(10*time.Second).Unix()))
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/limited") {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"sha": "abc"}`))
+	}))
+	defer ts.Close()
+	c, _ := newGitHubClient(GitHubConfig{URL: ts.URL})
+	var rec GitHubCommit
+	if err := c.get(ts.URL+"/repos/org/srv/commits/abc", &rec); err != nil || rec.Sha != "abc" {
+		t.Fatalf("Fail TestGitHubClientRateLimit, %v %+v\n", err, rec)
+	}
+	if len(waits) != 1 || waits[0] <= 0 || waits[0] > 10*time.Second {
+		t.Errorf("Fail TestGitHubClientRateLimit, wrong waits %v\n", waits)
+	}
+	// wait longer than max wait is not attempted
+	if err := c.get(ts.URL+"/limited", &rec); err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Errorf("Fail TestGitHubClientRateLimit, wrong error %v\n", err)
+	}
+}
+
+// TestGitHubClientRetry
+func TestGitHubClientRetry(t *testing.T) {
+	githubSleep = func(d time.Duration) {}
+	defer func() { githubSleep = time.Sleep }()
+	requests := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		requests[key]++
+		if r.URL.Path == "/limited" && requests[key] == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Path == "/failed" && requests[key] == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	c, _ := newGitHubClient(GitHubConfig{URL: ts.URL})
+	var rec map[string]interface{}
+	if err := c.get(ts.URL+"/failed", &rec); err != nil {
+		t.Errorf("Fail TestGitHubClientRetry, failed GET is not retried: %v\n", err)
+	}
+	if err := c.post(ts.URL+"/failed", rec, nil); err == nil {
+		t.Errorf("Fail TestGitHubClientRetry, failed POST should not be retried\n")
+	}
+	if err := c.post(ts.URL+"/limited", rec, nil); err != nil {
+		t.Errorf("Fail TestGitHubClientRetry, rate limited POST is not retried: %v\n", err)
+	}
+	if requests["GET /failed"] != 2 || requests["POST /failed"] != 1 || requests["POST /limited"] != 2 {
+		t.Errorf("Fail TestGitHubClientRetry, wrong requests %v\n", requests)
+	}
+}
+
+// TestGitHubCache
+func TestGitHubCache(t *testing.T) {
+	c := newGitHubCache(2)
+	c.add(githubCacheEntry{url: "a", etag: "1"})
+	c.add(githubCacheEntry{url: "b", etag: "2"})
+	c.get("a")
+	c.add(githubCacheEntry{url: "c", etag: "3"})
+	if _, ok := c.get("b"); ok {
+		t.Errorf("Fail TestGitHubCache, least recently used entry is not evicted\n")
+	}
+	for _, u := range []string{"a", "c"} {
+		if _, ok := c.get(u); !ok {
+			t.Errorf("Fail TestGitHubCache, entry %s is evicted\n", u)
+		}
+	}
+}
+
+// TestGitHubApp
+func TestGitHubApp(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(t.TempDir(), "app.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	ioutil.WriteFile(fname, data, 0600)
+
+	tokens := 0
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app/installations/7/access_tokens" {
+			jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			arr := strings.Split(jwt, ".")
+			if len(arr) != 3 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			sig, _ := base64.RawURLEncoding.DecodeString(arr[2])
+			hash := sha256.Sum256([]byte(arr[0] + "." + arr[1]))
+			if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, hash[:], sig) != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			tokens++
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"token": "inst-token", "expires_at": "%s"}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"sha": "abc"}`))
+	}))
+	defer ts.Close()
+	c, err := newGitHubClient(GitHubConfig{URL: ts.URL, AppID: 1, InstallationID: 7, PrivateKey: fname})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec GitHubCommit
+	for i := 0; i < 2; i++ {
+		if err := c.get(ts.URL+"/repos/org/srv/commits/abc", &rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tokens != 1 || auth != "token inst-token" {
+		t.Errorf("Fail TestGitHubApp, tokens %d auth %s\n", tokens, auth)
+	}
+}
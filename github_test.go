@@ -1,17 +1,93 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
+// helper function to serve fake GitHub API with given responses
+func fakeGitHub(t *testing.T, responses map[string]string) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	api := githubAPI
+	githubAPI = ts.URL
+	t.Cleanup(func() {
+		githubAPI = api
+		ts.Close()
+	})
+}
+
 // TestGetCommit
 func TestGetCommit(t *testing.T) {
-	r := Request{Service: "imagebot", Namespace: "test", Tag: "00.00.01", Repository: "vkuznet/imagebot"}
-	sha, err := getCommit(r)
-	if err != nil {
-		t.Errorf("Fail TestGetCommit, %v\n", err)
+	commit := "1130ebd31beeb1a0a4b50e908896e918f2b9be7d"
+	fork := "2230ebd31beeb1a0a4b50e908896e918f2b9be7d"
+	fakeGitHub(t, map[string]string{
+		"/repos/vkuznet/imagebot/git/refs/tags/00.00.01":        fmt.Sprintf(`{"ref": "refs/tags/00.00.01", "object": {"sha": "%s", "type": "commit"}}`, commit),
+		"/repos/vkuznet/imagebot/git/refs/tags/00.00.02":        `{"ref": "refs/tags/00.00.02", "object": {"sha": "aaa", "type": "tag"}}`,
+		"/repos/vkuznet/imagebot/git/tags/aaa":                  fmt.Sprintf(`{"tag": "00.00.02", "sha": "aaa", "object": {"sha": "%s", "type": "commit"}}`, commit),
+		"/repos/vkuznet/imagebot/git/refs/tags/00":              `[{"ref": "refs/tags/00.00.01", "object": {"sha": "bbb", "type": "commit"}}]`,
+		"/repos/vkuznet/imagebot/git/refs/heads/main":           fmt.Sprintf(`{"ref": "refs/heads/main", "object": {"sha": "%s", "type": "commit"}}`, commit),
+		"/repos/vkuznet/imagebot/commits/" + commit:             fmt.Sprintf(`{"sha": "%s"}`, commit),
+		"/repos/vkuznet/imagebot/commits/" + fork:               fmt.Sprintf(`{"sha": "%s"}`, fork),
+		"/repos/vkuznet/imagebot":                               `{"default_branch": "main"}`,
+		"/repos/vkuznet/imagebot/compare/main..." + commit:      `{"status": "behind"}`,
+		"/repos/vkuznet/imagebot/compare/main..." + fork:        `{"status": "diverged"}`,
+		"/repos/vkuznet/imagebot/compare/release/1..." + commit: `{"status": "diverged"}`,
+		"/repos/vkuznet/imagebot/compare/release/1..." + fork:   `{"status": "behind"}`,
+	})
+	policies := Config.Policies
+	defer func() { Config.Policies = policies }()
+	Config.Policies = nil
+
+	tests := []struct {
+		tag, commit string
+		allow       bool
+		protected   bool
+		fail        bool
+	}{
+		{tag: "00.00.01"},                                           // lightweight tag
+		{tag: "00.00.02"},                                           // annotated tag
+		{tag: "00", fail: true},                                     // prefix of other tags
+		{tag: "main", fail: true},                                   // branch is not allowed by default
+		{tag: "main", allow: true},                                  // branch allowed by policy
+		{tag: "latest", fail: true},                                 // unknown ref
+		{tag: commit[:7], commit: commit, allow: true},              // bare commit allowed by policy
+		{tag: commit, commit: commit, allow: true},                  // full commit as a tag
+		{tag: "latest", commit: commit, allow: true, fail: true},    // tag is not the commit
+		{tag: commit[:3], commit: commit, allow: true, fail: true},  // too short commit prefix
+		{tag: fork[:7], commit: fork, allow: true, fail: true},      // commit of a fork
+		{tag: fork[:7], commit: fork, allow: true, protected: true}, // commit of protected branch
 	}
-	if sha != "1130ebd31beeb1a0a4b50e908896e918f2b9be7d" {
-		t.Errorf("Fail to get sha, %s\n", sha)
+	for _, tt := range tests {
+		Config.Policies = nil
+		if tt.allow {
+			Config.Policies = []ServicePolicy{{Service: "imagebot", AllowBranches: true, AllowCommits: true}}
+		}
+		if tt.protected {
+			Config.Policies[0].Protected = &BranchPolicy{Branches: []string{"release/1"}}
+		}
+		r := Request{Service: "imagebot", Namespace: "test", Tag: tt.tag, Commit: tt.commit, Repository: "vkuznet/imagebot"}
+		sha, err := getCommit(r)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("Fail TestGetCommit, tag %s is accepted with sha %s\n", tt.tag, sha)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Fail TestGetCommit, tag %s: %v\n", tt.tag, err)
+		}
+		if tt.commit != "" && sha != tt.commit || tt.commit == "" && sha != commit {
+			t.Errorf("Fail to get sha of tag %s, %s\n", tt.tag, sha)
+		}
 	}
 }
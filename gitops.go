@@ -0,0 +1,300 @@
+package main
+
+// gitops module provides deployment of requests via commits to manifests repository
+//
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// GitOpsTarget represents configuration of manifests git repository
+type GitOpsTarget struct {
+	Repository  string `json:"repository"`  // URL of manifests git repository
+	Branch      string `json:"branch"`      // base branch of manifests repository, default main
+	File        string `json:"file"`        // path to manifest file within the repository
+	PushBranch  string `json:"pushBranch"`  // branch to push changes to, default base branch
+	PullRequest bool   `json:"pullRequest"` // open pull request from push branch to base branch
+	Project     string `json:"project"`     // GitHub owner/repo of manifests repository used for pull requests
+	Token       string `json:"token"`       // GitHub token used to open pull requests, default token of GitHub client
+	Workdir     string `json:"workdir"`     // local directory of repository clone
+	AuthorName  string `json:"authorName"`  // commit author name
+	AuthorEmail string `json:"authorEmail"` // commit author email
+}
+
+// number of attempts to push changes to manifests repository
+const gitPushAttempts = 3
+
+// dirLocks protects local directories (e.g. clones of manifests repositories) shared by services
+var dirLocks = struct {
+	sync.Mutex
+	dirs map[string]*sync.Mutex
+}{dirs: make(map[string]*sync.Mutex)}
+
+// helper function to lock local directory, it returns unlock function
+func lockDir(dir string) func() {
+	dirLocks.Lock()
+	mu, ok := dirLocks.dirs[dir]
+	if !ok {
+		mu = &sync.Mutex{}
+		dirLocks.dirs[dir] = mu
+	}
+	dirLocks.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// helper function to execute git command in given directory
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("git %s: %w, %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// helper function to return base branch of gitops target
+func (g *GitOpsTarget) baseBranch() string {
+	if g.Branch == "" {
+		return "main"
+	}
+	return g.Branch
+}
+
+// helper function to return branch where changes of given request are pushed
+func (g *GitOpsTarget) pushBranch(r Request) string {
+	if g.PushBranch != "" {
+		return g.PushBranch
+	}
+	if g.PullRequest {
+		return fmt.Sprintf("imagebot/%s-%s-%s", r.Namespace, r.Service, r.Tag)
+	}
+	return g.baseBranch()
+}
+
+// helper function to return local clone directory of gitops target
+func (g *GitOpsTarget) workdir() string {
+	if g.Workdir != "" {
+		return g.Workdir
+	}
+	name := regexp.MustCompile(`[^A-Za-z0-9_.-]+`).ReplaceAllString(g.Repository, "_")
+	return filepath.Join(os.TempDir(), "imagebot-gitops", name)
+}
+
+// helper function to clone or update local copy of manifests repository
+// and to reset it to the state of the base branch
+func (g *GitOpsTarget) sync() (string, error) {
+	dir := g.workdir()
+	base := g.baseBranch()
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			return dir, err
+		}
+		if _, err := git("", "clone", "--branch", base, g.Repository, dir); err != nil {
+			return dir, err
+		}
+		return dir, nil
+	}
+	if _, err := git(dir, "fetch", "--prune", "origin"); err != nil {
+		return dir, err
+	}
+	if _, err := git(dir, "checkout", "-B", base, fmt.Sprintf("origin/%s", base)); err != nil {
+		return dir, err
+	}
+	if _, err := git(dir, "reset", "--hard", fmt.Sprintf("origin/%s", base)); err != nil {
+		return dir, err
+	}
+	_, err := git(dir, "clean", "-fdx")
+	return dir, err
+}
+
+// helper function to create commit message of given request
+func commitMessage(r Request, job *Job) string {
+	msg := fmt.Sprintf("Update %s/%s image to %s:%s\n\n", r.Namespace, r.Service, r.Image, r.Tag)
+	msg += fmt.Sprintf("Source repository: %s\n", r.Repository)
+	msg += fmt.Sprintf("Source commit: %s\n", r.Commit)
+	if digest := job.digest(); digest != "" {
+		msg += fmt.Sprintf("Image digest: %s\n", digest)
+	}
+	if job != nil {
+		msg += fmt.Sprintf("Imagebot job: %s\n", job.ID)
+	}
+	return msg
+}
+
+// helper function to commit given file of the local clone
+func (g *GitOpsTarget) commit(dir, file string, r Request, job *Job) error {
+	if _, err := git(dir, "add", file); err != nil {
+		return err
+	}
+	name := g.AuthorName
+	if name == "" {
+		name = "imagebot"
+	}
+	email := g.AuthorEmail
+	if email == "" {
+		email = "imagebot@localhost"
+	}
+	args := []string{
+		"-c", fmt.Sprintf("user.name=%s", name),
+		"-c", fmt.Sprintf("user.email=%s", email),
+		"commit", "-m", commitMessage(r, job),
+	}
+	_, err := git(dir, args...)
+	return err
+}
+
+// helper function to update manifest file of gitops target, the update function
+// receives content of the file and returns its new content
+func (g *GitOpsTarget) apply(r Request, job *Job, file string, update func(string) (string, error)) error {
+	if g == nil || g.Repository == "" || file == "" {
+		return errors.New("gitops target requires repository and file")
+	}
+	dir := g.workdir()
+	unlock := lockDir(dir)
+	defer unlock()
+
+	branch := g.pushBranch(r)
+	var err error
+	var data []byte
+	var content string
+	for attempt := 1; attempt <= gitPushAttempts; attempt++ {
+		if _, err = g.sync(); err != nil {
+			return err
+		}
+		if branch != g.baseBranch() {
+			if _, err = git(dir, "checkout", "-B", branch); err != nil {
+				return err
+			}
+		}
+		fname := filepath.Join(dir, file)
+		data, err = ioutil.ReadFile(fname)
+		if err != nil {
+			return err
+		}
+		content, err = update(string(data))
+		if err != nil {
+			return err
+		}
+		if content == string(data) {
+			job.Logf("manifest %s of %s is already up to date", file, g.Repository)
+			return nil
+		}
+		if err = ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			return err
+		}
+		if err = g.commit(dir, file, r, job); err != nil {
+			return err
+		}
+		args := []string{"push", "origin", fmt.Sprintf("HEAD:refs/heads/%s", branch)}
+		if branch != g.baseBranch() {
+			args = []string{"push", "--force", "origin", fmt.Sprintf("HEAD:refs/heads/%s", branch)}
+		}
+		if _, err = git(dir, args...); err == nil {
+			job.Logf("pushed %s update to %s branch %s", file, g.Repository, branch)
+			break
+		}
+		job.Logf("attempt %d to push to %s failed, error %v", attempt, g.Repository, err)
+	}
+	if err != nil {
+		return err
+	}
+	if g.PullRequest {
+		return g.openPullRequest(r, branch, job)
+	}
+	return nil
+}
+
+// helper function to deploy request by committing the new tag, pinned to
+// verified image digest, to manifests repository
+func gitopsDeploy(r Request, g *GitOpsTarget, job *Job) error {
+	if g == nil {
+		return errors.New("gitops target is not configured")
+	}
+	pinned := r
+	pinned.Tag = pinnedTag(r, job)
+	return g.apply(r, job, g.File, func(content string) (string, error) {
+		job.update(func(j *Job) {
+			j.PreviousImage = currentImage(content, r)
+			j.NewImage = imageRef(r.Image, pinned.Tag)
+		})
+		return changeTag(content, pinned), nil
+	})
+}
+
+// GitHubPullRequest represents GitHub pull request
+type GitHubPullRequest struct {
+	Title   string `json:"title"`
+	Head    string `json:"head"`
+	Base    string `json:"base"`
+	Body    string `json:"body"`
+	Number  int    `json:"number,omitempty"`
+	HTMLURL string `json:"html_url,omitempty"`
+}
+
+// helper function to return GitHub owner/repo of manifests repository
+func (g *GitOpsTarget) project() string {
+	if g.Project != "" {
+		return g.Project
+	}
+	repo := strings.TrimSuffix(g.Repository, ".git")
+	repo = strings.Replace(repo, ":", "/", -1)
+	arr := strings.Split(repo, "/")
+	if len(arr) < 2 {
+		return repo
+	}
+	return strings.Join(arr[len(arr)-2:], "/")
+}
+
+// helper function to find open GitHub pull request from given branch to the base branch
+func (g *GitOpsTarget) findPullRequest(client *GitHubClient, branch string) (*GitHubPullRequest, error) {
+	owner := strings.Split(g.project(), "/")[0]
+	rurl := fmt.Sprintf("%s/repos/%s/pulls?state=open&head=%s&base=%s",
+		client.api(), g.project(),
+		url.QueryEscape(owner+":"+branch), url.QueryEscape(g.baseBranch()))
+	var prs []GitHubPullRequest
+	if err := client.get(rurl, &prs); err != nil {
+		return nil, err
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	return &prs[0], nil
+}
+
+// helper function to open GitHub pull request from given branch to the base branch,
+// existing open pull request of the branch is reused since the branch is already updated
+func (g *GitOpsTarget) openPullRequest(r Request, branch string, job *Job) error {
+	client := ghClient
+	if g.Token != "" {
+		client = ghClient.withToken(g.Token)
+	}
+	existing, err := g.findPullRequest(client, branch)
+	if err != nil {
+		return fmt.Errorf("unable to look up pull request, %v", err)
+	}
+	if existing != nil {
+		job.Logf("updated pull request #%d %s", existing.Number, existing.HTMLURL)
+		return nil
+	}
+	msg := commitMessage(r, job)
+	arr := strings.SplitN(msg, "\n", 2)
+	pr := GitHubPullRequest{Title: arr[0], Head: branch, Base: g.baseBranch(), Body: strings.TrimSpace(arr[1])}
+	rurl := fmt.Sprintf("%s/repos/%s/pulls", client.api(), g.project())
+	if err := client.post(rurl, pr, &pr); err != nil {
+		return fmt.Errorf("unable to open pull request, %v", err)
+	}
+	job.Logf("opened pull request #%d %s", pr.Number, pr.HTMLURL)
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function to create local bare repository with given files on main branch
+func testBareRepo(t *testing.T, files map[string]string) string {
+	tmp := t.TempDir()
+	bare := filepath.Join(tmp, "manifests.git")
+	seed := filepath.Join(tmp, "seed")
+	if _, err := git("", "init", "--bare", "-b", "main", bare); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git("", "clone", bare, seed); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		fname := filepath.Join(seed, name)
+		os.MkdirAll(filepath.Dir(fname), 0755)
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmds := [][]string{
+		{"checkout", "-b", "main"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@localhost", "commit", "-m", "init"},
+		{"push", "origin", "main"},
+	}
+	for _, args := range cmds {
+		if _, err := git(seed, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bare
+}
+
+// TestGitOpsDeploy
+func TestGitOpsDeploy(t *testing.T) {
+	manifest := "spec:\n  containers:\n  - name: srv\n    image: repo/srv:0.1\n"
+	bare := testBareRepo(t, map[string]string{"apps/srv.yaml": manifest})
+	g := &GitOpsTarget{Repository: bare, File: "apps/srv.yaml", Workdir: filepath.Join(t.TempDir(), "clone")}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Repository: "org/srv", Image: "repo/srv", Commit: "abc123"}
+	job := newJob(r)
+	if err := gitopsDeploy(r, g, job); err != nil {
+		t.Fatal(err)
+	}
+	out, err := git(bare, "show", "main:apps/srv.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "image: repo/srv:0.2") {
+		t.Errorf("Fail TestGitOpsDeploy, manifest is not updated\n%s\n", out)
+	}
+	msg, err := git(bare, "log", "-1", "--format=%B", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, "abc123") || !strings.Contains(msg, "org/srv") {
+		t.Errorf("Fail TestGitOpsDeploy, wrong commit message\n%s\n", msg)
+	}
+	if job.PreviousImage != "repo/srv:0.1" {
+		t.Errorf("Fail TestGitOpsDeploy, wrong previous image %s\n", job.PreviousImage)
+	}
+
+	// second deployment of the same tag should not create new commit
+	if err := gitopsDeploy(r, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	count, _ := git(bare, "rev-list", "--count", "main")
+	if strings.TrimSpace(count) != "2" {
+		t.Errorf("Fail TestGitOpsDeploy, wrong number of commits %s\n", count)
+	}
+
+	// image verified by request checks is pinned to its digest
+	r.Tag = "0.3"
+	job = newJob(r)
+	job.Digest = "sha256:abc"
+	if err := gitopsDeploy(r, g, job); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = git(bare, "show", "main:apps/srv.yaml")
+	if !strings.Contains(out, "image: repo/srv:0.3@sha256:abc") {
+		t.Errorf("Fail TestGitOpsDeploy, manifest is not pinned to digest\n%s\n", out)
+	}
+	msg, _ = git(bare, "log", "-1", "--format=%B", "main")
+	if !strings.Contains(msg, "Image digest: sha256:abc") {
+		t.Errorf("Fail TestGitOpsDeploy, no digest in commit message\n%s\n", msg)
+	}
+}
+
+// TestGitOpsPullRequest
+func TestGitOpsPullRequest(t *testing.T) {
+	var pr GitHubPullRequest
+	var created int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/org/manifests/pulls" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "GET" {
+			if created == 0 || r.URL.Query().Get("head") != "org:"+pr.Head || r.URL.Query().Get("base") != pr.Base {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"number": 1, "html_url": "https://github.com/org/manifests/pull/1"}]`))
+			return
+		}
+		created++
+		json.NewDecoder(r.Body).Decode(&pr)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 1, "html_url": "https://github.com/org/manifests/pull/1"}`))
+	}))
+	defer ts.Close()
+	api := githubAPI
+	githubAPI = ts.URL
+	defer func() { githubAPI = api }()
+
+	manifest := "image: repo/srv:0.1\n"
+	bare := testBareRepo(t, map[string]string{"srv.yaml": manifest})
+	g := &GitOpsTarget{Repository: bare, File: "srv.yaml", PullRequest: true, Project: "org/manifests", Workdir: filepath.Join(t.TempDir(), "clone")}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Repository: "org/srv", Image: "repo/srv", Commit: "abc123"}
+	if err := gitopsDeploy(r, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	branch := "imagebot/test-srv-0.2"
+	if pr.Head != branch || pr.Base != "main" {
+		t.Errorf("Fail TestGitOpsPullRequest, wrong pull request %+v\n", pr)
+	}
+	out, err := git(bare, "show", branch+":srv.yaml")
+	if err != nil || !strings.Contains(out, "repo/srv:0.2") {
+		t.Errorf("Fail TestGitOpsPullRequest, branch is not updated %s %v\n", out, err)
+	}
+	out, _ = git(bare, "show", "main:srv.yaml")
+	if out != manifest {
+		t.Errorf("Fail TestGitOpsPullRequest, base branch should not be changed\n%s\n", out)
+	}
+
+	// re-deployment of the same branch should reuse open pull request
+	r.Commit = "def456"
+	if err := gitopsDeploy(r, g, nil); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Errorf("Fail TestGitOpsPullRequest, pull request is opened %d times\n", created)
+	}
+}
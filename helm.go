@@ -0,0 +1,192 @@
+package main
+
+// helm module provides deployment of requests via upgrade of helm releases
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HelmTarget represents configuration of helm release of the service
+type HelmTarget struct {
+	Release    string `json:"release"`    // release name, default service name
+	Namespace  string `json:"namespace"`  // release namespace, default request namespace
+	Chart      string `json:"chart"`      // chart reference used for release upgrade
+	Version    string `json:"version"`    // chart version
+	ValuesPath string `json:"valuesPath"` // path of image tag in release values, default image.tag
+	DigestPath string `json:"digestPath"` // path of image digest in release values, image is not pinned to digest if empty
+	Timeout    int    `json:"timeout"`    // upgrade timeout in seconds
+}
+
+// HelmRevision represents record of helm release history
+type HelmRevision struct {
+	Revision    int    `json:"revision"`
+	Updated     string `json:"updated"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	AppVersion  string `json:"app_version"`
+	Description string `json:"description"`
+}
+
+// helper function to return release name of helm target
+func (h *HelmTarget) release(r Request) string {
+	if h.Release != "" {
+		return h.Release
+	}
+	return r.Service
+}
+
+// helper function to return release namespace of helm target
+func (h *HelmTarget) namespace(r Request) string {
+	if h.Namespace != "" {
+		return h.Namespace
+	}
+	return r.Namespace
+}
+
+// helper function to return values path of image tag
+func (h *HelmTarget) valuesPath() string {
+	if h.ValuesPath != "" {
+		return h.ValuesPath
+	}
+	return "image.tag"
+}
+
+// helper function to return upgrade timeout of helm target
+func (h *HelmTarget) timeout() string {
+	if h.Timeout > 0 {
+		return fmt.Sprintf("%ds", h.Timeout)
+	}
+	return "300s"
+}
+
+// helper function to get history of helm release
+func helmHistory(release, ns string) ([]HelmRevision, error) {
+	var revs []HelmRevision
+	out, err := runCommand("helm", "history", release, "-n", ns, "-o", "json")
+	if err != nil {
+		return revs, err
+	}
+	err = json.Unmarshal(out, &revs)
+	return revs, err
+}
+
+// helper function to find currently deployed revision in helm release history
+func deployedRevision(revs []HelmRevision) int {
+	for i := len(revs) - 1; i >= 0; i-- {
+		if revs[i].Status == "deployed" {
+			return revs[i].Revision
+		}
+	}
+	return 0
+}
+
+// helper function to look up value of given dot separated path in helm values
+func lookupValue(values map[string]interface{}, path string) string {
+	var val interface{} = values
+	for _, key := range strings.Split(path, ".") {
+		rec, ok := val.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		val = rec[key]
+	}
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// helper function to get helm release values
+func helmValues(release, ns string) (map[string]interface{}, error) {
+	out, err := runCommand("helm", "get", "values", release, "-n", ns, "--all", "-o", "json")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	err = json.Unmarshal(out, &values)
+	return values, err
+}
+
+// helper function to roll back helm release to given revision
+func helmRollback(release, ns string, rev int, timeout string) error {
+	_, err := runCommand("helm", "rollback", release, fmt.Sprintf("%d", rev), "-n", ns, "--wait", "--timeout", timeout)
+	return err
+}
+
+// helper function to build arguments of helm upgrade command which sets given
+// image tag and digest, the digest is always set (empty one included) so it
+// is not reused from previous release values
+func (h *HelmTarget) upgradeArgs(r Request, tag, digest string) []string {
+	args := []string{
+		"upgrade", h.release(r), h.Chart,
+		"-n", h.namespace(r),
+		"--reuse-values",
+		"--set-string", fmt.Sprintf("%s=%s", h.valuesPath(), tag),
+	}
+	if h.DigestPath != "" {
+		args = append(args, "--set-string", fmt.Sprintf("%s=%s", h.DigestPath, digest))
+	}
+	args = append(args, "--wait", "--timeout", h.timeout())
+	if h.Version != "" {
+		args = append(args, "--version", h.Version)
+	}
+	return args
+}
+
+// helper function to deploy request by upgrading helm release with new image tag,
+// all other release values are reused and failed upgrade is rolled back to previous revision
+func helmDeploy(r Request, h *HelmTarget, job *Job) error {
+	if h == nil || h.Chart == "" {
+		return errors.New("helm target requires chart")
+	}
+	release := h.release(r)
+	ns := h.namespace(r)
+	revs, err := helmHistory(release, ns)
+	if err != nil {
+		return err
+	}
+	prevRev := deployedRevision(revs)
+	values, err := helmValues(release, ns)
+	if err != nil {
+		return err
+	}
+	// image tag and digest are kept in separate values since charts may use
+	// the tag elsewhere, e.g. in labels; digest is used only if chart takes it
+	prevTag, prevDigest := lookupValue(values, h.valuesPath()), ""
+	tag, digest := tagDigest(r, job)
+	if h.DigestPath == "" {
+		digest = ""
+	} else {
+		prevDigest = lookupValue(values, h.DigestPath)
+	}
+	job.update(func(j *Job) {
+		j.PreviousImage = imageRef(r.Image, pinTag(prevTag, prevDigest))
+		j.NewImage = imageRef(r.Image, pinTag(tag, digest))
+		j.PreviousRevision = prevRev
+	})
+	job.Logf("upgrade helm release %s/%s revision %d, %s=%s -> %s", ns, release, prevRev, h.valuesPath(), prevTag, tag)
+
+	out, err := runCommand("helm", h.upgradeArgs(r, tag, digest)...)
+	if err != nil {
+		job.Logf("helm upgrade of %s/%s failed, error %v", ns, release, err)
+		if prevRev == 0 {
+			return err
+		}
+		if rerr := helmRollback(release, ns, prevRev, h.timeout()); rerr != nil {
+			return fmt.Errorf("helm upgrade failed: %v, rollback to revision %d failed: %v", err, prevRev, rerr)
+		}
+		job.Logf("helm release %s/%s rolled back to revision %d", ns, release, prevRev)
+		return fmt.Errorf("%w to revision %d, helm upgrade failed: %v", errRolledBack, prevRev, err)
+	}
+	job.Logf("helm upgrade output %s", string(out))
+	if revs, err := helmHistory(release, ns); err == nil {
+		rev := deployedRevision(revs)
+		job.update(func(j *Job) { j.Revision = rev })
+		job.Logf("helm release %s/%s deployed revision %d", ns, release, rev)
+	}
+	return nil
+}
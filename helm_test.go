@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestHelmDeploy
+func TestHelmDeploy(t *testing.T) {
+	history := `[{"revision":1,"status":"superseded"},{"revision":2,"status":"deployed"}]`
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "helm history"):
+			return []byte(history), nil
+		case strings.HasPrefix(cmd, "helm get values"):
+			return []byte(`{"image": {"repository": "repo/srv", "tag": "0.1", "digest": "sha256:old"}, "replicas": 2}`), nil
+		case strings.HasPrefix(cmd, "helm upgrade"):
+			history = `[{"revision":2,"status":"superseded"},{"revision":3,"status":"deployed"}]`
+			return []byte("upgraded"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	h := &HelmTarget{Release: "srv-release", Chart: "charts/srv"}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	if err := helmDeploy(r, h, job); err != nil {
+		t.Fatal(err)
+	}
+	upgrade := "helm upgrade srv-release charts/srv -n test --reuse-values --set-string image.tag=0.2 --wait --timeout 300s"
+	if !InList(upgrade, *calls) {
+		t.Errorf("Fail TestHelmDeploy, no upgrade command in %v\n", *calls)
+	}
+	if job.PreviousImage != "repo/srv:0.1" || job.PreviousRevision != 2 || job.Revision != 3 {
+		t.Errorf("Fail TestHelmDeploy, wrong job data %s %d %d\n", job.PreviousImage, job.PreviousRevision, job.Revision)
+	}
+
+	// image tag value never includes digest, charts may use it in labels
+	job = newJob(r)
+	job.Digest = "sha256:abc"
+	if err := helmDeploy(r, h, job); err != nil {
+		t.Fatal(err)
+	}
+	if last := (*calls)[len(*calls)-2]; last != upgrade || job.NewImage != "repo/srv:0.2" {
+		t.Errorf("Fail TestHelmDeploy, image without digest path is pinned, %s %s\n", last, job.NewImage)
+	}
+
+	// image verified by request checks is pinned to its digest via digest path
+	h.DigestPath = "image.digest"
+	job = newJob(r)
+	job.Digest = "sha256:abc"
+	if err := helmDeploy(r, h, job); err != nil {
+		t.Fatal(err)
+	}
+	upgrade = "helm upgrade srv-release charts/srv -n test --reuse-values --set-string image.tag=0.2 --set-string image.digest=sha256:abc --wait --timeout 300s"
+	if !InList(upgrade, *calls) {
+		t.Errorf("Fail TestHelmDeploy, no pinned upgrade command in %v\n", *calls)
+	}
+	if job.NewImage != "repo/srv:0.2@sha256:abc" || job.PreviousImage != "repo/srv:0.1@sha256:old" {
+		t.Errorf("Fail TestHelmDeploy, wrong images %s %s\n", job.PreviousImage, job.NewImage)
+	}
+
+	// pinned image of rollback is split into tag and digest, digest of
+	// previous release is cleared if image is not pinned
+	r.Tag = "0.1@sha256:old"
+	if err := helmDeploy(r, h, newJob(r)); err != nil {
+		t.Fatal(err)
+	}
+	r.Tag = "0.3"
+	if err := helmDeploy(r, h, newJob(r)); err != nil {
+		t.Fatal(err)
+	}
+	for _, upgrade := range []string{
+		"helm upgrade srv-release charts/srv -n test --reuse-values --set-string image.tag=0.1 --set-string image.digest=sha256:old --wait --timeout 300s",
+		"helm upgrade srv-release charts/srv -n test --reuse-values --set-string image.tag=0.3 --set-string image.digest= --wait --timeout 300s",
+	} {
+		if !InList(upgrade, *calls) {
+			t.Errorf("Fail TestHelmDeploy, no upgrade command %s in %v\n", upgrade, *calls)
+		}
+	}
+}
+
+// TestHelmRollback
+func TestHelmRollback(t *testing.T) {
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "helm history"):
+			return []byte(`[{"revision":4,"status":"deployed"}]`), nil
+		case strings.HasPrefix(cmd, "helm get values"):
+			return []byte(`{"image": {"tag": "0.1"}}`), nil
+		case strings.HasPrefix(cmd, "helm upgrade"):
+			return nil, errors.New("timed out waiting for the condition")
+		case strings.HasPrefix(cmd, "helm rollback"):
+			return []byte("rolled back"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	h := &HelmTarget{Chart: "charts/srv", ValuesPath: "app.image.tag"}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	err := helmDeploy(r, h, nil)
+	if !errors.Is(err, errRolledBack) {
+		t.Errorf("Fail TestHelmRollback, wrong error %v\n", err)
+	}
+	if !InList("helm rollback srv 4 -n test --wait --timeout 300s", *calls) {
+		t.Errorf("Fail TestHelmRollback, no rollback command in %v\n", *calls)
+	}
+}
+
+// TestLookupValue
+func TestLookupValue(t *testing.T) {
+	values := map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}}
+	if v := lookupValue(values, "image.tag"); v != "1.0" {
+		t.Errorf("Fail TestLookupValue, %s\n", v)
+	}
+	if v := lookupValue(values, "image.tag.name"); v != "" {
+		t.Errorf("Fail TestLookupValue, %s\n", v)
+	}
+}
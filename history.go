@@ -0,0 +1,308 @@
+package main
+
+// history module provides persistent storage of deployment records
+//
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DeployRecord represents record of deployment attempt
+type DeployRecord struct {
+	ID            string   `json:"id"`             // deployment job id
+	Request       Request  `json:"request"`        // image request
+	PreviousImage string   `json:"previous_image"` // image used before deployment
+	NewImage      string   `json:"new_image"`      // deployed image
+	Digest        string   `json:"digest"`         // digest of deployed image
+	Outcome       JobState `json:"outcome"`        // deployment outcome
+	Error         string   `json:"error"`          // deployment error
+	Started       int64    `json:"started"`        // deployment start timestamp
+	Finished      int64    `json:"finished"`       // deployment finish timestamp
+	Duration      float64  `json:"duration"`       // deployment duration in seconds
+	Caller        string   `json:"caller"`         // identity of the caller
+	TokenID       string   `json:"token_id"`       // id of the token used in request
+	Signer        string   `json:"signer"`         // verified signer of tag or commit
+
+	PreviousRevision int          `json:"previous_revision,omitempty"` // release revision before deployment
+	Revision         int          `json:"revision,omitempty"`          // release revision after deployment
+	Stages           []Stage      `json:"stages,omitempty"`            // stage transitions of deployment
+	Hooks            []HookResult `json:"hooks,omitempty"`             // results of deployment hooks
+	Changelog        *Changelog   `json:"changelog,omitempty"`         // changes between deployed and requested tags
+	Vulnerabilities  string       `json:"vulnerabilities,omitempty"`   // summary of image vulnerabilities
+	Action           string       `json:"action,omitempty"`            // maintenance action, e.g. switchback
+}
+
+// HistoryFilter represents filter of history records
+type HistoryFilter struct {
+	Service   string   // service name
+	Namespace string   // namespace name
+	Outcome   JobState // deployment outcome
+	Since     int64    // lower bound of deployment start timestamp
+	Until     int64    // upper bound of deployment start timestamp
+	Offset    int      // number of records to skip
+	Limit     int      // max number of records to return
+}
+
+// helper function to check if given record matches the filter
+func (f HistoryFilter) match(rec DeployRecord) bool {
+	if f.Service != "" && f.Service != rec.Request.Service {
+		return false
+	}
+	if f.Namespace != "" && f.Namespace != rec.Request.Namespace {
+		return false
+	}
+	if f.Outcome != "" && f.Outcome != rec.Outcome {
+		return false
+	}
+	if f.Since > 0 && rec.Started < f.Since {
+		return false
+	}
+	if f.Until > 0 && rec.Started > f.Until {
+		return false
+	}
+	return true
+}
+
+// HistoryStore represents local database of deployment records, records
+// are kept in memory and appended to the store file as JSON lines
+type HistoryStore struct {
+	mu      sync.Mutex
+	file    string
+	records []DeployRecord
+	index   map[string]int // positions of records by their ids
+	max     int            // max number of records to keep, 0 keeps all records
+	lines   int            // number of lines in the store file
+}
+
+// deployHistory represents history store used by the server
+var deployHistory *HistoryStore
+
+// newHistoryStore creates new history store and loads existing records from given file
+func newHistoryStore(file string) (*HistoryStore, error) {
+	h := &HistoryStore{file: file, index: make(map[string]int), max: Config.MaxHistory}
+	if file == "" {
+		return h, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec DeployRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("unable to parse history record in %s, error %v", file, err)
+		}
+		h.update(rec)
+		h.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if h.lines > len(h.records) {
+		if err := h.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// helper function to remove oldest records above max number of records,
+// it should be called with lock held
+func (h *HistoryStore) prune() {
+	if h.max <= 0 || len(h.records) <= h.max {
+		return
+	}
+	h.records = append([]DeployRecord{}, h.records[len(h.records)-h.max:]...)
+	h.index = make(map[string]int)
+	for i, rec := range h.records {
+		h.index[rec.ID] = i
+	}
+}
+
+// helper function to rewrite store file with kept records, so updated and
+// pruned records do not grow the file, it should be called with lock held
+func (h *HistoryStore) compact() error {
+	var data []byte
+	for _, rec := range h.records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	tmp := h.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.file); err != nil {
+		return err
+	}
+	h.lines = len(h.records)
+	return nil
+}
+
+// helper function to replace record with the same id or append new one,
+// it should be called with lock held
+func (h *HistoryStore) update(rec DeployRecord) {
+	if i, ok := h.index[rec.ID]; ok {
+		h.records[i] = rec
+	} else {
+		h.index[rec.ID] = len(h.records)
+		h.records = append(h.records, rec)
+	}
+	h.prune()
+}
+
+// Add adds record to the history store, record with the same id (e.g. of
+// the job rolled back with release) is updated and its latest version wins
+// when store file is loaded
+func (h *HistoryStore) Add(rec DeployRecord) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.update(rec)
+	if h.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	// store file is compacted once it holds twice as many lines as kept records
+	if h.lines > 2*len(h.records) {
+		return h.compact()
+	}
+	return nil
+}
+
+// Query returns records matching given filter (newest first) and total number of matches
+func (h *HistoryStore) Query(f HistoryFilter) ([]DeployRecord, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := []DeployRecord{}
+	total := 0
+	for i := len(h.records) - 1; i >= 0; i-- {
+		rec := h.records[i]
+		if !f.match(rec) {
+			continue
+		}
+		total++
+		if total <= f.Offset {
+			continue
+		}
+		if f.Limit > 0 && len(out) >= f.Limit {
+			continue
+		}
+		out = append(out, rec)
+	}
+	return out, total
+}
+
+// Get returns history record for given id
+func (h *HistoryStore) Get(id string) (DeployRecord, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, ok := h.index[id]; ok {
+		return h.records[i], true
+	}
+	return DeployRecord{}, false
+}
+
+// helper function to parse timestamp given either as unix seconds or RFC3339 string
+func parseTimestamp(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %s", v)
+	}
+	return t.Unix(), nil
+}
+
+// helper function to parse history filter from HTTP request
+func historyFilter(r *http.Request) (HistoryFilter, error) {
+	var err error
+	q := r.URL.Query()
+	f := HistoryFilter{
+		Service:   q.Get("service"),
+		Namespace: q.Get("namespace"),
+		Outcome:   JobState(q.Get("outcome")),
+		Limit:     100,
+	}
+	if f.Since, err = parseTimestamp(q.Get("since")); err != nil {
+		return f, err
+	}
+	if f.Until, err = parseTimestamp(q.Get("until")); err != nil {
+		return f, err
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("invalid limit %s", v)
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if f.Offset, err = strconv.Atoi(v); err != nil || f.Offset < 0 {
+			return f, fmt.Errorf("invalid offset %s", v)
+		}
+	}
+	return f, nil
+}
+
+// HistoryResponse represents response of history API
+type HistoryResponse struct {
+	Total   int            `json:"total"`   // total number of matching records
+	Offset  int            `json:"offset"`  // offset of returned records
+	Limit   int            `json:"limit"`   // limit of returned records
+	Records []DeployRecord `json:"records"` // deployment records
+}
+
+// HistoryHandler represents history API
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	start := time.Now()
+	defer logRequest(w, r, start, &status)
+	if r.Method != "GET" {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		return
+	}
+	f, err := historyFilter(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	records, total := deployHistory.Query(f)
+	rec := HistoryResponse{Total: total, Offset: f.Offset, Limit: f.Limit, Records: records}
+	writeJSON(w, status, rec)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHistoryStore
+func TestHistoryStore(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "history.db")
+	h, err := newHistoryStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := []DeployRecord{
+		{ID: "1", Request: Request{Service: "srv1", Namespace: "ns1"}, Outcome: JobSucceeded, Started: 100},
+		{ID: "2", Request: Request{Service: "srv2", Namespace: "ns1"}, Outcome: JobFailed, Started: 200},
+		{ID: "3", Request: Request{Service: "srv1", Namespace: "ns2"}, Outcome: JobSucceeded, Started: 300},
+		{ID: "4", Request: Request{Service: "srv1", Namespace: "ns1"}, Outcome: JobSucceeded, Started: 400},
+	}
+	for _, rec := range recs {
+		if err := h.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// records should survive re-opening of the store
+	h, err = newHistoryStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, total := h.Query(HistoryFilter{Service: "srv1"})
+	if total != 3 || len(out) != 3 || out[0].ID != "4" {
+		t.Errorf("Fail TestHistoryStore, wrong service records %+v\n", out)
+	}
+	out, total = h.Query(HistoryFilter{Namespace: "ns1", Outcome: JobSucceeded, Since: 150})
+	if total != 1 || out[0].ID != "4" {
+		t.Errorf("Fail TestHistoryStore, wrong filtered records %+v\n", out)
+	}
+	out, total = h.Query(HistoryFilter{Offset: 1, Limit: 2})
+	if total != 4 || len(out) != 2 || out[0].ID != "3" || out[1].ID != "2" {
+		t.Errorf("Fail TestHistoryStore, wrong page of records %+v\n", out)
+	}
+	if rec, ok := h.Get("2"); !ok || rec.Request.Service != "srv2" {
+		t.Errorf("Fail TestHistoryStore, wrong record %+v\n", rec)
+	}
+
+	// oldest records are pruned and store file is compacted
+	Config.MaxHistory = 2
+	defer func() { Config.MaxHistory = 0 }()
+	h.max = 2
+	for _, rec := range recs {
+		rec.Outcome = JobRolledBack
+		if err := h.Add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h, err = newHistoryStore(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, total = h.Query(HistoryFilter{})
+	if total != 2 || out[0].ID != "4" || out[1].ID != "3" || out[0].Outcome != JobRolledBack {
+		t.Errorf("Fail TestHistoryStore, wrong pruned records %+v\n", out)
+	}
+	if _, ok := h.Get("1"); ok {
+		t.Errorf("Fail TestHistoryStore, pruned record is found\n")
+	}
+	data, _ := ioutil.ReadFile(fname)
+	if lines := strings.Count(string(data), "\n"); lines > 4 {
+		t.Errorf("Fail TestHistoryStore, store file is not compacted, %d lines\n", lines)
+	}
+}
+
+// TestHistoryHandler
+func TestHistoryHandler(t *testing.T) {
+	var err error
+	deployHistory, err = newHistoryStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployHistory.Add(DeployRecord{ID: "1", Request: Request{Service: "srv"}, Started: 1600000000})
+	deployHistory.Add(DeployRecord{ID: "2", Request: Request{Service: "srv"}, Started: 1700000000})
+
+	req := httptest.NewRequest("GET", "/history?service=srv&until=2020-12-31T00:00:00Z", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(HistoryHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var rec HistoryResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Total != 1 || rec.Records[0].ID != "1" {
+		t.Errorf("Fail TestHistoryHandler, wrong response %+v\n", rec)
+	}
+
+	req = httptest.NewRequest("GET", "/history?limit=abc", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(HistoryHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
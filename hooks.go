@@ -0,0 +1,249 @@
+package main
+
+// hooks module provides pre- and post-deploy hooks executed around deployments
+//
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Hooks represents pre- and post-deploy hooks of the service
+type Hooks struct {
+	Pre  []Hook `json:"pre"`  // hooks executed before deployment, their failure aborts deployment
+	Post []Hook `json:"post"` // hooks executed after deployment, their failure triggers rollback
+}
+
+// Hook represents deployment hook
+type Hook struct {
+	Name     string `json:"name"`     // hook name
+	Type     string `json:"type"`     // hook type: job or http
+	Template string `json:"template"` // path to k8s Job template of job hook
+	URL      string `json:"url"`      // callback URL of http hook
+	Method   string `json:"method"`   // HTTP method of http hook, default POST
+	Timeout  int    `json:"timeout"`  // hook timeout in seconds, default 300
+}
+
+// HookResult represents result of hook execution
+type HookResult struct {
+	Name     string  `json:"name"`            // hook name
+	Phase    string  `json:"phase"`           // hook phase: pre or post
+	Status   string  `json:"status"`          // hook status: succeeded or failed
+	Error    string  `json:"error,omitempty"` // hook error
+	Logs     string  `json:"logs,omitempty"`  // hook logs
+	Duration float64 `json:"duration"`        // hook duration in seconds
+}
+
+// HookData represents data available in job hook templates and sent to http hooks
+type HookData struct {
+	Request
+	JobID string `json:"job_id"` // deployment job id
+	Hook  string `json:"hook"`   // hook name
+	Phase string `json:"phase"`  // hook phase
+
+	Changelog *Changelog `json:"changelog,omitempty"` // changes between deployed and requested tags
+}
+
+// hookPollInterval defines how often status of hook job is checked
+var hookPollInterval = 2 * time.Second
+
+// max size of hook logs kept in deployment record
+const maxHookLogs = 64 * 1024
+
+// helper function to return pre-deploy hooks
+func (h *Hooks) pre() []Hook {
+	if h == nil {
+		return nil
+	}
+	return h.Pre
+}
+
+// helper function to return post-deploy hooks
+func (h *Hooks) post() []Hook {
+	if h == nil {
+		return nil
+	}
+	return h.Post
+}
+
+// helper function to return hook timeout
+func (h Hook) timeout() time.Duration {
+	if h.Timeout > 0 {
+		return time.Duration(h.Timeout) * time.Second
+	}
+	return 300 * time.Second
+}
+
+// helper function to truncate hook logs
+func truncateLogs(logs string) string {
+	if len(logs) > maxHookLogs {
+		return logs[len(logs)-maxHookLogs:]
+	}
+	return logs
+}
+
+// helper function to run given hooks, it stops at first failed hook
+func runHooks(phase string, hooks []Hook, r Request, job *Job) error {
+	for _, h := range hooks {
+		data := HookData{Request: r, Hook: h.Name, Phase: phase, Changelog: job.changelog()}
+		if job != nil {
+			data.JobID = job.ID
+		}
+		job.Stage(fmt.Sprintf("%s-hook %s", phase, h.Name), "started", "")
+		start := time.Now()
+		var logs string
+		var err error
+		switch h.Type {
+		case "job":
+			logs, err = runJobHook(h, data)
+		case "http":
+			logs, err = runHTTPHook(h, data)
+		default:
+			err = fmt.Errorf("unknown hook type %s", h.Type)
+		}
+		res := HookResult{Name: h.Name, Phase: phase, Status: "succeeded", Logs: truncateLogs(logs), Duration: time.Since(start).Seconds()}
+		if err != nil {
+			res.Status = "failed"
+			res.Error = err.Error()
+		}
+		job.update(func(j *Job) { j.Hooks = append(j.Hooks, res) })
+		job.Stage(fmt.Sprintf("%s-hook %s", phase, h.Name), res.Status, res.Error)
+		if err != nil {
+			return fmt.Errorf("hook %s: %v", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// K8sJobStatus represents status of k8s Job
+type K8sJobStatus struct {
+	Status struct {
+		Active     int `json:"Active"`
+		Succeeded  int `json:"Succeeded"`
+		Failed     int `json:"Failed"`
+		Conditions []struct {
+			Type    string `json:"Type"`
+			Status  string `json:"Status"`
+			Message string `json:"Message"`
+		} `json:"Conditions"`
+	} `json:"Status"`
+}
+
+// helper function to check if k8s Job is finished, it returns error for failed job
+func (s K8sJobStatus) finished() (bool, error) {
+	for _, c := range s.Status.Conditions {
+		if c.Status != "True" {
+			continue
+		}
+		switch c.Type {
+		case "Complete":
+			return true, nil
+		case "Failed":
+			return true, fmt.Errorf("job failed: %s", c.Message)
+		}
+	}
+	return false, nil
+}
+
+// helper function to render job hook template
+func renderHook(h Hook, data HookData) (string, error) {
+	content, err := ioutil.ReadFile(h.Template)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(h.Name).Parse(string(content))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// helper function to run k8s Job hook and wait for its completion,
+// it returns logs of the job
+func runJobHook(h Hook, data HookData) (string, error) {
+	manifest, err := renderHook(h, data)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile("", "imagebot-hook-*.yaml")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(manifest)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	out, err := runCommand("kubectl", "create", "-f", tmp.Name(), "-n", data.Namespace, "-o", "name")
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(out))
+	deadline := time.Now().Add(h.timeout())
+	for {
+		var status K8sJobStatus
+		out, err := runCommand("kubectl", "get", name, "-n", data.Namespace, "-o", "json")
+		if err == nil {
+			err = json.Unmarshal(out, &status)
+		}
+		if err != nil {
+			return "", err
+		}
+		done, jerr := status.finished()
+		if done {
+			logs, _ := runCommand("kubectl", "logs", name, "-n", data.Namespace, "--all-containers")
+			return string(logs), jerr
+		}
+		if time.Now().After(deadline) {
+			logs, _ := runCommand("kubectl", "logs", name, "-n", data.Namespace, "--all-containers")
+			return string(logs), fmt.Errorf("%s did not finish within %v", name, h.timeout())
+		}
+		time.Sleep(hookPollInterval)
+	}
+}
+
+// helper function to run http hook, it returns response body of the callback
+func runHTTPHook(h Hook, data HookData) (string, error) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	method := h.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, h.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: h.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHookLogs))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return string(out), fmt.Errorf("%s %s returned status %d", method, h.URL, resp.StatusCode)
+	}
+	return string(out), nil
+}
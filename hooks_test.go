@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJobHook
+func TestJobHook(t *testing.T) {
+	interval := hookPollInterval
+	defer func() { hookPollInterval = interval }()
+	hookPollInterval = 10 * time.Millisecond
+	tmpl := filepath.Join(t.TempDir(), "migrate.yaml")
+	ioutil.WriteFile(tmpl, []byte("kind: Job\nmetadata:\n  generateName: migrate-{{.Service}}-\nimage: {{.Image}}:{{.Tag}}\n"), 0644)
+	var manifest string
+	polls := 0
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl create -f"):
+			data, _ := ioutil.ReadFile(strings.Split(cmd, " ")[3])
+			manifest = string(data)
+			return []byte("job.batch/migrate-srv-abc\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get job.batch/migrate-srv-abc"):
+			polls++
+			if polls < 2 {
+				return []byte(`{"status": {"active": 1}}`), nil
+			}
+			return []byte(`{"status": {"succeeded": 1, "conditions": [{"type": "Complete", "status": "True"}]}}`), nil
+		case strings.HasPrefix(cmd, "kubectl logs job.batch/migrate-srv-abc"):
+			return []byte("migration done"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	hooks := []Hook{{Name: "migrate", Type: "job", Template: tmpl}}
+	if err := runHooks("pre", hooks, r, job); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(manifest, "image: repo/srv:0.2") || !strings.Contains(manifest, "migrate-srv-") {
+		t.Errorf("Fail TestJobHook, wrong manifest\n%s\n", manifest)
+	}
+	if len(job.Hooks) != 1 || job.Hooks[0].Logs != "migration done" || job.Hooks[0].Status != "succeeded" {
+		t.Errorf("Fail TestJobHook, wrong hook results %+v\n", job.Hooks)
+	}
+}
+
+// TestPostHookRollback
+func TestPostHookRollback(t *testing.T) {
+	var data HookData
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&data)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("smoke test failed"))
+	}))
+	defer ts.Close()
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment srv"):
+			return []byte("image: repo/srv:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	policies := Config.Policies
+	defer func() { Config.Policies = policies }()
+	Config.Policies = []ServicePolicy{
+		{Service: "srv", Hooks: &Hooks{Post: []Hook{{Name: "smoke", Type: "http", URL: ts.URL}}}},
+	}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	err := exeRequest(r, job)
+	if !errors.Is(err, errRolledBack) {
+		t.Fatalf("Fail TestPostHookRollback, wrong error %v\n", err)
+	}
+	if data.Tag != "0.2" || data.Phase != "post" || data.JobID != job.ID {
+		t.Errorf("Fail TestPostHookRollback, wrong hook data %+v\n", data)
+	}
+	if !strings.Contains(strings.Join(*calls, "\n"), "/srv-test-0.1-") {
+		t.Errorf("Fail TestPostHookRollback, previous image is not redeployed %v\n", *calls)
+	}
+	if len(job.Hooks) != 1 || job.Hooks[0].Logs != "smoke test failed" {
+		t.Errorf("Fail TestPostHookRollback, wrong hook results %+v\n", job.Hooks)
+	}
+}
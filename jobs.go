@@ -0,0 +1,768 @@
+package main
+
+// jobs module provides asynchronous execution of deployment requests
+// via bounded pool of workers and keeps track of their states
+//
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobState represents state of deployment job
+type JobState string
+
+// list of possible job states
+const (
+	JobQueued     JobState = "queued"
+	JobRunning    JobState = "running"
+	JobSucceeded  JobState = "succeeded"
+	JobFailed     JobState = "failed"
+	JobRolledBack JobState = "rolled back"
+	JobCoalesced  JobState = "coalesced"
+	JobSkipped    JobState = "skipped"
+	JobRejected   JobState = "rejected"
+)
+
+// errRolledBack should be wrapped by deployment steps which failed
+// but successfully restored previous state of the workload
+var errRolledBack = errors.New("deployment rolled back")
+
+// errCoalesced is returned for jobs superseded by newer request for the same workload
+var errCoalesced = errors.New("request coalesced with newer request")
+
+// Stage represents stage transition of deployment
+type Stage struct {
+	Name    string `json:"name"`              // stage name
+	Status  string `json:"status"`            // stage status: started, succeeded or failed
+	Time    int64  `json:"time"`              // stage transition timestamp
+	Message string `json:"message,omitempty"` // stage message
+}
+
+// Job represents deployment job of image request
+type Job struct {
+	ID       string   `json:"id"`                 // job identifier
+	Request  Request  `json:"request"`            // image request of the job
+	State    JobState `json:"state"`              // job state
+	Error    string   `json:"error,omitempty"`    // job error message
+	Created  int64    `json:"created"`            // job creation timestamp
+	Started  int64    `json:"started,omitempty"`  // job start timestamp
+	Finished int64    `json:"finished,omitempty"` // job finish timestamp
+	Logs     []string `json:"logs"`               // job logs
+
+	Caller        string  `json:"caller,omitempty"`         // identity of the caller
+	TokenID       string  `json:"token_id,omitempty"`       // id of the token used in request
+	PreviousImage string  `json:"previous_image,omitempty"` // image used before deployment
+	NewImage      string  `json:"new_image,omitempty"`      // deployed image
+	Digest        string  `json:"digest,omitempty"`         // digest of deployed image
+	Duration      float64 `json:"duration,omitempty"`       // deployment duration in seconds
+	Signer        string  `json:"signer,omitempty"`         // verified signer of tag or commit
+
+	PreviousRevision int            `json:"previous_revision,omitempty"` // release revision before deployment
+	Revision         int            `json:"revision,omitempty"`          // release revision after deployment
+	Stages           []Stage        `json:"stages,omitempty"`            // stage transitions of deployment
+	Hooks            []HookResult   `json:"hooks,omitempty"`             // results of deployment hooks
+	DeploymentID     int64          `json:"deployment_id,omitempty"`     // id of GitHub deployment
+	Changelog        *Changelog     `json:"changelog,omitempty"`         // changes between deployed and requested tags
+	Vulnerabilities  string         `json:"vulnerabilities,omitempty"`   // summary of image vulnerabilities
+	Action           string         `json:"action,omitempty"`            // maintenance action of the job, e.g. switchback, default deployment
+	NotBefore        int64          `json:"not_before,omitempty"`        // timestamp before which scheduled job is not executed
+	ReleaseID        string         `json:"release_id,omitempty"`        // id of release job which deploys this job
+	Release          *ReleaseResult `json:"release,omitempty"`           // result of release job
+
+	mu  sync.Mutex // protects job data
+	seq uint64     // job sequence number within job manager
+}
+
+// jobData represents job data without job methods, it is used for JSON marshalling
+type jobData Job
+
+// MarshalJSON implements json.Marshaler interface
+func (j *Job) MarshalJSON() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal((*jobData)(j))
+}
+
+// Logf adds log message to the job and to the server log
+func (j *Job) Logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg)
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	tstamp := time.Now().Format(time.RFC3339)
+	j.Logs = append(j.Logs, fmt.Sprintf("[%s] %s", tstamp, msg))
+}
+
+// Stage records stage transition of the job
+func (j *Job) Stage(name, status, msg string) {
+	if msg != "" {
+		j.Logf("stage %s %s: %s", name, status, msg)
+	} else {
+		j.Logf("stage %s %s", name, status)
+	}
+	j.update(func(j *Job) {
+		j.Stages = append(j.Stages, Stage{Name: name, Status: status, Time: time.Now().Unix(), Message: msg})
+	})
+}
+
+// helper function to set state of the job
+func (j *Job) setState(state JobState, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.State = state
+	now := time.Now().Unix()
+	switch state {
+	case JobRunning:
+		j.Started = now
+	case JobQueued:
+		j.Started = 0
+		j.Finished = 0
+	default:
+		j.Finished = now
+	}
+	if err != nil {
+		j.Error = err.Error()
+	}
+}
+
+// helper function to update job data under the job lock
+func (j *Job) update(f func(j *Job)) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(j)
+}
+
+// helper function to create deployment record of the job
+func (j *Job) record() DeployRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return DeployRecord{
+		ID:               j.ID,
+		Request:          j.Request,
+		PreviousImage:    j.PreviousImage,
+		NewImage:         j.NewImage,
+		Digest:           j.Digest,
+		Outcome:          j.State,
+		Error:            j.Error,
+		Started:          j.Started,
+		Finished:         j.Finished,
+		Duration:         j.Duration,
+		Caller:           j.Caller,
+		TokenID:          j.TokenID,
+		Signer:           j.Signer,
+		PreviousRevision: j.PreviousRevision,
+		Revision:         j.Revision,
+		Stages:           append([]Stage{}, j.Stages...),
+		Hooks:            append([]HookResult{}, j.Hooks...),
+		Changelog:        j.Changelog,
+		Vulnerabilities:  j.Vulnerabilities,
+		Action:           j.Action,
+	}
+}
+
+// helper function to get state of the job
+func (j *Job) state() JobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State
+}
+
+// helper function to get digest of the job image verified by request checks
+func (j *Job) digest() string {
+	if j == nil {
+		return ""
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Digest
+}
+
+// helper function to get changelog of the job
+func (j *Job) changelog() *Changelog {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Changelog
+}
+
+// helper function to generate job identifier
+func jobID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// newJob creates new job for given image request
+func newJob(r Request) *Job {
+	return &Job{
+		ID:      jobID(),
+		Request: r,
+		State:   JobQueued,
+		Created: time.Now().Unix(),
+		Logs:    []string{},
+	}
+}
+
+// helper function to attach information gathered by checks of the job request
+func (j *Job) setInfo(info RequestInfo) {
+	j.update(func(j *Job) {
+		j.Signer = info.Signer
+		j.Digest = info.Digest
+		j.Vulnerabilities = info.Vulnerabilities
+	})
+}
+
+// JobManager keeps track of deployment jobs and executes them
+type JobManager struct {
+	mu      sync.Mutex      // protects jobs map and order list
+	jobs    map[string]*Job // jobs by their ids
+	order   []string        // job ids in submission order
+	queue   chan *Job       // queue of jobs to be executed
+	store   string          // file name where jobs are persisted
+	workers int             // number of workers
+	maxJobs int             // max number of finished jobs to keep
+	seq     uint64          // last assigned job sequence number
+	slots   *workloadSlots  // serializes deployments of the same workload
+
+	timers map[string]*scheduledJob // pending scheduled jobs by workload and action
+}
+
+// scheduledJob represents job waiting for its NotBefore timestamp
+type scheduledJob struct {
+	job   *Job
+	timer *time.Timer
+}
+
+// jobManager represents job manager used by the server
+var jobManager *JobManager
+
+// newJobManager creates new job manager and loads persisted jobs from the store
+func newJobManager(store string, workers, queueSize, maxJobs int) (*JobManager, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	m := &JobManager{
+		jobs:    make(map[string]*Job),
+		store:   store,
+		workers: workers,
+		maxJobs: maxJobs,
+		slots:   newWorkloadSlots(),
+		timers:  make(map[string]*scheduledJob),
+	}
+	pending, err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > queueSize {
+		queueSize = len(pending)
+	}
+	m.queue = make(chan *Job, queueSize)
+	for _, job := range pending {
+		job.Logf("job %s re-queued after server restart", job.ID)
+		job.setState(JobQueued, nil)
+		if job.ReleaseID != "" {
+			// release members are deployed by their release job
+			continue
+		}
+		if job.Action != "" && job.Action != actionRelease {
+			m.schedule(job)
+			continue
+		}
+		m.queue <- job
+	}
+	return m, nil
+}
+
+// Start starts workers of job manager
+func (m *JobManager) Start() {
+	for i := 0; i < m.workers; i++ {
+		go m.worker()
+	}
+}
+
+// helper function to process jobs from the queue
+func (m *JobManager) worker() {
+	for job := range m.queue {
+		m.run(job, false)
+	}
+}
+
+// Submit adds job to the queue of the job manager
+func (m *JobManager) Submit(job *Job) error {
+	m.add(job)
+	select {
+	case m.queue <- job:
+		job.Logf("job %s queued for %s/%s", job.ID, job.Request.Namespace, job.Request.Service)
+		m.save()
+		return nil
+	default:
+		err := errors.New("job queue is full")
+		job.setState(JobFailed, err)
+		m.save()
+		return err
+	}
+}
+
+// Run executes given job and records its outcome, it waits for busy workload
+func (m *JobManager) Run(job *Job) error {
+	return m.run(job, true)
+}
+
+// helper function to execute given job, jobs of busy workloads either wait
+// for the workload or they are parked and re-queued once workload is released
+func (m *JobManager) run(job *Job, wait bool) error {
+	m.add(job)
+	if job.Action == actionRelease {
+		// release members acquire slots of their workloads
+		return m.exec(job)
+	}
+	release, err := m.acquire(job, wait)
+	if release == nil {
+		return err
+	}
+	defer release()
+	return m.exec(job)
+}
+
+// helper function to wait for CI checks of the job and acquire its workload
+// slot, it returns function which releases the slot or nil if the job is not
+// executed, e.g. its checks failed or it is parked or coalesced
+func (m *JobManager) acquire(job *Job, wait bool) (func(), error) {
+	if job.Action == "" {
+		// CI checks are waited for before the job takes its workload, queued
+		// jobs with pending checks are re-queued instead of holding the worker
+		var requeue func()
+		if !wait {
+			requeue = func() { m.requeue(job) }
+		}
+		ready, err := waitChecks(job.Request, findPolicy(job.Request), job, requeue)
+		if err != nil {
+			m.fail(job, err)
+			return nil, err
+		}
+		if !ready {
+			return nil, nil
+		}
+	}
+	key := job.Request.workload()
+	status, superseded := m.slots.acquire(key, job, wait)
+	if superseded != nil {
+		m.coalesce(superseded)
+	}
+	switch status {
+	case slotCoalesced:
+		m.coalesce(job)
+		return nil, errCoalesced
+	case slotParked:
+		job.Logf("job %s waits for deployment of %s", job.ID, key)
+		return nil, nil
+	}
+	return func() { m.releaseSlot(key, job) }, nil
+}
+
+// helper function to release workload slot held by given job and re-queue
+// job parked for the workload
+func (m *JobManager) releaseSlot(key string, job *Job) {
+	if p := m.slots.release(key, job); p != nil {
+		m.requeue(p)
+	}
+}
+
+// helper function to execute given job and store its outcome, deployment
+// record is not stored for release jobs since their members have their own
+func (m *JobManager) exec(job *Job) error {
+	if job.Action != actionRelease {
+		defer m.record(job)
+	}
+	job.setState(JobRunning, nil)
+	m.save()
+	job.Logf("job %s started", job.ID)
+	start := time.Now()
+	err := m.execute(job)
+	job.update(func(j *Job) { j.Duration = time.Since(start).Seconds() })
+	if err == nil {
+		job.setState(JobSucceeded, nil)
+		job.Logf("job %s succeeded", job.ID)
+	} else if errors.Is(err, errRolledBack) {
+		job.setState(JobRolledBack, err)
+		job.Logf("job %s rolled back, error %v", job.ID, err)
+	} else {
+		job.setState(JobFailed, err)
+		job.Logf("job %s failed, error %v", job.ID, err)
+	}
+	m.save()
+	return err
+}
+
+// helper function to execute action of the job
+func (m *JobManager) execute(job *Job) error {
+	switch job.Action {
+	case "":
+		return exeRequest(job.Request, job)
+	case actionRelease:
+		return runRelease(m, job)
+	case actionSwitchBack:
+		return switchBackJob(job)
+	case actionScaleDown:
+		return scaleDownJob(job)
+	}
+	return fmt.Errorf("unknown job action %s", job.Action)
+}
+
+// Schedule registers maintenance job which is executed once its NotBefore
+// timestamp is reached, pending job of the same workload and action is cancelled
+func (m *JobManager) Schedule(job *Job) {
+	m.add(job)
+	m.schedule(job)
+	job.Logf("job %s %s of %s scheduled at %s", job.ID, job.Action, job.Request.workload(), time.Unix(job.NotBefore, 0).Format(time.RFC3339))
+	m.save()
+}
+
+// Cancel cancels pending scheduled job of given workload and action
+func (m *JobManager) Cancel(workload, action string) {
+	m.mu.Lock()
+	key := workload + "#" + action
+	p, ok := m.timers[key]
+	delete(m.timers, key)
+	m.mu.Unlock()
+	if !ok || !p.timer.Stop() {
+		return
+	}
+	p.job.setState(JobSkipped, fmt.Errorf("%s of %s is cancelled", action, workload))
+	m.save()
+}
+
+// helper function to start timer of scheduled job, the job runs outside of
+// workers once the timer fires
+func (m *JobManager) schedule(job *Job) {
+	key := job.Request.workload() + "#" + job.Action
+	m.Cancel(job.Request.workload(), job.Action)
+	delay := time.Until(time.Unix(job.NotBefore, 0))
+	if delay < 0 {
+		delay = 0
+	}
+	p := &scheduledJob{job: job}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timers[key] = p
+	p.timer = time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		if m.timers[key] == p {
+			delete(m.timers, key)
+		}
+		m.mu.Unlock()
+		m.Run(job)
+	})
+}
+
+// helper function to mark job failed before its execution
+func (m *JobManager) fail(job *Job, err error) {
+	job.setState(JobFailed, err)
+	job.Logf("job %s failed, error %v", job.ID, err)
+	m.save()
+	m.record(job)
+}
+
+// helper function to mark job superseded by newer request of the same workload
+func (m *JobManager) coalesce(job *Job) {
+	job.setState(JobCoalesced, errCoalesced)
+	job.Logf("job %s superseded by newer request for %s", job.ID, job.Request.workload())
+	m.save()
+	m.record(job)
+}
+
+// helper function to put parked job back into the queue
+func (m *JobManager) requeue(job *Job) {
+	select {
+	case m.queue <- job:
+	default:
+		go func() { m.queue <- job }()
+	}
+}
+
+// helper function to store deployment record of finished job in history store
+func (m *JobManager) record(job *Job) {
+	if deployHistory == nil {
+		return
+	}
+	if err := deployHistory.Add(job.record()); err != nil {
+		log.Printf("unable to store deployment record of job %s, error %v\n", job.ID, err)
+	}
+}
+
+// Get returns job for given id
+func (m *JobManager) Get(id string) (*Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+// Jobs returns list of known jobs in submission order
+func (m *JobManager) Jobs() []*Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []*Job
+	for _, id := range m.order {
+		out = append(out, m.jobs[id])
+	}
+	return out
+}
+
+// helper function to register job within job manager
+func (m *JobManager) add(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.jobs[job.ID]; ok {
+		return
+	}
+	m.seq++
+	job.seq = m.seq
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job.ID)
+	m.prune()
+}
+
+// helper function to remove oldest finished jobs, it should be called with lock held
+func (m *JobManager) prune() {
+	if m.maxJobs <= 0 || len(m.order) <= m.maxJobs {
+		return
+	}
+	excess := len(m.order) - m.maxJobs
+	var order []string
+	for _, id := range m.order {
+		job := m.jobs[id]
+		if excess > 0 {
+			if s := job.state(); s != JobQueued && s != JobRunning {
+				delete(m.jobs, id)
+				excess--
+				continue
+			}
+		}
+		order = append(order, id)
+	}
+	m.order = order
+}
+
+// helper function to persist jobs into the store
+func (m *JobManager) save() {
+	if m.store == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []*Job
+	for _, id := range m.order {
+		jobs = append(jobs, m.jobs[id])
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		log.Println("unable to marshal jobs", err)
+		return
+	}
+	tmp := m.store + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("unable to write jobs store", err)
+		return
+	}
+	if err := os.Rename(tmp, m.store); err != nil {
+		log.Println("unable to update jobs store", err)
+	}
+}
+
+// helper function to load jobs from the store, it returns list of unfinished jobs
+func (m *JobManager) load() ([]*Job, error) {
+	var pending []*Job
+	if m.store == "" {
+		return pending, nil
+	}
+	data, err := ioutil.ReadFile(m.store)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pending, nil
+		}
+		return pending, err
+	}
+	var jobs []*Job
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return pending, err
+	}
+	for _, job := range jobs {
+		if job.Logs == nil {
+			job.Logs = []string{}
+		}
+		m.seq++
+		job.seq = m.seq
+		m.jobs[job.ID] = job
+		m.order = append(m.order, job.ID)
+		if job.State == JobQueued || job.State == JobRunning {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+// workloadSlots serializes deployments of the same workload, while waiting
+// for a busy workload only the newest request is kept and older ones are coalesced
+type workloadSlots struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	busy   map[string]bool // workloads with running deployment
+	latest map[string]*Job // newest job per busy or awaited workload
+	parked map[string]*Job // newest job waiting for busy workload without holding a worker
+}
+
+// slot acquisition outcomes
+const (
+	slotAcquired  = iota // job holds workload slot
+	slotCoalesced        // job is superseded by newer request
+	slotParked           // job waits for busy workload and it is re-queued once workload is released
+)
+
+// newWorkloadSlots creates new workloadSlots object
+func newWorkloadSlots() *workloadSlots {
+	s := &workloadSlots{
+		busy:   make(map[string]bool),
+		latest: make(map[string]*Job),
+		parked: make(map[string]*Job),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// helper function to compare versions of image tags, e.g. v1.10.0 and 1.9.2,
+// it returns false if either tag is not a version
+func compareVersions(t1, t2 string) (int, bool) {
+	parse := func(tag string) ([]int, bool) {
+		var out []int
+		for _, v := range strings.Split(strings.TrimPrefix(tag, "v"), ".") {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, false
+			}
+			out = append(out, n)
+		}
+		return out, true
+	}
+	v1, ok1 := parse(t1)
+	v2, ok2 := parse(t2)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	for i := 0; i < len(v1) || i < len(v2); i++ {
+		var n1, n2 int
+		if i < len(v1) {
+			n1 = v1[i]
+		}
+		if i < len(v2) {
+			n2 = v2[i]
+		}
+		if n1 != n2 {
+			if n1 > n2 {
+				return 1, true
+			}
+			return -1, true
+		}
+	}
+	return 0, true
+}
+
+// helper function to check if job j1 supersedes job j2, jobs with version
+// tags are ordered by versions and others by submission order
+func supersedes(j1, j2 *Job) bool {
+	if cmp, ok := compareVersions(j1.Request.Tag, j2.Request.Tag); ok && cmp != 0 {
+		return cmp > 0
+	}
+	return j1.seq > j2.seq
+}
+
+// helper function to acquire workload slot for given job, if workload is busy
+// the job either waits for it or it is parked, older jobs are coalesced; it
+// returns acquisition outcome and parked job superseded by given job
+func (s *workloadSlots) acquire(key string, job *Job, wait bool) (int, *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job.Action != "" {
+		// maintenance jobs wait for the workload and never coalesce deployments
+		for s.busy[key] {
+			s.cond.Wait()
+		}
+		s.busy[key] = true
+		return slotAcquired, nil
+	}
+	cur := s.latest[key]
+	if cur != nil && cur != job && supersedes(cur, job) {
+		return slotCoalesced, nil
+	}
+	var superseded *Job
+	if p := s.parked[key]; p != nil && p != job {
+		superseded = p
+	}
+	delete(s.parked, key)
+	s.latest[key] = job
+	// wake up older jobs waiting for this workload
+	s.cond.Broadcast()
+	if !s.busy[key] {
+		s.busy[key] = true
+		return slotAcquired, superseded
+	}
+	if !wait {
+		s.parked[key] = job
+		return slotParked, superseded
+	}
+	for s.busy[key] {
+		s.cond.Wait()
+		if s.latest[key] != job {
+			return slotCoalesced, superseded
+		}
+	}
+	s.busy[key] = true
+	return slotAcquired, superseded
+}
+
+// helper function to wait for workload slot regardless of deployment jobs of
+// the workload, e.g. to roll back release member deployed before server restart
+func (s *workloadSlots) hold(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.busy[key] {
+		s.cond.Wait()
+	}
+	s.busy[key] = true
+}
+
+// helper function to release workload slot held by given job, it returns
+// parked job which should be re-queued
+func (s *workloadSlots) release(key string, job *Job) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.busy, key)
+	if s.latest[key] == job {
+		delete(s.latest, key)
+	}
+	p := s.parked[key]
+	delete(s.parked, key)
+	s.cond.Broadcast()
+	return p
+}
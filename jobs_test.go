@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestJobStore
+func TestJobStore(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "jobs.json")
+	mgr, err := newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Request{Service: "srv", Namespace: "test", Tag: "123", Repository: "repo/srv"}
+	job := newJob(r)
+	if err := mgr.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	done := newJob(r)
+	mgr.add(done)
+	done.setState(JobSucceeded, nil)
+	mgr.save()
+
+	// new job manager should pick up queued job from the store
+	mgr, err = newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mgr.Jobs()) != 2 {
+		t.Errorf("Fail TestJobStore, wrong number of jobs %d\n", len(mgr.Jobs()))
+	}
+	if len(mgr.queue) != 1 {
+		t.Errorf("Fail TestJobStore, wrong number of queued jobs %d\n", len(mgr.queue))
+	}
+	if j, ok := mgr.Get(done.ID); !ok || j.State != JobSucceeded {
+		t.Errorf("Fail TestJobStore, unable to restore job %+v\n", j)
+	}
+}
+
+// TestJobsHandler
+func TestJobsHandler(t *testing.T) {
+	mgr := jobManager
+	defer func() { jobManager = mgr }()
+	var err error
+	jobManager, err = newJobManager("", 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := newJob(Request{Service: "srv", Namespace: "test", Tag: "123"})
+	jobManager.Submit(job)
+
+	req := httptest.NewRequest("GET", fmt.Sprintf("/jobs/%s", job.ID), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(JobsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var rec Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != job.ID || rec.State != JobQueued {
+		t.Errorf("Fail TestJobsHandler, wrong job %s %s\n", rec.ID, rec.State)
+	}
+
+	req = httptest.NewRequest("GET", "/jobs/xxx", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(JobsHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+// TestWorkloadSlots
+func TestWorkloadSlots(t *testing.T) {
+	slots := newWorkloadSlots()
+	job := func(seq uint64, tag string) *Job {
+		return &Job{seq: seq, Request: Request{Namespace: "ns", Service: "srv", Tag: tag}}
+	}
+	j1, j2, j3 := job(1, "abc"), job(2, "def"), job(3, "ghi")
+	if status, _ := slots.acquire("ns/srv", j1, true); status != slotAcquired {
+		t.Fatal("Fail TestWorkloadSlots, unable to acquire free workload")
+	}
+	// different workload should not be blocked
+	other := job(4, "abc")
+	if status, _ := slots.acquire("ns/other", other, true); status != slotAcquired {
+		t.Fatal("Fail TestWorkloadSlots, unable to acquire different workload")
+	}
+	slots.release("ns/other", other)
+
+	// jobs of busy workload are parked, newer job supersedes parked one
+	if status, _ := slots.acquire("ns/srv", j2, false); status != slotParked {
+		t.Fatalf("Fail TestWorkloadSlots, job is not parked, status %d\n", status)
+	}
+	if status, superseded := slots.acquire("ns/srv", j3, false); status != slotParked || superseded != j2 {
+		t.Fatalf("Fail TestWorkloadSlots, parked job is not superseded, status %d\n", status)
+	}
+	if status, _ := slots.acquire("ns/srv", j2, false); status != slotCoalesced {
+		t.Error("Fail TestWorkloadSlots, superseded request should not be acquired")
+	}
+	if p := slots.release("ns/srv", j1); p != j3 {
+		t.Fatalf("Fail TestWorkloadSlots, parked job is not returned on release %+v\n", p)
+	}
+	if status, _ := slots.acquire("ns/srv", j3, false); status != slotAcquired {
+		t.Fatal("Fail TestWorkloadSlots, re-queued job is not acquired")
+	}
+
+	// waiting job is coalesced by newer job
+	j4, j5 := job(5, "jkl"), job(6, "mno")
+	older := make(chan int)
+	go func() {
+		status, _ := slots.acquire("ns/srv", j4, true)
+		older <- status
+	}()
+	waitLatest(slots, "ns/srv", j4)
+	newer := make(chan int)
+	go func() {
+		status, _ := slots.acquire("ns/srv", j5, true)
+		newer <- status
+	}()
+	if status := <-older; status != slotCoalesced {
+		t.Error("Fail TestWorkloadSlots, older request should be coalesced")
+	}
+	slots.release("ns/srv", j3)
+	if status := <-newer; status != slotAcquired {
+		t.Error("Fail TestWorkloadSlots, newest request should be executed")
+	}
+	slots.release("ns/srv", j5)
+	if len(slots.latest) != 0 || len(slots.busy) != 0 || len(slots.parked) != 0 {
+		t.Errorf("Fail TestWorkloadSlots, released workloads are not pruned %+v\n", slots.latest)
+	}
+
+	// version tags are ordered by versions
+	v2, v1 := job(7, "v1.10.0"), job(8, "v1.9.2")
+	slots.acquire("ns/srv", j1, true)
+	slots.acquire("ns/srv", v2, false)
+	if status, _ := slots.acquire("ns/srv", v1, false); status != slotCoalesced {
+		t.Error("Fail TestWorkloadSlots, older version should be coalesced")
+	}
+}
+
+// helper function to wait until given job becomes the newest job of the workload,
+// latest job is set and the job waits under the same lock
+func waitLatest(slots *workloadSlots, key string, job *Job) {
+	for {
+		slots.mu.Lock()
+		ok := slots.latest[key] == job
+		slots.mu.Unlock()
+		if ok {
+			return
+		}
+		runtime.Gosched()
+	}
+}
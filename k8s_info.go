@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"log"
 	"os/exec"
+	"sort"
 	"strings"
 )
 
@@ -28,7 +29,7 @@ type ContainerStatus struct {
 
 // Metadata represents meta-data information about k8s image
 type Metadata struct {
-	//     Annotations       map[string]string        `json:"Annotations"`
+	Annotations map[string]string `json:"Annotations"`
 	//     CreationTimestamp string                   `json:"CreationTimestamp"`
 	//     GenerateName      string                   `json:"GenerateName"`
 	//     Labels            map[string]string        `json:"Labels"`
@@ -61,7 +62,62 @@ type PodInfo struct {
 	//     Kind       string   `json:"Kind"`
 	Metadata Metadata `json:"Metadata"`
 	//     Spec       Spec     `json:"Spec"`
-	//     Status Status `json:Status`
+	Status Status `json:"Status"`
+}
+
+// PodList represents list of pods
+type PodList struct {
+	Items []PodInfo `json:"Items"`
+}
+
+// DeploymentSpec represents k8s deployment spec
+type DeploymentSpec struct {
+	Replicas int `json:"Replicas"`
+	Selector struct {
+		MatchLabels map[string]string `json:"MatchLabels"`
+	} `json:"Selector"`
+}
+
+// DeploymentStatus represents k8s deployment status
+type DeploymentStatus struct {
+	Replicas          int `json:"Replicas"`
+	ReadyReplicas     int `json:"ReadyReplicas"`
+	UpdatedReplicas   int `json:"UpdatedReplicas"`
+	AvailableReplicas int `json:"AvailableReplicas"`
+}
+
+// DeploymentInfo represents k8s deployment information
+type DeploymentInfo struct {
+	Metadata Metadata         `json:"Metadata"`
+	Spec     DeploymentSpec   `json:"Spec"`
+	Status   DeploymentStatus `json:"Status"`
+}
+
+// ServiceInfo represents k8s service information
+type ServiceInfo struct {
+	Metadata Metadata `json:"Metadata"`
+	Spec     struct {
+		Selector map[string]string `json:"Selector"`
+	} `json:"Spec"`
+}
+
+// helper function to return label selector of the deployment
+func (d DeploymentInfo) selector() string {
+	var keys []string
+	for k := range d.Spec.Selector.MatchLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var out []string
+	for _, k := range keys {
+		out = append(out, fmt.Sprintf("%s=%s", k, d.Spec.Selector.MatchLabels[k]))
+	}
+	return strings.Join(out, ",")
+}
+
+// helper function to check if all replicas of the deployment are updated and ready
+func (d DeploymentInfo) ready() bool {
+	return d.Status.UpdatedReplicas >= d.Spec.Replicas && d.Status.ReadyReplicas >= d.Spec.Replicas
 }
 
 // helper function to execute command
@@ -91,6 +147,27 @@ func exe(command string, args ...string) ([]string, error) {
 	return out, nil
 }
 
+// runCommand executes given command and returns its output, it is defined as
+// a variable to allow substitution of external commands (kubectl, helm) in tests
+var runCommand = func(command string, args ...string) ([]byte, error) {
+	return runCommandIn("", command, args...)
+}
+
+// runCommandIn executes given command in given working directory and returns
+// its output, e.g. kustomize edit which works on kustomization of current directory
+var runCommandIn = func(dir, command string, args ...string) ([]byte, error) {
+	if Config.Verbose > 0 {
+		log.Println(command, args, dir)
+	}
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if e, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("%s %v: %v, %s", command, args, err, strings.TrimSpace(string(e.Stderr)))
+	}
+	return out, err
+}
+
 // helper function to get namespaces
 func namespaces() ([]string, error) {
 	args := []string{"get", "namespaces", "-A"}
@@ -126,6 +203,73 @@ func podInfo(pod, ns string) (PodInfo, error) {
 	return rec, err
 }
 
+// helper function to get deployment information
+func deploymentInfo(name, ns string) (DeploymentInfo, error) {
+	var rec DeploymentInfo
+	out, err := runCommand("kubectl", "get", "deployment", name, "-n", ns, "-o", "json")
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(out, &rec)
+	return rec, err
+}
+
+// helper function to get k8s service information
+func serviceInfo(name, ns string) (ServiceInfo, error) {
+	var rec ServiceInfo
+	out, err := runCommand("kubectl", "get", "service", name, "-n", ns, "-o", "json")
+	if err != nil {
+		return rec, err
+	}
+	err = json.Unmarshal(out, &rec)
+	return rec, err
+}
+
+// helper function to apply merge patch to given k8s object
+func patchObject(kind, name, ns string, patch interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = runCommand("kubectl", "patch", kind, name, "-n", ns, "--type", "merge", "-p", string(data))
+	return err
+}
+
+// helper function to scale deployment to given number of replicas
+func scaleDeployment(name, ns string, replicas int) error {
+	_, err := runCommand("kubectl", "scale", fmt.Sprintf("deployment/%s", name), "-n", ns, fmt.Sprintf("--replicas=%d", replicas))
+	return err
+}
+
+// helper function to get pods matching given label selector
+func selectPods(selector, ns string) ([]PodInfo, error) {
+	var rec PodList
+	out, err := runCommand("kubectl", "get", "pods", "-n", ns, "-l", selector, "-o", "json")
+	if err != nil {
+		return rec.Items, err
+	}
+	err = json.Unmarshal(out, &rec)
+	return rec.Items, err
+}
+
+// helper function to count container restarts of given pods
+func restartCount(pods []PodInfo) int {
+	var count int
+	for _, p := range pods {
+		for _, c := range p.Status.ContainerStatuses {
+			count += c.RestartCount
+		}
+	}
+	return count
+}
+
+// helper function to wait for rollout of the deployment
+func waitRollout(name, ns string, timeout int) error {
+	args := []string{"rollout", "status", fmt.Sprintf("deployment/%s", name), "-n", ns, fmt.Sprintf("--timeout=%ds", timeout)}
+	_, err := runCommand("kubectl", args...)
+	return err
+}
+
 // InList helper function to check item in a list
 func InList(a string, list []string) bool {
 	check := 0
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -11,3 +12,17 @@ func TestInList(t *testing.T) {
 		t.Errorf("Fail TestInList\n")
 	}
 }
+
+// helper function to substitute external commands with given handler,
+// it returns pointer to the list of executed commands
+func fakeCommands(t *testing.T, handler func(cmd string) ([]byte, error)) *[]string {
+	var calls []string
+	orig := runCommandIn
+	runCommandIn = func(dir, command string, args ...string) ([]byte, error) {
+		cmd := strings.Join(append([]string{command}, args...), " ")
+		calls = append(calls, cmd)
+		return handler(cmd)
+	}
+	t.Cleanup(func() { runCommandIn = orig })
+	return &calls
+}
@@ -0,0 +1,138 @@
+package main
+
+// kustomize module provides deployment of requests via image overrides of kustomize overlays
+//
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KustomizeTarget represents configuration of kustomize overlay of the service
+type KustomizeTarget struct {
+	Dir    string        `json:"dir"`    // overlay directory, local or within gitops repository
+	File   string        `json:"file"`   // kustomization file name, default kustomization.yaml
+	Name   string        `json:"name"`   // image name in kustomization images, default request image
+	GitOps *GitOpsTarget `json:"gitops"` // hand off the change via commit to git repository instead of applying it
+}
+
+// helper function to return kustomization file of the target
+func (k *KustomizeTarget) file() string {
+	name := k.File
+	if name == "" {
+		name = "kustomization.yaml"
+	}
+	return filepath.Join(k.Dir, name)
+}
+
+// helper function to return image name of the target
+func (k *KustomizeTarget) image(r Request) string {
+	if k.Name != "" {
+		return k.Name
+	}
+	return r.Image
+}
+
+// helper function to return indentation of given line
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// helper function to get image of the request rendered by kustomize overlay
+// in given directory, i.e. the image deployed before the overlay is updated
+func kustomizeImage(dir string, r Request) (string, error) {
+	out, err := runCommand("kustomize", "build", dir)
+	if err != nil {
+		return "", err
+	}
+	return currentImage(string(out), r), nil
+}
+
+// helper function to update image override in kustomization file content via
+// kustomize edit set image, tag and digest are set as newTag and digest fields
+// of the image entry (tags in form of sha256:... are set as digest only), so
+// the tag is never combined with digest. It returns new content of
+// kustomization file
+func setKustomizeImage(content, name, tag, digest string) (string, error) {
+	dir, err := ioutil.TempDir("", "kustomize")
+	if err != nil {
+		return content, err
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "kustomization.yaml")
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		return content, err
+	}
+	if _, err := runCommandIn(dir, "kustomize", "edit", "set", "image", imageRef(name, pinTag(tag, digest))); err != nil {
+		return content, err
+	}
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return content, err
+	}
+	return string(data), nil
+}
+
+// helper function to deploy request by updating image override of kustomize
+// overlay, the overlay is either applied to k8s or committed to git repository
+func kustomizeDeploy(r Request, k *KustomizeTarget, job *Job) error {
+	if k == nil || k.Dir == "" {
+		return errors.New("kustomize target requires overlay directory")
+	}
+	name := k.image(r)
+	tag, digest := tagDigest(r, job)
+	dir := k.Dir
+	if k.GitOps != nil {
+		dir = filepath.Join(k.GitOps.workdir(), k.Dir)
+	}
+	update := func(content string) (string, error) {
+		prev, err := kustomizeImage(dir, r)
+		if err != nil {
+			job.Logf("unable to render kustomize overlay %s, error %v", dir, err)
+		}
+		content, err = setKustomizeImage(content, name, tag, digest)
+		if err != nil {
+			return content, err
+		}
+		job.update(func(j *Job) {
+			if prev != "" {
+				j.PreviousImage = prev
+			}
+			j.NewImage = imageRef(r.Image, pinTag(tag, digest))
+		})
+		return content, nil
+	}
+	if k.GitOps != nil {
+		return k.GitOps.apply(r, job, k.file(), update)
+	}
+
+	// local overlay, it can be shared among services
+	unlock := lockDir(k.Dir)
+	defer unlock()
+	fname := k.file()
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	content, err := update(string(data))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		return err
+	}
+	out, err := runCommand("kubectl", "apply", "-k", k.Dir)
+	if err != nil {
+		// restore original overlay
+		if werr := ioutil.WriteFile(fname, data, 0644); werr != nil {
+			return fmt.Errorf("%v, unable to restore kustomization %s, error %v", err, fname, werr)
+		}
+		return err
+	}
+	job.Logf("applied kustomize overlay %s with image %s, output %s", k.Dir, imageRef(name, r.Tag), string(out))
+	return nil
+}
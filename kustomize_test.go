@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// helper function to substitute kustomize edit set image command, the fake
+// command sets newTag and digest of the image entry in kustomization of
+// working directory like kustomize does for name:tag@digest argument, while
+// fake kustomize build renders image of the overlay kustomization
+func fakeKustomize(t *testing.T) *[]string {
+	var calls []string
+	orig := runCommandIn
+	runCommandIn = func(dir, command string, args ...string) ([]byte, error) {
+		cmd := strings.Join(append([]string{command}, args...), " ")
+		calls = append(calls, cmd)
+		if strings.HasPrefix(cmd, "kustomize build ") {
+			data, err := ioutil.ReadFile(filepath.Join(args[len(args)-1], "kustomization.yaml"))
+			if err != nil {
+				return nil, err
+			}
+			tag := regexp.MustCompile(`newTag: "?([^"\n]*)`).FindStringSubmatch(string(data))
+			digest := regexp.MustCompile(`digest: (\S+)`).FindStringSubmatch(string(data))
+			switch {
+			case tag != nil && digest != nil:
+				return []byte(fmt.Sprintf("spec:\n  containers:\n  - image: repo/srv:%s@%s\n", tag[1], digest[1])), nil
+			case tag != nil:
+				return []byte(fmt.Sprintf("spec:\n  containers:\n  - image: repo/srv:%s\n", tag[1])), nil
+			}
+			return nil, errors.New("no image")
+		}
+		if !strings.HasPrefix(cmd, "kustomize edit set image ") {
+			if strings.HasPrefix(cmd, "kubectl apply -k") {
+				return []byte("deployment.apps/srv configured"), nil
+			}
+			return nil, errors.New("unexpected command")
+		}
+		fname := filepath.Join(dir, "kustomization.yaml")
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		ref, digest := args[len(args)-1], ""
+		if arr := strings.SplitN(ref, "@", 2); len(arr) == 2 {
+			ref, digest = arr[0], arr[1]
+		}
+		var tag string
+		if arr := strings.SplitN(ref, ":", 2); len(arr) == 2 {
+			tag = arr[1]
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			field := strings.TrimSpace(line)
+			if strings.HasPrefix(field, "newTag:") || strings.HasPrefix(field, "digest:") {
+				continue
+			}
+			lines = append(lines, line)
+			if strings.HasSuffix(field, "name: repo/srv") {
+				pad := strings.Repeat(" ", indent(line)+2)
+				if tag != "" {
+					lines = append(lines, fmt.Sprintf("%snewTag: %q", pad, tag))
+				}
+				if digest != "" {
+					lines = append(lines, fmt.Sprintf("%sdigest: %s", pad, digest))
+				}
+			}
+		}
+		return nil, ioutil.WriteFile(fname, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	}
+	t.Cleanup(func() { runCommandIn = orig })
+	return &calls
+}
+
+// TestKustomizeDeploy
+func TestKustomizeDeploy(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "kustomization.yaml")
+	ioutil.WriteFile(fname, []byte("images:\n  - name: repo/srv\n    newTag: \"0.1\"\n"), 0644)
+	calls := fakeKustomize(t)
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	job := newJob(r)
+	if err := kustomizeDeploy(r, &KustomizeTarget{Dir: dir}, job); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(fname)
+	if string(data) != "images:\n  - name: repo/srv\n    newTag: \"0.2\"\n" {
+		t.Errorf("Fail TestKustomizeDeploy, wrong kustomization\n%s\n", string(data))
+	}
+	if len(*calls) != 3 || (*calls)[1] != "kustomize edit set image repo/srv:0.2" || job.PreviousImage != "repo/srv:0.1" {
+		t.Errorf("Fail TestKustomizeDeploy, calls %v previous image %s\n", *calls, job.PreviousImage)
+	}
+
+	// image verified by request checks is pinned to its digest
+	job = newJob(r)
+	job.Digest = "sha256:abc"
+	if err := kustomizeDeploy(r, &KustomizeTarget{Dir: dir}, job); err != nil {
+		t.Fatal(err)
+	}
+	if (*calls)[4] != "kustomize edit set image repo/srv:0.2@sha256:abc" || job.NewImage != "repo/srv:0.2@sha256:abc" {
+		t.Errorf("Fail TestKustomizeDeploy, calls %v new image %s\n", *calls, job.NewImage)
+	}
+	// tag and digest are kept in separate fields of image entry
+	data, _ = ioutil.ReadFile(fname)
+	if string(data) != "images:\n  - name: repo/srv\n    newTag: \"0.2\"\n    digest: sha256:abc\n" {
+		t.Errorf("Fail TestKustomizeDeploy, wrong pinned kustomization\n%s\n", string(data))
+	}
+
+	// pinned image of rollback is split into tag and digest
+	r.Tag = "0.1@sha256:old"
+	job = newJob(r)
+	if err := kustomizeDeploy(r, &KustomizeTarget{Dir: dir}, job); err != nil {
+		t.Fatal(err)
+	}
+	if (*calls)[7] != "kustomize edit set image repo/srv:0.1@sha256:old" || job.PreviousImage != "repo/srv:0.2@sha256:abc" {
+		t.Errorf("Fail TestKustomizeDeploy, calls %v previous image %s\n", *calls, job.PreviousImage)
+	}
+}
+
+// TestKustomizeGitOps
+func TestKustomizeGitOps(t *testing.T) {
+	bare := testBareRepo(t, map[string]string{"overlays/prod/kustomization.yaml": "images:\n- name: repo/srv\n  newTag: \"0.1\"\n"})
+	g := &GitOpsTarget{Repository: bare, Workdir: filepath.Join(t.TempDir(), "clone")}
+	k := &KustomizeTarget{Dir: "overlays/prod", GitOps: g}
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv", Commit: "abc"}
+	fakeKustomize(t)
+	if err := kustomizeDeploy(r, k, nil); err != nil {
+		t.Fatal(err)
+	}
+	out, err := git(bare, "show", "main:overlays/prod/kustomization.yaml")
+	if err != nil || !strings.Contains(out, "newTag: \"0.2\"") {
+		t.Errorf("Fail TestKustomizeGitOps, overlay is not updated %s %v\n", out, err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+// labels module checks OCI labels of service images against the request
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// LabelPolicy represents OCI labels policy of the service images
+type LabelPolicy struct {
+	Required bool `json:"required"` // refuse images without revision and source labels
+}
+
+// OCI labels describing source of the image
+const (
+	revisionLabel = "org.opencontainers.image.revision"
+	sourceLabel   = "org.opencontainers.image.source"
+)
+
+// min length of abbreviated commit accepted in revision label
+const minRevisionLength = 7
+
+// helper function to fetch image manifest of given reference
+func imageManifest(c *RegistryClient, name, ref string) (OCIManifest, error) {
+	var m OCIManifest
+	_, data, err := c.Manifest(name, ref)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+// helper function to fetch labels of image config of given manifest, labels
+// of every platform image are returned for image index, nested image indexes
+// are refused
+func imageLabels(c *RegistryClient, name, ref string) ([]map[string]string, error) {
+	m, err := imageManifest(c, name, ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) == 0 {
+		labels, err := configLabels(c, name, m)
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]string{labels}, nil
+	}
+	var out []map[string]string
+	for _, desc := range m.Manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			// attestation manifests of buildkit
+			continue
+		}
+		pm, err := imageManifest(c, name, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if len(pm.Manifests) > 0 {
+			return nil, fmt.Errorf("nested image index %s is not supported", desc.Digest)
+		}
+		labels, err := configLabels(c, name, pm)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, labels)
+	}
+	return out, nil
+}
+
+// helper function to fetch labels of image config of given image manifest
+func configLabels(c *RegistryClient, name string, m OCIManifest) (map[string]string, error) {
+	blob, err := layerBlob(c, name, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(blob, &config); err != nil {
+		return nil, fmt.Errorf("invalid image config %s", m.Config.Digest)
+	}
+	return config.Config.Labels, nil
+}
+
+// helper function to check if revision label matches the commit, abbreviated
+// commits are accepted
+func revisionMatches(revision, commit string) bool {
+	if revision == commit {
+		return true
+	}
+	return len(revision) >= minRevisionLength && strings.HasPrefix(commit, revision)
+}
+
+// helper function to check OCI labels of requested image according to service
+// policy, digest of the image is used unless it is empty
+func checkLabels(r Request, policy ServicePolicy, digest string) error {
+	lp := policy.Labels
+	if lp == nil {
+		return nil
+	}
+	host, err := sourceHost(r, policy)
+	if err != nil {
+		return err
+	}
+	c, name := imageRegistry(r.Image)
+	ref := digest
+	if ref == "" {
+		ref = r.Tag
+	}
+	images, err := imageLabels(c, name, ref)
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return errors.New("image has no platform images")
+	}
+	for _, labels := range images {
+		revision, source := labels[revisionLabel], labels[sourceLabel]
+		if revision == "" || source == "" {
+			if lp.Required {
+				return fmt.Errorf("image %s has no %s and %s labels", imageRef(r.Image, r.Tag), revisionLabel, sourceLabel)
+			}
+		}
+		if revision != "" && !revisionMatches(revision, r.Commit) {
+			return fmt.Errorf("image %s is built from commit %s, request commit %s", imageRef(r.Image, r.Tag), revision, r.Commit)
+		}
+		if source != "" && !sourceMatches(source, host, r.Repository) {
+			return fmt.Errorf("image %s is built from %s, request repository %s", imageRef(r.Image, r.Tag), source, r.Repository)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestCheckLabels
+func TestCheckLabels(t *testing.T) {
+	reg := fakeRegistry(t)
+	commit := "1130ebd31beeb1a0a4b50e908896e918f2b9be7d"
+	image := func(tag, revision, source string) string {
+		config := fmt.Sprintf(`{"config": {"Labels": {"org.opencontainers.image.revision": "%s", "org.opencontainers.image.source": "%s"}}}`, revision, source)
+		desc := reg.blob("application/vnd.oci.image.config.v1+json", []byte(config))
+		return reg.manifest("org/srv", []string{tag}, OCIManifest{Config: desc})
+	}
+	image("0.1", commit, "https://github.com/org/srv")
+	image("0.2", commit[:7], "https://github.com/Org/srv.git")
+	image("0.3", "deadbeef", "https://github.com/org/srv")
+	image("0.4", commit, "https://github.com/org/other")
+	image("0.5", "", "")
+	amd64 := image("amd64", commit, "https://github.com/org/srv")
+	arm64 := image("arm64", "deadbeef", "https://github.com/org/srv")
+	index := reg.manifest("org/srv", []string{"0.6"}, OCIManifest{
+		MediaType: "application/vnd.oci.image.index.v1+json",
+		Manifests: []OCIDescriptor{
+			{Digest: amd64, Platform: &OCIPlatform{OS: "linux", Architecture: "amd64"}},
+			{Digest: arm64, Platform: &OCIPlatform{OS: "linux", Architecture: "arm64"}},
+		},
+	})
+	image("0.7", commit, "https://evil.example/org/srv")
+
+	// registry serves different manifest under digest of platform image
+	tampered := image("tampered", commit, "git+https://github.com/org/srv")
+	reg.manifests["org/srv:"+tampered] = reg.manifests["org/srv:0.4"]
+	reg.manifest("org/srv", []string{"0.8"}, OCIManifest{
+		MediaType: "application/vnd.oci.image.index.v1+json",
+		Manifests: []OCIDescriptor{{Digest: tampered, Platform: &OCIPlatform{OS: "linux", Architecture: "amd64"}}},
+	})
+	reg.manifest("org/srv", []string{"0.9"}, OCIManifest{
+		MediaType: "application/vnd.oci.image.index.v1+json",
+		Manifests: []OCIDescriptor{{Digest: index, Platform: &OCIPlatform{OS: "linux", Architecture: "amd64"}}},
+	})
+
+	tests := map[string]string{
+		"0.1": "",
+		"0.2": "",
+		"0.3": "is built from commit deadbeef",
+		"0.4": "is built from https://github.com/org/other",
+		"0.5": "has no",
+		"0.6": "is built from commit deadbeef",
+		"0.7": "is built from https://evil.example/org/srv",
+		"0.8": "digest mismatch",
+		"0.9": "nested image index",
+	}
+	policy := ServicePolicy{Service: "srv", Labels: &LabelPolicy{Required: true}}
+	for tag, msg := range tests {
+		r := Request{Service: "srv", Image: reg.host + "/org/srv", Tag: tag, Repository: "org/srv", Commit: commit}
+		err := checkLabels(r, policy, "")
+		if msg == "" && err != nil {
+			t.Errorf("Fail TestCheckLabels, tag %s, error %v\n", tag, err)
+		}
+		if msg != "" && (err == nil || !strings.Contains(err.Error(), msg)) {
+			t.Errorf("Fail TestCheckLabels, tag %s, wrong error %v\n", tag, err)
+		}
+	}
+	policy.Labels.Required = false
+	r := Request{Service: "srv", Image: reg.host + "/org/srv", Tag: "0.5", Repository: "org/srv", Commit: commit}
+	if err := checkLabels(r, policy, ""); err != nil {
+		t.Errorf("Fail TestCheckLabels, image without labels is refused, error %v\n", err)
+	}
+}
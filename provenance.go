@@ -0,0 +1,205 @@
+package main
+
+// provenance module provides provenance annotations of workloads patched by imagebot
+//
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// annotations of k8s workloads describing provenance of deployed image
+const (
+	repositoryAnnotation  = "imagebot.io/source-repository"
+	commitAnnotation      = "imagebot.io/source-commit"
+	tagAnnotation         = "imagebot.io/tag"
+	digestAnnotation      = "imagebot.io/digest"
+	jobAnnotation         = "imagebot.io/job-id"
+	deployedAnnotation    = "imagebot.io/deployed-at"
+	changeCauseAnnotation = "kubernetes.io/change-cause"
+)
+
+// Provenance represents provenance of the image deployed to k8s workload
+type Provenance struct {
+	Repository  string `json:"repository"`   // source repository
+	Commit      string `json:"commit"`       // source commit
+	Tag         string `json:"tag"`          // image tag
+	Digest      string `json:"digest"`       // image digest
+	JobID       string `json:"job_id"`       // imagebot job id
+	DeployedAt  int64  `json:"deployed_at"`  // deployment timestamp
+	ChangeCause string `json:"change_cause"` // k8s change cause
+}
+
+// helper function to create provenance of given request and job
+func newProvenance(r Request, job *Job) Provenance {
+	p := Provenance{
+		Repository: r.Repository,
+		Commit:     r.Commit,
+		Tag:        r.Tag,
+		DeployedAt: time.Now().Unix(),
+	}
+	job.update(func(j *Job) {
+		p.JobID = j.ID
+		p.Digest = j.Digest
+	})
+	p.ChangeCause = fmt.Sprintf("imagebot: %s from %s@%s", imageRef(r.Image, r.Tag), r.Repository, r.Commit)
+	if p.JobID != "" {
+		p.ChangeCause += fmt.Sprintf(" (job %s)", p.JobID)
+	}
+	return p
+}
+
+// helper function to return provenance as map of annotations
+func (p Provenance) annotations() map[string]string {
+	rec := map[string]string{
+		repositoryAnnotation:  p.Repository,
+		commitAnnotation:      p.Commit,
+		tagAnnotation:         p.Tag,
+		deployedAnnotation:    fmt.Sprintf("%d", p.DeployedAt),
+		changeCauseAnnotation: p.ChangeCause,
+	}
+	if p.Digest != "" {
+		rec[digestAnnotation] = p.Digest
+	}
+	if p.JobID != "" {
+		rec[jobAnnotation] = p.JobID
+	}
+	return rec
+}
+
+// helper function to create provenance from map of annotations
+func provenanceFromAnnotations(rec map[string]string) Provenance {
+	p := Provenance{
+		Repository:  rec[repositoryAnnotation],
+		Commit:      rec[commitAnnotation],
+		Tag:         rec[tagAnnotation],
+		Digest:      rec[digestAnnotation],
+		JobID:       rec[jobAnnotation],
+		ChangeCause: rec[changeCauseAnnotation],
+	}
+	p.DeployedAt, _ = strconv.ParseInt(rec[deployedAnnotation], 10, 64)
+	return p
+}
+
+// helper function to find provenance of previously deployed image in deployment
+// history, image without history record gets provenance of its tag only
+func previousProvenance(r Request, prev string) Provenance {
+	p := Provenance{Tag: imageTag(prev, r.Image), DeployedAt: time.Now().Unix()}
+	if arr := strings.SplitN(p.Tag, "@", 2); len(arr) == 2 && arr[0] != "" {
+		p.Tag, p.Digest = arr[0], arr[1]
+	}
+	if deployHistory != nil {
+		recs, _ := deployHistory.Query(HistoryFilter{Service: r.Service, Namespace: r.Namespace, Outcome: JobSucceeded})
+		for _, rec := range recs {
+			if rec.NewImage == prev && rec.Action == "" {
+				p.Repository = rec.Request.Repository
+				p.Commit = rec.Request.Commit
+				if rec.Digest != "" {
+					p.Digest = rec.Digest
+				}
+				p.JobID = rec.ID
+				break
+			}
+		}
+	}
+	p.ChangeCause = fmt.Sprintf("imagebot: restore %s", prev)
+	if p.Repository != "" {
+		p.ChangeCause += fmt.Sprintf(" from %s@%s", p.Repository, p.Commit)
+	}
+	return p
+}
+
+// helper function to set provenance annotations in metadata of deployment yaml
+// manifest, so they are applied together with the image, stale provenance
+// annotations of the manifest are removed
+func setProvenance(yaml string, p Provenance) string {
+	rec := p.annotations()
+	var keys []string
+	for k := range rec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var entries []string
+	for _, k := range keys {
+		entries = append(entries, fmt.Sprintf("    %s: %s", k, strconv.Quote(rec[k])))
+	}
+	stale := func(line string) bool {
+		key := strings.Trim(strings.SplitN(strings.TrimSpace(line), ":", 2)[0], `"'`)
+		for _, k := range []string{repositoryAnnotation, commitAnnotation, tagAnnotation, digestAnnotation, jobAnnotation, deployedAnnotation, changeCauseAnnotation} {
+			if key == k {
+				return true
+			}
+		}
+		return false
+	}
+	lines := strings.Split(yaml, "\n")
+	meta := -1
+	for i, line := range lines {
+		if line == "metadata:" {
+			meta = i
+			break
+		}
+	}
+	if meta < 0 {
+		head := append([]string{"metadata:", "  annotations:"}, entries...)
+		return strings.Join(append(head, lines...), "\n")
+	}
+	out := append([]string{}, lines[:meta+1]...)
+	found, inAnnotations := false, false
+	i := meta + 1
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if line != "" && indent(line) == 0 {
+			break
+		}
+		if line == "  annotations:" {
+			out = append(out, line)
+			out = append(out, entries...)
+			found, inAnnotations = true, true
+			continue
+		}
+		if line != "" && indent(line) <= 2 {
+			inAnnotations = false
+		}
+		if inAnnotations && indent(line) == 4 && stale(line) {
+			continue
+		}
+		out = append(out, line)
+	}
+	if !found {
+		head := append([]string{}, out[:meta+1]...)
+		head = append(head, "  annotations:")
+		head = append(head, entries...)
+		out = append(head, out[meta+1:]...)
+	}
+	out = append(out, lines[i:]...)
+	return strings.Join(out, "\n")
+}
+
+// helper function to read provenance of given deployment
+func workloadProvenance(name, ns string) (Provenance, error) {
+	info, err := deploymentInfo(name, ns)
+	if err != nil {
+		return Provenance{}, err
+	}
+	return provenanceFromAnnotations(info.Metadata.Annotations), nil
+}
+
+// helper function to check if deployment drifted from the image recorded
+// in its provenance, e.g. it was changed outside of imagebot
+func checkDrift(name string, r Request, current string, job *Job) {
+	p, err := workloadProvenance(name, r.Namespace)
+	if err != nil || p.Tag == "" || current == "" {
+		return
+	}
+	expect := imageRef(r.Image, p.Tag)
+	if p.Digest != "" && !strings.HasPrefix(p.Tag, "sha256:") && current == imageRef(r.Image, p.Tag+"@"+p.Digest) {
+		return
+	}
+	if expect != current {
+		job.Logf("drift detected for deployment %s/%s: image %s, imagebot deployed %s by job %s", r.Namespace, name, current, expect, p.JobID)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestSetProvenance
+func TestSetProvenance(t *testing.T) {
+	yaml := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    deployment.kubernetes.io/revision: "3"
+    imagebot.io/digest: sha256:old
+    imagebot.io/tag: "0.1"
+  name: srv
+spec:
+  template:
+    metadata:
+      annotations:
+        imagebot.io/tag: keep
+    spec:
+      containers:
+      - image: repo/srv:0.2
+`
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv", Repository: "org/srv", Commit: "abc"}
+	job := newJob(r)
+	out := setProvenance(yaml, newProvenance(r, job))
+	arr := strings.SplitN(out, "\n  name: srv", 2)
+	if len(arr) != 2 || !strings.Contains(arr[1], "imagebot.io/tag: keep") {
+		t.Fatalf("Fail TestSetProvenance, wrong manifest\n%s\n", out)
+	}
+	annotations := map[string]string{}
+	for _, line := range strings.Split(arr[0], "\n")[4:] {
+		kv := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if v, err := strconv.Unquote(kv[1]); err == nil {
+			kv[1] = v
+		}
+		annotations[kv[0]] = kv[1]
+	}
+	p := provenanceFromAnnotations(annotations)
+	if p.Repository != "org/srv" || p.Commit != "abc" || p.Tag != "0.2" || p.JobID != job.ID || p.DeployedAt == 0 || p.Digest != "" {
+		t.Errorf("Fail TestSetProvenance, wrong provenance %+v\n", p)
+	}
+	if !strings.Contains(p.ChangeCause, "repo/srv:0.2") || annotations["deployment.kubernetes.io/revision"] != "3" {
+		t.Errorf("Fail TestSetProvenance, wrong annotations %+v\n", annotations)
+	}
+
+	// manifest without metadata annotations
+	out = setProvenance("metadata:\n  name: srv\nspec: {}\n", newProvenance(r, job))
+	if !strings.HasPrefix(out, "metadata:\n  annotations:\n    imagebot.io/") || !strings.Contains(out, "\n  name: srv\nspec: {}\n") {
+		t.Errorf("Fail TestSetProvenance, wrong manifest\n%s\n", out)
+	}
+}
+
+// TestPreviousProvenance
+func TestPreviousProvenance(t *testing.T) {
+	history := deployHistory
+	defer func() { deployHistory = history }()
+	deployHistory, _ = newHistoryStore("")
+	old := Request{Service: "srv", Namespace: "test", Tag: "0.1", Image: "repo/srv", Repository: "org/srv", Commit: "old"}
+	deployHistory.Add(DeployRecord{ID: "job1", Request: old, NewImage: "repo/srv:0.1", Digest: "sha256:aaa", Outcome: JobSucceeded})
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv", Repository: "org/srv", Commit: "new"}
+	deployHistory.Add(DeployRecord{ID: "job2", Request: r, NewImage: "repo/srv:0.2", Outcome: JobRolledBack})
+
+	p := previousProvenance(r, "repo/srv:0.1")
+	if p.Commit != "old" || p.Tag != "0.1" || p.Digest != "sha256:aaa" || p.JobID != "job1" {
+		t.Errorf("Fail TestPreviousProvenance, wrong provenance %+v\n", p)
+	}
+	p = previousProvenance(r, "repo/srv:0.0")
+	if p.Commit != "" || p.Repository != "" || p.Tag != "0.0" {
+		t.Errorf("Fail TestPreviousProvenance, unknown image should not get request provenance %+v\n", p)
+	}
+}
+
+// TestRestoreDeployment
+func TestRestoreDeployment(t *testing.T) {
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		if strings.HasPrefix(cmd, "kubectl get deployment srv -n test -o json") {
+			rec := fmt.Sprintf(`{"metadata": {"annotations": {"%s": "other-job", "%s": "0.3"}}}`, jobAnnotation, tagAnnotation)
+			return []byte(rec), nil
+		}
+		if strings.HasPrefix(cmd, "kubectl get deployment srv") {
+			return []byte("image: repo/srv:0.3\n"), nil
+		}
+		return []byte("ok"), nil
+	})
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.3", Image: "repo/srv"}
+	job := newJob(r)
+	if err := restoreDeployment("srv", r, "repo/srv:0.2", job); err == nil {
+		t.Error("Fail TestRestoreDeployment, changes of other job should not be reverted")
+	}
+	job.ID = "other-job"
+	if err := restoreDeployment("srv", r, "repo/srv:0.2", job); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.Join(*calls, "\n"), "/srv-test-0.2-") {
+		t.Errorf("Fail TestRestoreDeployment, previous image is not redeployed %v\n", *calls)
+	}
+	for _, c := range *calls {
+		if strings.Contains(c, "rollout undo") {
+			t.Errorf("Fail TestRestoreDeployment, unexpected rollout undo %s\n", c)
+		}
+	}
+}
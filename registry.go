@@ -0,0 +1,542 @@
+package main
+
+// registry module provides docker registry v2 API client which supports
+// multiple registries with bearer token and basic authentication challenges
+//
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RegistryConfig represents configuration of docker registry
+type RegistryConfig struct {
+	Host     string `json:"host"`     // registry host as used in image names, e.g. ghcr.io
+	URL      string `json:"url"`      // registry URL, default https://<host> or https://registry-1.docker.io
+	AuthURL  string `json:"authUrl"`  // token service URL, by default it is taken from registry challenge
+	Service  string `json:"service"`  // token service name, by default it is taken from registry challenge
+	Username string `json:"username"` // registry user name
+	Password string `json:"password"` // registry password or access token
+	Insecure bool   `json:"insecure"` // skip verification of registry TLS certificate
+	Timeout  int    `json:"timeout"`  // HTTP timeout in seconds, default 30
+	Check    bool   `json:"check"`    // check that requested image exists in the registry
+}
+
+// RegistryClient represents docker registry v2 API client
+type RegistryClient struct {
+	config RegistryConfig
+	client *http.Client
+	mu     sync.Mutex
+	tokens map[string]registryToken // bearer tokens per scope
+	basic  bool                     // registry requested basic authentication
+}
+
+// registryToken represents bearer token of the registry
+type registryToken struct {
+	token  string
+	expire time.Time
+}
+
+// default Docker Hub registry endpoints
+const (
+	dockerHubHost     = "docker.io"
+	dockerHubRegistry = "https://registry-1.docker.io"
+	dockerHubAuth     = "https://auth.docker.io/token"
+	dockerHubService  = "registry.docker.io"
+)
+
+// media types of image manifests accepted from the registry
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// OCIManifest represents image manifest of the registry
+type OCIManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Config      OCIDescriptor     `json:"config"`
+	Layers      []OCIDescriptor   `json:"layers"`
+	Subject     *OCIDescriptor    `json:"subject,omitempty"`
+	Manifests   []OCIDescriptor   `json:"manifests,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// OCIDescriptor represents content descriptor of OCI manifest
+type OCIDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Platform     *OCIPlatform      `json:"platform,omitempty"`
+}
+
+// OCIPlatform represents platform of the image in image index
+type OCIPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+}
+
+// errImageNotFound is returned when image manifest does not exist in the registry
+var errImageNotFound = errors.New("image not found in registry")
+
+// errRegistryAuth is returned when registry refuses credentials of imagebot
+var errRegistryAuth = errors.New("registry authentication failed")
+
+// registries keeps registry configurations and clients of imagebot
+var registries = struct {
+	sync.Mutex
+	defaults RegistryConfig            // registry of images without registry host
+	configs  map[string]RegistryConfig // registry configurations per host
+	auths    map[string]RegistryConfig // credentials from docker config per host
+	clients  map[string]*RegistryClient
+}{
+	configs: make(map[string]RegistryConfig),
+	auths:   make(map[string]RegistryConfig),
+	clients: make(map[string]*RegistryClient),
+}
+
+// helper function to setup registries from imagebot configuration and
+// docker config file, by default ~/.docker/config.json is used if it exists
+func setupRegistries(defaults RegistryConfig, configs []RegistryConfig, dockerConfig string) error {
+	auths := make(map[string]RegistryConfig)
+	fname := dockerConfig
+	if fname == "" {
+		fname = defaultDockerConfig()
+	}
+	if fname != "" {
+		var err error
+		auths, err = readDockerConfig(fname)
+		if err != nil && (dockerConfig != "" || !os.IsNotExist(err)) {
+			return err
+		}
+	}
+	registries.Lock()
+	defer registries.Unlock()
+	registries.defaults = defaults
+	registries.configs = make(map[string]RegistryConfig)
+	for _, c := range configs {
+		if c.Host == "" {
+			return fmt.Errorf("registry %s has no host", c.URL)
+		}
+		registries.configs[normalizeRegistryHost(c.Host)] = c
+	}
+	registries.auths = auths
+	registries.clients = make(map[string]*RegistryClient)
+	return nil
+}
+
+// helper function to return path of default docker config file
+func defaultDockerConfig() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".docker", "config.json")
+	}
+	return ""
+}
+
+// helper function to read registry credentials from docker config.json or
+// from Kubernetes secret of kubernetes.io/dockerconfigjson type
+func readDockerConfig(fname string) (map[string]RegistryConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var rec struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+		Data map[string]string `json:"data"` // data of Kubernetes secret
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("unable to parse docker config %s, error %v", fname, err)
+	}
+	if rec.Auths == nil && rec.Data[".dockerconfigjson"] != "" {
+		data, err = base64.StdEncoding.DecodeString(rec.Data[".dockerconfigjson"])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("unable to parse docker config of secret %s, error %v", fname, err)
+		}
+	}
+	auths := make(map[string]RegistryConfig)
+	for host, a := range rec.Auths {
+		c := RegistryConfig{Username: a.Username, Password: a.Password}
+		if a.Auth != "" {
+			val, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth of %s in docker config %s", host, fname)
+			}
+			arr := strings.SplitN(string(val), ":", 2)
+			if len(arr) == 2 {
+				c.Username, c.Password = arr[0], arr[1]
+			}
+		}
+		auths[normalizeRegistryHost(host)] = c
+	}
+	return auths, nil
+}
+
+// helper function to normalize registry host, e.g. https://index.docker.io/v1/
+// key of docker config becomes docker.io
+func normalizeRegistryHost(host string) string {
+	host = strings.TrimPrefix(host, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHubHost
+	}
+	return host
+}
+
+// helper function to split image name into registry host and repository
+// name, the host is empty for images without registry host
+func parseImage(image string) (string, string) {
+	arr := strings.SplitN(image, "/", 2)
+	if len(arr) == 2 && (strings.ContainsAny(arr[0], ".:") || arr[0] == "localhost") {
+		return normalizeRegistryHost(arr[0]), arr[1]
+	}
+	return "", image
+}
+
+// helper function to return registry client and repository name of the image
+func imageRegistry(image string) (*RegistryClient, string) {
+	key, name := parseImage(image)
+	registries.Lock()
+	defer registries.Unlock()
+	if c, ok := registries.clients[key]; ok {
+		return c, c.repository(name)
+	}
+	host := key
+	var config RegistryConfig
+	if host == "" {
+		config = registries.defaults
+		if config.URL == "" {
+			host = dockerHubHost
+		} else {
+			host = normalizeRegistryHost(config.URL)
+		}
+	}
+	if c, ok := registries.configs[host]; ok {
+		config = c
+	}
+	if config.URL == "" {
+		config.URL = "https://" + host
+	}
+	if config.Username == "" {
+		if a, ok := registries.auths[host]; ok {
+			config.Username, config.Password = a.Username, a.Password
+		}
+	}
+	c := newRegistryClient(config)
+	registries.clients[key] = c
+	return c, c.repository(name)
+}
+
+// helper function to create registry client with given configuration
+func newRegistryClient(config RegistryConfig) *RegistryClient {
+	if config.URL == "" || normalizeRegistryHost(config.URL) == dockerHubHost {
+		config.URL = dockerHubRegistry
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.URL == dockerHubRegistry {
+		if config.AuthURL == "" {
+			config.AuthURL = dockerHubAuth
+		}
+		if config.Service == "" {
+			config.Service = dockerHubService
+		}
+	}
+	timeout := 30 * time.Second
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	if config.Insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return &RegistryClient{config: config, client: client, tokens: make(map[string]registryToken)}
+}
+
+// helper function to return repository name of the image in the registry,
+// e.g. httpgo becomes library/httpgo on Docker Hub
+func (c *RegistryClient) repository(name string) string {
+	if c.config.URL == dockerHubRegistry && !strings.Contains(name, "/") {
+		return "library/" + name
+	}
+	return name
+}
+
+// pattern of authentication challenge parameters
+var challengePattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// helper function to parse WWW-Authenticate challenge of the registry
+func parseChallenge(header string) (string, map[string]string) {
+	arr := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	params := make(map[string]string)
+	if len(arr) == 2 {
+		for _, m := range challengePattern.FindAllStringSubmatch(arr[1], -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	return strings.ToLower(arr[0]), params
+}
+
+// helper function to obtain bearer token for given scope from the token service
+func (c *RegistryClient) bearerToken(realm, service, scope string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[scope]; ok && time.Now().Before(t.expire) {
+		return t.token, nil
+	}
+	query := url.Values{"scope": []string{scope}}
+	if service != "" {
+		query.Set("service", service)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s?%s", realm, query.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.config.Username != "" {
+		req.SetBasicAuth(c.config.Username, c.config.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%w: token service %s responded with %s", errRegistryAuth, realm, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token service responded with %s", resp.Status)
+	}
+	var rec struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return "", err
+	}
+	if rec.Token == "" {
+		rec.Token = rec.AccessToken
+	}
+	if rec.ExpiresIn == 0 {
+		rec.ExpiresIn = 60
+	}
+	expire := time.Now().Add(time.Duration(rec.ExpiresIn)*time.Second - 10*time.Second)
+	c.tokens[scope] = registryToken{token: rec.Token, expire: expire}
+	return rec.Token, nil
+}
+
+// helper function to return cached bearer token of given scope
+func (c *RegistryClient) cachedToken(scope string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.tokens[scope]; ok && time.Now().Before(t.expire) {
+		return t.token
+	}
+	return ""
+}
+
+// helper function to perform registry API request of given repository, the
+// request is repeated with credentials requested by registry challenge
+func (c *RegistryClient) do(method, name, path string, accept []string) (*http.Response, error) {
+	scope := fmt.Sprintf("repository:%s:pull", name)
+	rurl := fmt.Sprintf("%s/v2/%s/%s", c.config.URL, name, path)
+	send := func(auth func(req *http.Request)) (*http.Response, error) {
+		req, err := http.NewRequest(method, rurl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		auth(req)
+		return c.client.Do(req)
+	}
+	basic := func(req *http.Request) {
+		if c.config.Username != "" {
+			req.SetBasicAuth(c.config.Username, c.config.Password)
+		}
+	}
+	bearer := func(token string) func(req *http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	// use known credentials first
+	token := c.cachedToken(scope)
+	if token == "" && c.config.AuthURL != "" {
+		var err error
+		if token, err = c.bearerToken(c.config.AuthURL, c.config.Service, scope); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	useBasic := c.basic
+	c.mu.Unlock()
+	var resp *http.Response
+	var err error
+	switch {
+	case token != "":
+		resp, err = send(bearer(token))
+	case useBasic:
+		resp, err = send(basic)
+	default:
+		resp, err = send(func(req *http.Request) {})
+	}
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	// answer authentication challenge of the registry
+	scheme, params := parseChallenge(resp.Header.Get("Www-Authenticate"))
+	switch scheme {
+	case "bearer":
+		resp.Body.Close()
+		realm, service := params["realm"], params["service"]
+		if c.config.AuthURL != "" {
+			realm, service = c.config.AuthURL, c.config.Service
+		}
+		if realm == "" {
+			return nil, fmt.Errorf("registry %s challenge has no realm", c.config.URL)
+		}
+		c.mu.Lock()
+		delete(c.tokens, scope)
+		c.mu.Unlock()
+		token, err := c.bearerToken(realm, service, scope)
+		if err != nil {
+			return nil, err
+		}
+		return send(bearer(token))
+	case "basic":
+		if c.config.Username == "" || useBasic {
+			return resp, nil
+		}
+		resp.Body.Close()
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return send(basic)
+	}
+	return resp, nil
+}
+
+// helper function to check response of registry API request
+func (c *RegistryClient) check(resp *http.Response, name, ref string) error {
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %s:%s", errImageNotFound, name, ref)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// Docker Hub also responds with 401 for non-existing repositories,
+		// but it can not be told apart from missing or wrong credentials
+		return fmt.Errorf("%w: %s responded with %s for %s:%s, check registry credentials and image name", errRegistryAuth, c.config.URL, resp.Status, name, ref)
+	}
+	return fmt.Errorf("registry %s responded with %s for %s:%s", c.config.URL, resp.Status, name, ref)
+}
+
+// ManifestDigest returns digest of image manifest of given repository and
+// reference, errImageNotFound is returned if image does not exist in the registry.
+// If registry does not report digest the manifest is fetched and hashed
+func (c *RegistryClient) ManifestDigest(name, ref string) (string, error) {
+	resp, err := c.do("HEAD", name, "manifests/"+ref, manifestTypes)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if err := c.check(resp, name, ref); err != nil {
+		return "", err
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	_, data, err := c.Manifest(name, ref)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Manifest returns media type and content of image manifest of given
+// repository and reference, content of manifest fetched by digest is verified
+// against the digest
+func (c *RegistryClient) Manifest(name, ref string) (string, []byte, error) {
+	resp, err := c.do("GET", name, "manifests/"+ref, manifestTypes)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if err := c.check(resp, name, ref); err != nil {
+		return "", nil, err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasPrefix(ref, "sha256:") {
+		sum := sha256.Sum256(data)
+		if ref != "sha256:"+hex.EncodeToString(sum[:]) {
+			return "", nil, fmt.Errorf("digest mismatch of manifest %s:%s", name, ref)
+		}
+	}
+	return resp.Header.Get("Content-Type"), data, nil
+}
+
+// Blob returns content of the blob with given digest
+func (c *RegistryClient) Blob(name, digest string) ([]byte, error) {
+	resp, err := c.do("GET", name, "blobs/"+digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := c.check(resp, name, digest); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// helper function to check that requested image exists in the registry,
+// it returns digest of the image. The check is enabled by check flag of
+// the registry of the image or by service policy which verifies image of
+// given digest
+func checkImage(r Request, policy ServicePolicy) (string, error) {
+	c, name := imageRegistry(r.Image)
+	if !c.config.Check && policy.Cosign == nil && policy.SLSA == nil && policy.Labels == nil && policy.Vulnerabilities == nil {
+		return "", nil
+	}
+	digest, err := c.ManifestDigest(name, r.Tag)
+	if err != nil {
+		return "", err
+	}
+	return digest, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestManifestDigest
+func TestManifestDigest(t *testing.T) {
+	tokens := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "bot" || pass != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:org/srv:pull" || r.URL.Query().Get("service") != "registry.test" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tokens++
+			w.Write([]byte(`{"token": "abc", "expires_in": 300}`))
+		case "/v2/org/srv/manifests/0.1":
+			if r.Header.Get("Authorization") != "Bearer abc" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:123")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := newRegistryClient(RegistryConfig{URL: ts.URL, AuthURL: ts.URL + "/token", Service: "registry.test", Username: "bot", Password: "secret"})
+	digest, err := c.ManifestDigest("org/srv", "0.1")
+	if err != nil || digest != "sha256:123" {
+		t.Fatalf("Fail TestManifestDigest, digest %s, error %v\n", digest, err)
+	}
+	if _, err := c.ManifestDigest("org/srv", "0.2"); !errors.Is(err, errImageNotFound) {
+		t.Errorf("Fail TestManifestDigest, wrong error of missing tag %v\n", err)
+	}
+	if tokens != 1 {
+		t.Errorf("Fail TestManifestDigest, token is not cached, %d token requests\n", tokens)
+	}
+	c = newRegistryClient(RegistryConfig{URL: ts.URL, AuthURL: ts.URL + "/token", Service: "registry.test", Username: "bot", Password: "wrong"})
+	if _, err := c.ManifestDigest("org/srv", "0.1"); !errors.Is(err, errRegistryAuth) {
+		t.Errorf("Fail TestManifestDigest, wrong error of refused credentials %v\n", err)
+	}
+}
+
+// TestParseImage
+func TestParseImage(t *testing.T) {
+	tests := map[string][2]string{
+		"httpgo":                          {"", "httpgo"},
+		"cmssw/httpgo":                    {"", "cmssw/httpgo"},
+		"docker.io/cmssw/httpgo":          {"docker.io", "cmssw/httpgo"},
+		"index.docker.io/cmssw/httpgo":    {"docker.io", "cmssw/httpgo"},
+		"ghcr.io/org/srv":                 {"ghcr.io", "org/srv"},
+		"localhost/srv":                   {"localhost", "srv"},
+		"registry.local:5000/team/app/sv": {"registry.local:5000", "team/app/sv"},
+	}
+	for image, exp := range tests {
+		if host, name := parseImage(image); host != exp[0] || name != exp[1] {
+			t.Errorf("Fail TestParseImage, image %s parsed into %s %s\n", image, host, name)
+		}
+	}
+	if name := newRegistryClient(RegistryConfig{}).repository("httpgo"); name != "library/httpgo" {
+		t.Errorf("Fail TestParseImage, wrong Docker Hub repository %s\n", name)
+	}
+}
+
+// TestImageRegistryCache
+func TestImageRegistryCache(t *testing.T) {
+	empty := t.TempDir() + "/config.json"
+	ioutil.WriteFile(empty, []byte("{}"), 0600)
+	if err := setupRegistries(RegistryConfig{}, nil, empty); err != nil {
+		t.Fatal(err)
+	}
+	c1, name := imageRegistry("cmssw/httpgo")
+	c2, _ := imageRegistry("cmssw/auth-proxy-server")
+	if c1 != c2 || name != "cmssw/httpgo" {
+		t.Errorf("Fail TestImageRegistryCache, client of images without registry host is not cached")
+	}
+	c3, _ := imageRegistry("ghcr.io/org/srv")
+	c4, _ := imageRegistry("ghcr.io/org/other")
+	if c3 != c4 || c3 == c1 {
+		t.Errorf("Fail TestImageRegistryCache, wrong clients of ghcr.io images")
+	}
+}
+
+// TestRegistryChallenges
+func TestRegistryChallenges(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if user, pass, ok := r.BasicAuth(); !ok || user != "ghuser" || pass != "ghpass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"access_token": "tkn"}`))
+		case strings.HasPrefix(r.URL.Path, "/v2/bearer/"):
+			if r.Header.Get("Authorization") != "Bearer tkn" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:bearer/srv:pull"`, ts.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:bearer")
+		case strings.HasPrefix(r.URL.Path, "/v2/basic/"):
+			if user, pass, ok := r.BasicAuth(); !ok || user != "ghuser" || pass != "ghpass" {
+				w.Header().Set("Www-Authenticate", `Basic realm="registry"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:basic")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	host := strings.TrimPrefix(ts.URL, "http://")
+
+	// credentials are taken from Kubernetes dockerconfigjson secret
+	auth := base64.StdEncoding.EncodeToString([]byte("ghuser:ghpass"))
+	config := fmt.Sprintf(`{"auths": {"http://%s": {"auth": "%s"}}}`, host, auth)
+	secret := fmt.Sprintf(`{"kind": "Secret", "data": {".dockerconfigjson": "%s"}}`, base64.StdEncoding.EncodeToString([]byte(config)))
+	fname := t.TempDir() + "/secret.json"
+	if err := ioutil.WriteFile(fname, []byte(secret), 0600); err != nil {
+		t.Fatal(err)
+	}
+	registries := []RegistryConfig{{Host: host, URL: ts.URL}}
+	if err := setupRegistries(RegistryConfig{}, registries, fname); err != nil {
+		t.Fatal(err)
+	}
+	empty := t.TempDir() + "/config.json"
+	ioutil.WriteFile(empty, []byte("{}"), 0600)
+	defer setupRegistries(RegistryConfig{}, nil, empty)
+
+	for _, image := range []string{"bearer", "basic"} {
+		c, name := imageRegistry(fmt.Sprintf("%s/%s/srv", host, image))
+		digest, err := c.ManifestDigest(name, "0.1")
+		if err != nil || digest != "sha256:"+image {
+			t.Errorf("Fail TestRegistryChallenges, %s challenge digest %s, error %v\n", image, digest, err)
+		}
+	}
+	if _, err := readDockerConfig(os.DevNull); err == nil {
+		t.Errorf("Fail TestRegistryChallenges, empty docker config is accepted")
+	}
+}
+
+// fakeRegistryServer represents local registry stand-in serving manifests and blobs
+type fakeRegistryServer struct {
+	host      string
+	url       string
+	config    string            // empty docker config file
+	manifests map[string][]byte // manifests per repository and reference, e.g. org/srv:0.1
+	blobs     map[string][]byte // blobs per digest
+}
+
+// helper function to serve local registry stand-in and route images of its host to it
+func fakeRegistry(t *testing.T) *fakeRegistryServer {
+	reg := &fakeRegistryServer{manifests: make(map[string][]byte), blobs: make(map[string][]byte)}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		if idx := strings.Index(path, "/manifests/"); idx > 0 {
+			data, ok := reg.manifests[path[:idx]+":"+path[idx+len("/manifests/"):]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var m struct {
+				MediaType string `json:"mediaType"`
+			}
+			json.Unmarshal(data, &m)
+			w.Header().Set("Content-Type", m.MediaType)
+			w.Header().Set("Docker-Content-Digest", blobDigest(data))
+			w.Write(data)
+			return
+		}
+		if idx := strings.Index(path, "/blobs/"); idx > 0 {
+			if data, ok := reg.blobs[path[idx+len("/blobs/"):]]; ok {
+				w.Write(data)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	reg.host = strings.TrimPrefix(ts.URL, "http://")
+	reg.url = ts.URL
+	empty := t.TempDir() + "/config.json"
+	reg.config = empty
+	ioutil.WriteFile(empty, []byte("{}"), 0600)
+	if err := setupRegistries(RegistryConfig{}, []RegistryConfig{{Host: reg.host, URL: ts.URL}}, empty); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		setupRegistries(RegistryConfig{}, nil, empty)
+		ts.Close()
+	})
+	return reg
+}
+
+// helper function to enable image check of the registry
+func (reg *fakeRegistryServer) check(t *testing.T) {
+	if err := setupRegistries(RegistryConfig{}, []RegistryConfig{{Host: reg.host, URL: reg.url, Check: true}}, reg.config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// helper function to return digest of given content
+func blobDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// helper function to add blob to the registry, it returns blob descriptor
+func (reg *fakeRegistryServer) blob(mediaType string, data []byte) OCIDescriptor {
+	digest := blobDigest(data)
+	reg.blobs[digest] = data
+	return OCIDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+}
+
+// helper function to add manifest to the registry, it returns manifest digest
+func (reg *fakeRegistryServer) manifest(name string, refs []string, m OCIManifest) string {
+	if m.MediaType == "" {
+		m.MediaType = "application/vnd.oci.image.manifest.v1+json"
+	}
+	data, _ := json.Marshal(m)
+	digest := blobDigest(data)
+	for _, ref := range append(refs, digest) {
+		reg.manifests[name+":"+ref] = data
+	}
+	return digest
+}
+
+// TestCheckImage
+func TestCheckImage(t *testing.T) {
+	reg := fakeRegistry(t)
+	digest := reg.manifest("org/srv", []string{"0.1"}, OCIManifest{})
+	r := Request{Image: reg.host + "/org/srv", Tag: "0.1"}
+	// check flag of default registry does not apply to other registries
+	registries.defaults.Check = true
+	if out, err := checkImage(r, ServicePolicy{}); err != nil || out != "" {
+		t.Errorf("Fail TestCheckImage, image is checked by default registry flag, digest %s error %v\n", out, err)
+	}
+	reg.check(t)
+	if out, err := checkImage(r, ServicePolicy{}); err != nil || out != digest {
+		t.Errorf("Fail TestCheckImage, digest %s error %v\n", out, err)
+	}
+	r.Tag = "0.2"
+	if _, err := checkImage(r, ServicePolicy{}); !errors.Is(err, errImageNotFound) {
+		t.Errorf("Fail TestCheckImage, wrong error of missing tag %v\n", err)
+	}
+}
+
+// TestManifestDigestFallback
+func TestManifestDigestFallback(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2}`)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/org/srv/manifests/0.1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		// registry does not report digest of the manifest
+		w.Write(manifest)
+	}))
+	defer ts.Close()
+	c := newRegistryClient(RegistryConfig{URL: ts.URL})
+	if digest, err := c.ManifestDigest("org/srv", "0.1"); err != nil || digest != blobDigest(manifest) {
+		t.Errorf("Fail TestManifestDigestFallback, digest %s error %v\n", digest, err)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+// release module provides atomic deployment of multiple services
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Release represents release request which deploys several services together
+type Release struct {
+	Name    string    `json:"name"`    // release name
+	Members []Request `json:"members"` // release members deployed in given order
+	Expire  int64     `json:"expire"`  // expire timestamp of release request
+}
+
+// ReleaseMember represents outcome of release member deployment
+type ReleaseMember struct {
+	Namespace string   `json:"namespace"`       // namespace of the member
+	Service   string   `json:"service"`         // service name of the member
+	Image     string   `json:"image"`           // image of the member
+	Tag       string   `json:"tag"`             // image tag of the member
+	JobID     string   `json:"job_id"`          // deployment job id
+	State     JobState `json:"state"`           // deployment state of the member
+	Error     string   `json:"error,omitempty"` // deployment error of the member
+}
+
+// ReleaseResult represents result of release request
+type ReleaseResult struct {
+	ID       string          `json:"id"`                 // release id
+	Name     string          `json:"name"`               // release name
+	State    JobState        `json:"state"`              // release state
+	Error    string          `json:"error,omitempty"`    // release error
+	Created  int64           `json:"created"`            // release creation timestamp
+	Finished int64           `json:"finished,omitempty"` // release finish timestamp
+	Members  []ReleaseMember `json:"members"`            // outcomes of release members
+}
+
+// action of release jobs, release result is kept in the job and persisted with it
+const actionRelease = "release"
+
+// helper function to update release result of release job under the job lock
+func updateRelease(job *Job, f func(res *ReleaseResult)) {
+	job.update(func(j *Job) { f(j.Release) })
+}
+
+// helper function to get copy of release result of given release id
+func getRelease(m *JobManager, id string) (ReleaseResult, bool) {
+	job, ok := m.Get(id)
+	if !ok || job.Action != actionRelease {
+		return ReleaseResult{}, false
+	}
+	var out ReleaseResult
+	job.update(func(j *Job) {
+		out = *j.Release
+		out.Members = append([]ReleaseMember{}, j.Release.Members...)
+	})
+	return out, true
+}
+
+// helper function to validate release request, all members are validated up
+// front and information gathered by their checks is returned in members order
+func checkRelease(rel Release) ([]RequestInfo, error) {
+	if len(rel.Members) == 0 {
+		return nil, errors.New("release has no members")
+	}
+	if rel.Expire < time.Now().Unix() {
+		return nil, errors.New("expired release")
+	}
+	workloads := make(map[string]bool)
+	for _, r := range rel.Members {
+		if workloads[r.workload()] {
+			return nil, fmt.Errorf("duplicate release member %s", r.workload())
+		}
+		workloads[r.workload()] = true
+	}
+	var infos []RequestInfo
+	for _, r := range rel.Members {
+		info, err := checkRequest(r)
+		if err != nil {
+			return nil, fmt.Errorf("release member %s: %v", r.workload(), err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// helper function to compare release requests
+func compareReleases(r1, r2 Release) bool {
+	if r1.Name != r2.Name || len(r1.Members) != len(r2.Members) {
+		return false
+	}
+	for idx, r := range r1.Members {
+		m := r2.Members[idx]
+		if r.Namespace != m.Namespace || r.Service != m.Service || r.Image != m.Image || r.Tag != m.Tag || r.Commit != m.Commit || r.Repository != m.Repository {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to create release job with deployment jobs of release members,
+// the release id is id of the release job
+func newRelease(rel Release) (*Job, []*Job) {
+	job := newJob(Request{})
+	job.Action = actionRelease
+	res := &ReleaseResult{ID: job.ID, Name: rel.Name, State: JobQueued, Created: job.Created}
+	var members []*Job
+	for _, r := range rel.Members {
+		member := newJob(r)
+		member.ReleaseID = job.ID
+		members = append(members, member)
+		res.Members = append(res.Members, ReleaseMember{
+			Namespace: r.Namespace, Service: r.Service, Image: r.Image, Tag: r.Tag,
+			JobID: member.ID, State: JobQueued,
+		})
+	}
+	job.Release = res
+	return job, members
+}
+
+// helper function to register release job and its members within job manager
+func addRelease(m *JobManager, job *Job, members []*Job) {
+	for _, member := range members {
+		m.add(member)
+	}
+	m.add(job)
+}
+
+// helper function to deploy release members in order, if any member fails
+// already deployed members are rolled back in reverse order. Members keep
+// their workload slots until the release is finished, so other deployments of
+// their workloads can not interleave with the release and its rollback.
+// Members deployed before server restart are not deployed again, while member
+// superseded by newer request of its workload fails the release
+func runRelease(m *JobManager, job *Job) error {
+	var ids []string
+	updateRelease(job, func(res *ReleaseResult) {
+		res.State = JobRunning
+		for _, member := range res.Members {
+			ids = append(ids, member.JobID)
+		}
+	})
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+	var failed error
+	var deployed []*Job
+	last := len(ids)
+	for idx, id := range ids {
+		member, ok := m.Get(id)
+		if !ok {
+			failed = fmt.Errorf("unknown job %s of release member", id)
+			last = idx
+			break
+		}
+		var err error
+		switch member.state() {
+		case JobSucceeded:
+			key := member.Request.workload()
+			m.slots.hold(key)
+			releases = append(releases, func() { m.releaseSlot(key, member) })
+			deployed = append(deployed, member)
+			continue
+		case JobCoalesced:
+			err = errCoalesced
+		default:
+			var release func()
+			release, err = m.acquire(member, true)
+			if release != nil {
+				releases = append(releases, release)
+				err = m.exec(member)
+			}
+		}
+		state := member.state()
+		updateRelease(job, func(res *ReleaseResult) {
+			res.Members[idx].State = state
+			if err != nil {
+				res.Members[idx].Error = err.Error()
+			}
+		})
+		if errors.Is(err, errCoalesced) {
+			failed = fmt.Errorf("release member %s is superseded by newer request", member.Request.workload())
+			last = idx
+			break
+		}
+		if err != nil {
+			failed = fmt.Errorf("release member %s failed: %v", member.Request.workload(), err)
+			last = idx
+			break
+		}
+		deployed = append(deployed, member)
+	}
+	if failed == nil {
+		updateRelease(job, func(res *ReleaseResult) {
+			res.State = JobSucceeded
+			res.Finished = time.Now().Unix()
+		})
+		return nil
+	}
+
+	// skip remaining members and roll back deployed ones
+	state := JobRolledBack
+	for idx := last + 1; idx < len(ids); idx++ {
+		if member, ok := m.Get(ids[idx]); ok {
+			member.setState(JobSkipped, nil)
+		}
+		updateRelease(job, func(res *ReleaseResult) { res.Members[idx].State = JobSkipped })
+	}
+	m.save()
+	for i := len(deployed) - 1; i >= 0; i-- {
+		member := deployed[i]
+		r := member.Request
+		err := rollbackDeploy(r, findPolicy(r), member)
+		if err == nil {
+			member.setState(JobRolledBack, fmt.Errorf("%w, %v", errRolledBack, failed))
+			reportDeployment(r, findPolicy(r), member, "inactive", "rolled back with release")
+		} else {
+			state = JobFailed
+			member.Logf("unable to roll back release member %s, error %v", r.workload(), err)
+		}
+		m.save()
+		m.record(member)
+		updateRelease(job, func(res *ReleaseResult) {
+			for idx := range res.Members {
+				if res.Members[idx].JobID != member.ID {
+					continue
+				}
+				res.Members[idx].State = member.state()
+				if err != nil {
+					res.Members[idx].Error = fmt.Sprintf("rollback failed: %v", err)
+				}
+			}
+		})
+	}
+	updateRelease(job, func(res *ReleaseResult) {
+		res.State = state
+		res.Error = failed.Error()
+		res.Finished = time.Now().Unix()
+	})
+	if state == JobRolledBack {
+		return fmt.Errorf("%w, %v", errRolledBack, failed)
+	}
+	return failed
+}
+
+// helper function to read release request from HTTP request body
+func readRelease(r *http.Request) (Release, error) {
+	var rel Release
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return rel, err
+	}
+	err = json.Unmarshal(data, &rel)
+	return rel, err
+}
+
+// ReleaseHandler represents release API: POST /release/token provides release
+// token, POST /release executes release and GET /release/<id> provides its result
+func ReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	start := time.Now()
+	defer logRequest(w, r, start, &status)
+	path := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("%s/release", Config.Base))
+	path = strings.Trim(path, "/")
+
+	if r.Method == "GET" {
+		res, ok := getRelease(jobManager, path)
+		if !ok {
+			status = http.StatusNotFound
+			w.WriteHeader(status)
+			return
+		}
+		writeJSON(w, status, res)
+		return
+	}
+	if r.Method != "POST" {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		return
+	}
+	rel, err := readRelease(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		log.Println("unable to read release request", err)
+		w.WriteHeader(status)
+		return
+	}
+
+	// release token request
+	if path == "token" {
+		rel.Expire = time.Now().Unix() + Config.TokenInterval
+		for idx := range rel.Members {
+			rel.Members[idx].Expire = rel.Expire
+		}
+		token, err := encodeToken(rel)
+		if err != nil {
+			status = http.StatusInternalServerError
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(token))
+		return
+	}
+	if path != "" {
+		status = http.StatusNotFound
+		w.WriteHeader(status)
+		return
+	}
+
+	// validate release token and all release members
+	var tokenRelease Release
+	token := bearerToken(r)
+	if err := decodeTokenData(token, &tokenRelease); err != nil || !compareReleases(tokenRelease, rel) {
+		status = http.StatusUnauthorized
+		log.Println("unauthorized release request", err)
+		w.WriteHeader(status)
+		return
+	}
+	infos, err := checkRelease(tokenRelease)
+	if err != nil {
+		status = http.StatusUnauthorized
+		log.Printf("release is not allowed, error %v", err)
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	job, members := newRelease(tokenRelease)
+	for idx, member := range members {
+		member.setInfo(infos[idx])
+	}
+	for _, j := range append(members, job) {
+		j.Caller = caller(r)
+		j.TokenID = tokenID(token)
+	}
+	addRelease(jobManager, job, members)
+	if Config.Async {
+		if err := jobManager.Submit(job); err != nil {
+			status = http.StatusServiceUnavailable
+			log.Printf("unable to queue release %s, error %v", job.ID, err)
+			w.WriteHeader(status)
+			return
+		}
+		status = http.StatusAccepted
+		rec, _ := getRelease(jobManager, job.ID)
+		writeJSON(w, status, rec)
+		return
+	}
+	if err := jobManager.Run(job); err != nil {
+		status = http.StatusInternalServerError
+		log.Printf("release %s failed, error %v", job.ID, err)
+	}
+	rec, _ := getRelease(jobManager, job.ID)
+	writeJSON(w, status, rec)
+}
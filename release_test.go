@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestReleaseRollback
+func TestReleaseRollback(t *testing.T) {
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment web"):
+			return []byte("image: repo/web:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment api"):
+			return []byte("image: repo/api:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment db"):
+			return []byte("image: repo/db:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			if strings.Contains(cmd, "/api-") {
+				return nil, errors.New("apply failed")
+			}
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	history := deployHistory
+	defer func() { deployHistory = history }()
+	deployHistory, _ = newHistoryStore("")
+	store := filepath.Join(t.TempDir(), "jobs.json")
+	mgr, err := newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := Release{Name: "v1", Members: []Request{
+		{Service: "web", Namespace: "test", Tag: "0.2", Image: "repo/web"},
+		{Service: "api", Namespace: "test", Tag: "0.2", Image: "repo/api"},
+		{Service: "db", Namespace: "test", Tag: "0.2", Image: "repo/db"},
+	}}
+	job, members := newRelease(rel)
+	addRelease(mgr, job, members)
+	err = mgr.Run(job)
+	if !errors.Is(err, errRolledBack) {
+		t.Fatalf("Fail TestReleaseRollback, wrong error %v\n", err)
+	}
+	// release result should be persisted with the release job
+	mgr, err = newJobManager(store, 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, ok := getRelease(mgr, job.ID)
+	if !ok || out.State != JobRolledBack || out.ID != job.ID {
+		t.Fatalf("Fail TestReleaseRollback, wrong release state %+v\n", out)
+	}
+	recs, total := deployHistory.Query(HistoryFilter{Service: "web"})
+	if total != 1 || recs[0].Outcome != JobRolledBack {
+		t.Errorf("Fail TestReleaseRollback, wrong history of rolled back member %+v\n", recs)
+	}
+	expect := []JobState{JobRolledBack, JobFailed, JobSkipped}
+	for idx, m := range out.Members {
+		if m.State != expect[idx] {
+			t.Errorf("Fail TestReleaseRollback, member %s state %s, expect %s\n", m.Service, m.State, expect[idx])
+		}
+	}
+	var undo []string
+	for _, c := range *calls {
+		if strings.HasPrefix(c, "kubectl apply -f") && strings.Contains(c, "-0.1-") {
+			undo = append(undo, c)
+		}
+		if strings.HasPrefix(c, "kubectl get deployment db") {
+			t.Errorf("Fail TestReleaseRollback, skipped member was deployed: %s\n", c)
+		}
+	}
+	if len(undo) != 1 || !strings.Contains(undo[0], "/web-test-0.1-") {
+		t.Errorf("Fail TestReleaseRollback, wrong rollback commands %v\n", undo)
+	}
+}
+
+// TestReleaseCoalesced
+func TestReleaseCoalesced(t *testing.T) {
+	calls := fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment web"):
+			return []byte("image: repo/web:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment api"):
+			return []byte("image: repo/api:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	mgr, err := newJobManager("", 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := Release{Name: "v1", Members: []Request{
+		{Service: "web", Namespace: "test", Tag: "0.2", Image: "repo/web"},
+		{Service: "api", Namespace: "test", Tag: "0.2", Image: "repo/api"},
+	}}
+	job, members := newRelease(rel)
+	addRelease(mgr, job, members)
+	// newer request of api service supersedes release member waiting for the workload
+	newer := newJob(Request{Service: "api", Namespace: "test", Tag: "0.3", Image: "repo/api"})
+	mgr.add(newer)
+	mgr.slots.latest["test/api"] = newer
+	if err := mgr.Run(job); !errors.Is(err, errRolledBack) {
+		t.Fatalf("Fail TestReleaseCoalesced, coalesced member should fail release: %v\n", err)
+	}
+	out, _ := getRelease(mgr, job.ID)
+	if out.State != JobRolledBack || out.Members[0].State != JobRolledBack || out.Members[1].State != JobCoalesced {
+		t.Errorf("Fail TestReleaseCoalesced, wrong release %+v\n", out)
+	}
+	var undo []string
+	for _, c := range *calls {
+		if strings.HasPrefix(c, "kubectl apply -f") && strings.Contains(c, "-0.1-") {
+			undo = append(undo, c)
+		}
+	}
+	if len(undo) != 1 || !strings.Contains(undo[0], "/web-test-0.1-") {
+		t.Errorf("Fail TestReleaseCoalesced, wrong rollback commands %v\n", undo)
+	}
+}
+
+// TestReleaseSlots
+func TestReleaseSlots(t *testing.T) {
+	deployed := make(chan bool)
+	var mu sync.Mutex
+	var order []string
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment web"):
+			return []byte("image: repo/web:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl get deployment api"):
+			return []byte("image: repo/api:0.1\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			mu.Lock()
+			order = append(order, cmd)
+			mu.Unlock()
+			if strings.Contains(cmd, "/api-") {
+				// newer deployment of web is submitted while release is running
+				deployed <- true
+				time.Sleep(100 * time.Millisecond)
+				return nil, errors.New("apply failed")
+			}
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	mgr, err := newJobManager("", 1, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel := Release{Name: "v1", Members: []Request{
+		{Service: "web", Namespace: "test", Tag: "0.2", Image: "repo/web"},
+		{Service: "api", Namespace: "test", Tag: "0.2", Image: "repo/api"},
+	}}
+	job, members := newRelease(rel)
+	addRelease(mgr, job, members)
+	done := make(chan error)
+	go func() {
+		<-deployed
+		done <- mgr.Run(newJob(Request{Service: "web", Namespace: "test", Tag: "0.3", Image: "repo/web"}))
+	}()
+	if err := mgr.Run(job); !errors.Is(err, errRolledBack) {
+		t.Fatalf("Fail TestReleaseSlots, wrong error %v\n", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	// newer deployment of web waits for the release and it is not overwritten by rollback
+	mu.Lock()
+	defer mu.Unlock()
+	last := order[len(order)-1]
+	if len(order) != 4 || !strings.Contains(order[2], "/web-test-0.1-") || !strings.Contains(last, "/web-test-0.3-") {
+		t.Errorf("Fail TestReleaseSlots, wrong order of deployments %v\n", order)
+	}
+}
+
+// TestCheckRelease
+func TestCheckRelease(t *testing.T) {
+	r := Request{Service: "srv", Namespace: "test", Tag: "0.2", Image: "repo/srv"}
+	rel := Release{Members: []Request{r, r}, Expire: 1 << 40}
+	if _, err := checkRelease(rel); err == nil || !strings.Contains(err.Error(), "duplicate") {
+		t.Errorf("Fail TestCheckRelease, duplicate members are not rejected: %v\n", err)
+	}
+	if _, err := checkRelease(Release{Expire: 1 << 40}); err == nil {
+		t.Errorf("Fail TestCheckRelease, empty release is not rejected\n")
+	}
+	tok := Release{Name: "v1", Members: []Request{r}}
+	other := tok
+	other.Members = []Request{{Service: "srv", Namespace: "test", Tag: "0.3", Image: "repo/srv"}}
+	if !compareReleases(tok, tok) || compareReleases(tok, other) {
+		t.Errorf("Fail TestCheckRelease, wrong release comparison\n")
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"os/exec"
+	"os"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -22,65 +23,283 @@ type Request struct {
 	Expire     int64  `json:"expire"`     // expire timestamp of request
 }
 
+// helper function to return workload identifier of the request
+func (r Request) workload() string {
+	return fmt.Sprintf("%s/%s", r.Namespace, r.Service)
+}
+
+// helper function to return image reference for given tag or digest
+func imageRef(image, tag string) string {
+	if strings.HasPrefix(tag, "sha256:") {
+		return fmt.Sprintf("%s@%s", image, tag)
+	}
+	return fmt.Sprintf("%s:%s", image, tag)
+}
+
+// helper function to extract tag or digest from image reference of given image
+func imageTag(ref, image string) string {
+	tag := strings.TrimPrefix(ref, image)
+	return strings.TrimLeft(tag, ":@")
+}
+
+// helper function to return tag of the request pinned to image digest verified
+// by request checks, e.g. 1.2@sha256:..., so the deployed image can not be
+// changed by moving the tag after the request was checked. It should be used
+// for full image references only, targets which keep tag and digest apart
+// should use tagDigest
+func pinnedTag(r Request, job *Job) string {
+	return pinTag(tagDigest(r, job))
+}
+
+// helper function to pin tag to given digest, e.g. 1.2@sha256:...
+func pinTag(tag, digest string) string {
+	if digest == "" || tag == "" {
+		return tag + digest
+	}
+	return fmt.Sprintf("%s@%s", tag, digest)
+}
+
+// helper function to return tag of the request and digest it is pinned to,
+// tags pinned to digest, e.g. 1.2@sha256:... of rolled back image, are split
+// and digest of image verified by request checks is used for other tags
+func tagDigest(r Request, job *Job) (string, string) {
+	if arr := strings.SplitN(r.Tag, "@", 2); len(arr) == 2 {
+		return arr[0], arr[1]
+	}
+	if strings.HasPrefix(r.Tag, "sha256:") {
+		return r.Tag, ""
+	}
+	return r.Tag, job.digest()
+}
+
 // helper function to change tag in provided string (yaml content)
 func changeTag(s string, r Request) string {
 	pat := fmt.Sprintf("image: %s.*", r.Image)
 	re := regexp.MustCompile(pat)
-	img := fmt.Sprintf("image: %s:%s", r.Image, r.Tag)
+	img := fmt.Sprintf("image: %s", imageRef(r.Image, r.Tag))
 	return re.ReplaceAllString(s, img)
 }
 
+// helper function to find current image of the request in provided string (yaml content)
+func currentImage(s string, r Request) string {
+	pat := fmt.Sprintf("image: (%s\\S*)", regexp.QuoteMeta(r.Image))
+	re := regexp.MustCompile(pat)
+	if m := re.FindStringSubmatch(s); len(m) > 1 {
+		return m[1]
+	}
+	return ""
+}
+
+// helper function to execute request according to the service policy,
+// the progress is reported to given job
+func exeRequest(r Request, job *Job) error {
+	job.Logf("execute request %+v", r)
+	policy := findPolicy(r)
+	startDeployment(r, policy, job)
+	err := runRequest(r, policy, job)
+	finishDeployment(r, policy, job, err)
+	return err
+}
+
+// helper function to run deployment steps of the request: changelog,
+// pre-deploy hooks, deployment to the target and post-deploy hooks, CI checks of the request
+// are waited for by job manager before the job takes its workload
+func runRequest(r Request, policy ServicePolicy, job *Job) error {
+	collectChangelog(r, policy, job)
+	if err := runHooks("pre", policy.Hooks.pre(), r, job); err != nil {
+		return fmt.Errorf("pre-deploy hook failed: %v", err)
+	}
+	if err := deployTarget(r, policy, job); err != nil {
+		return err
+	}
+	if err := runHooks("post", policy.Hooks.post(), r, job); err != nil {
+		if rerr := rollbackDeploy(r, policy, job); rerr != nil {
+			return fmt.Errorf("post-deploy hook failed: %v, rollback failed: %v", err, rerr)
+		}
+		return fmt.Errorf("%w, post-deploy hook failed: %v", errRolledBack, err)
+	}
+	return nil
+}
+
+// helper function to deploy request to the target of the service policy
+func deployTarget(r Request, policy ServicePolicy, job *Job) error {
+	switch policy.Target {
+	case "", "kubectl":
+		switch policy.Strategy {
+		case "", "rolling":
+			return kubectlDeploy(r, job)
+		case "canary":
+			return canaryDeploy(r, policy.Canary, job)
+		case "bluegreen":
+			return bluegreenDeploy(r, policy.BlueGreen, job)
+		}
+		return fmt.Errorf("unknown deployment strategy %s", policy.Strategy)
+	case "gitops":
+		return gitopsDeploy(r, policy.GitOps, job)
+	case "helm":
+		return helmDeploy(r, policy.Helm, job)
+	case "kustomize":
+		return kustomizeDeploy(r, policy.Kustomize, job)
+	}
+	return fmt.Errorf("unknown deployment target %s", policy.Target)
+}
+
+// helper function to roll back deployment of the request made by given job
+func rollbackDeploy(r Request, policy ServicePolicy, job *Job) error {
+	job.Stage("rollback", "started", fmt.Sprintf("roll back %s", r.workload()))
+	err := rollbackTarget(r, policy, job)
+	if err != nil {
+		job.Stage("rollback", "failed", err.Error())
+		return err
+	}
+	job.Stage("rollback", "succeeded", "")
+	return nil
+}
+
+// helper function to restore state of the target of the service policy
+func rollbackTarget(r Request, policy ServicePolicy, job *Job) error {
+	var prev string
+	var prevRev int
+	job.update(func(j *Job) {
+		prev = j.PreviousImage
+		prevRev = j.PreviousRevision
+	})
+	switch policy.Target {
+	case "", "kubectl":
+		switch policy.Strategy {
+		case "bluegreen":
+			_, err := switchBack(r, policy.BlueGreen, nil)
+			return err
+		case "canary":
+			c := policy.Canary
+			if c == nil {
+				c = &CanaryStrategy{}
+			}
+			if err := restoreDeployment(c.deployment(r), r, prev, job); err != nil {
+				return err
+			}
+		}
+		return restoreDeployment(r.Service, r, prev, job)
+	case "helm":
+		h := policy.Helm
+		if h == nil || prevRev == 0 {
+			return fmt.Errorf("unknown previous revision of helm release")
+		}
+		return helmRollback(h.release(r), h.namespace(r), prevRev, h.timeout())
+	}
+	// other targets are restored by deployment of previous image
+	if prev == "" {
+		return fmt.Errorf("unknown previous image of %s", r.workload())
+	}
+	rr := r
+	rr.Tag = imageTag(prev, r.Image)
+	job.Logf("redeploy previous image %s", prev)
+	return deployTarget(rr, policy, nil)
+}
+
+// helper function to restore previous image of given deployment changed by the
+// job, the deployment provenance is used to avoid reverting changes made by others
+func restoreDeployment(name string, r Request, prev string, job *Job) error {
+	if p, err := workloadProvenance(name, r.Namespace); err == nil && job != nil && p.JobID != "" && p.JobID != job.ID {
+		return fmt.Errorf("deployment %s/%s was changed by job %s, skip rollback", r.Namespace, name, p.JobID)
+	}
+	if prev == "" {
+		return fmt.Errorf("unknown previous image of deployment %s/%s", r.Namespace, name)
+	}
+	rr := r
+	rr.Tag = imageTag(prev, r.Image)
+	job.Logf("redeploy previous image %s to deployment %s", prev, name)
+	_, err := applyDeployment(name, rr, previousProvenance(r, prev), job)
+	return err
+}
+
 // helper function to execute request on k8s
-func exeRequest(r Request) error {
-	log.Printf("execute request %+v\n", r)
+func kubectlDeploy(r Request, job *Job) error {
+	prev, err := patchDeployment(r.Service, r, job)
+	if err != nil {
+		return err
+	}
+	ref := imageRef(r.Image, pinnedTag(r, job))
+	job.update(func(j *Job) {
+		j.PreviousImage = prev
+		j.NewImage = ref
+	})
+	return nil
+}
+
+// helper function to set image of the request pinned to its verified digest in
+// given k8s deployment, it returns image used by deployment before the change
+func patchDeployment(deployment string, r Request, job *Job) (string, error) {
+	rr := r
+	rr.Tag = pinnedTag(r, job)
+	return applyDeployment(deployment, rr, newProvenance(r, job), job)
+}
+
+// helper function to set image of the request and its provenance annotations
+// in given k8s deployment, it returns image used by deployment before the change
+func applyDeployment(deployment string, r Request, p Provenance, job *Job) (string, error) {
 	var args []string
 
 	// get yaml of our request image
-	args = []string{"get", "deployment", r.Service, "-n", r.Namespace, "-o", "yaml"}
-	cmd := exec.Command("kubectl", args...)
-	out, err := cmd.Output()
+	args = []string{"get", "deployment", deployment, "-n", r.Namespace, "-o", "yaml"}
+	out, err := runCommand("kubectl", args...)
 	if err != nil {
-		return err
+		return "", err
 	}
 	yaml := string(out)
 	log.Println("YAML", yaml)
 	// change image tag
-	content := changeTag(yaml, r)
+	prev := currentImage(yaml, r)
+	checkDrift(deployment, r, prev, job)
+	content := setProvenance(changeTag(yaml, r), p)
 	log.Println("NEW YAML", content)
 
-	// write new yml file
-	fname := fmt.Sprintf("/tmp/%s-%s-%s.yaml", r.Service, r.Namespace, r.Tag)
+	// write new yml file, every request uses its own file
+	tmp, err := ioutil.TempFile("", fmt.Sprintf("%s-%s-%s-*.yaml", deployment, r.Namespace, r.Tag))
+	if err != nil {
+		return prev, err
+	}
+	fname := tmp.Name()
+	defer os.Remove(fname)
 	log.Println("fname", fname)
-	err = ioutil.WriteFile(fname, []byte(content), 0777)
+	_, err = tmp.WriteString(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return err
+		return prev, err
 	}
 
 	// kubectl apply -f file.yml
 	args = []string{"apply", "-f", fname}
-	cmd = exec.Command("kubectl", args...)
-	out, err = cmd.Output()
+	out, err = runCommand("kubectl", args...)
 	if err != nil {
-		return err
+		return prev, err
 	}
-	log.Printf("deployed new image %s:%s to namespace %s from github repostiory %s, output %v\n", r.Image, r.Tag, r.Namespace, r.Repository, string(out))
-	return nil
+	job.Logf("deployed new image %s to deployment %s in namespace %s from github repostiory %s, output %v", imageRef(r.Image, r.Tag), deployment, r.Namespace, p.Repository, string(out))
+	return prev, nil
+}
+
+// RequestInfo represents information about image request gathered by its checks
+type RequestInfo struct {
+	Signer          string `json:"signer,omitempty"`          // identity of verified signer of tag or commit
+	Digest          string `json:"digest,omitempty"`          // digest of requested image in the registry
+	Vulnerabilities string `json:"vulnerabilities,omitempty"` // summary of image vulnerabilities
 }
 
-// helper function to check incoming request
-func checkRequest(r Request) error {
+// helper function to check incoming request, it returns information
+// gathered by the checks which is attached to deployment job of the request
+func checkRequest(r Request) (RequestInfo, error) {
+	var info RequestInfo
 	if r.Namespace == "" || r.Tag == "" || r.Repository == "" || r.Image == "" || r.Commit == "" || r.Service == "" {
 		log.Printf("ERROR, incomplete request %+v\n", r)
-		return fmt.Errorf("incomplete request")
+		return info, fmt.Errorf("incomplete request")
 	}
 	if r.Expire < time.Now().Unix() {
 		log.Printf("ERROR, request expired %+v\n", r)
-		return fmt.Errorf("expired request")
-	}
-	if commit, err := getCommit(r); commit != r.Commit || err != nil {
-		log.Printf("ERROR, unknown commit %s, request.Commit %v, error %v\n", commit, r.Commit, err)
-		return fmt.Errorf("unknown commit %s", commit)
+		return info, fmt.Errorf("expired request")
 	}
+	// allowed services are checked before any outbound request
 	var match bool
 	for idx, srv := range Config.Services {
 		ns := Config.Namespaces[idx]
@@ -89,11 +308,11 @@ func checkRequest(r Request) error {
 			match = true
 			if ns != r.Namespace {
 				log.Printf("ERROR, unknown namespace %s, request.Namespace %v\n", ns, r.Namespace)
-				return fmt.Errorf("unknown namespace %s", ns)
+				return info, fmt.Errorf("unknown namespace %s", ns)
 			}
 			if image != r.Image {
 				log.Printf("ERROR, unknown image %s, request.Image %v\n", image, r.Image)
-				return fmt.Errorf("unknown image %s", image)
+				return info, fmt.Errorf("unknown image %s", image)
 			}
 		} else {
 			continue
@@ -101,14 +320,52 @@ func checkRequest(r Request) error {
 	}
 	if !match {
 		log.Println("No matching service found in k8s for given request")
-		return fmt.Errorf("No matching service found for request %+v", r)
+		return info, fmt.Errorf("No matching service found for request %+v", r)
 	}
-	return nil
+	if commit, err := getCommit(r); commit != r.Commit || err != nil {
+		log.Printf("ERROR, unknown commit %s, request.Commit %v, error %v\n", commit, r.Commit, err)
+		return info, fmt.Errorf("unknown commit %s", commit)
+	}
+	signer, err := checkSignature(r, findPolicy(r))
+	if err != nil {
+		log.Printf("ERROR, signature check failed for %s@%s, error %v\n", r.Repository, r.Tag, err)
+		return info, err
+	}
+	info.Signer = signer
+	if err := checkAncestry(r, findPolicy(r)); err != nil {
+		log.Printf("ERROR, ancestry check failed for %s@%s, error %v\n", r.Repository, r.Commit, err)
+		return info, err
+	}
+	digest, err := checkImage(r, findPolicy(r))
+	if err != nil {
+		log.Printf("ERROR, image check failed for %s, error %v\n", imageRef(r.Image, r.Tag), err)
+		return info, err
+	}
+	info.Digest = digest
+	if err := checkCosign(r, findPolicy(r), digest); err != nil {
+		log.Printf("ERROR, cosign check failed for %s, error %v\n", imageRef(r.Image, r.Tag), err)
+		return info, err
+	}
+	if err := checkSLSA(r, findPolicy(r), digest); err != nil {
+		log.Printf("ERROR, provenance check failed for %s, error %v\n", imageRef(r.Image, r.Tag), err)
+		return info, err
+	}
+	if err := checkLabels(r, findPolicy(r), digest); err != nil {
+		log.Printf("ERROR, labels check failed for %s, error %v\n", imageRef(r.Image, r.Tag), err)
+		return info, err
+	}
+	summary, err := checkVulns(r, findPolicy(r), digest)
+	if err != nil {
+		log.Printf("ERROR, vulnerability check failed for %s, error %v\n", imageRef(r.Image, r.Tag), err)
+		return info, err
+	}
+	info.Vulnerabilities = summary
+	return info, nil
 }
 
-// helper function to compare requests
+// helper function to compare requests, all fields of the image request should match
 func compareRequests(r1, r2 Request) bool {
-	if r1.Namespace == r2.Namespace || r1.Service == r2.Service || r1.Tag == r2.Tag || r1.Repository == r2.Repository || r1.Commit == r2.Commit || r1.Image == r2.Image {
+	if r1.Namespace == r2.Namespace && r1.Service == r2.Service && r1.Tag == r2.Tag && r1.Repository == r2.Repository && r1.Commit == r2.Commit && r1.Image == r2.Image {
 		return true
 	}
 	log.Printf("requests do not match: %+v != %+v\n", r1, r2)
@@ -117,7 +374,19 @@ func compareRequests(r1, r2 Request) bool {
 
 // helper function to generate token
 func genToken(r Request) (string, error) {
-	data, err := json.Marshal(r)
+	return encodeToken(r)
+}
+
+// helper function to decode token
+func decodeToken(t string) (Request, error) {
+	var r Request
+	err := decodeTokenData(t, &r)
+	return r, err
+}
+
+// helper function to encode given object into token
+func encodeToken(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		return "", err
 	}
@@ -126,17 +395,15 @@ func genToken(r Request) (string, error) {
 	return hash, err
 }
 
-// helper function to decode token
-func decodeToken(t string) (Request, error) {
-	var r Request
+// helper function to decode token into given object
+func decodeTokenData(t string, v interface{}) error {
 	data, err := base64.StdEncoding.DecodeString(t)
 	if err != nil {
-		return r, err
+		return err
 	}
 	data, err = decrypt(data, Config.Secret)
 	if err != nil {
-		return r, err
+		return err
 	}
-	err = json.Unmarshal(data, &r)
-	return r, err
+	return json.Unmarshal(data, v)
 }
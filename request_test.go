@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -46,4 +48,52 @@ func TestToken(t *testing.T) {
 	if !compareRequests(req, r) {
 		t.Errorf("Fail TestToken, %+v != %+v\n", req, r)
 	}
+	// token of the request does not match request with any other field value
+	other := r
+	other.Tag = "456"
+	if compareRequests(req, other) {
+		t.Errorf("Fail TestToken, token matches request of other tag %+v\n", other)
+	}
+	other = r
+	other.Service = "db"
+	if compareRequests(req, other) {
+		t.Errorf("Fail TestToken, token matches request of other service %+v\n", other)
+	}
+}
+
+// TestCurrentImage
+func TestCurrentImage(t *testing.T) {
+	vals := []string{"bla-bla", "   - image: repo/srv:tag", "goo-goo"}
+	r := Request{Service: "srv", Namespace: "test", Tag: "123", Repository: "xxx/srv", Image: "repo/srv"}
+	if img := currentImage(strings.Join(vals, "\n"), r); img != "repo/srv:tag" {
+		t.Errorf("Fail TestCurrentImage, %s\n", img)
+	}
+}
+
+// TestCheckRequestAllowlist
+func TestCheckRequestAllowlist(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	api := githubAPI
+	githubAPI = ts.URL
+	defer func() { githubAPI = api }()
+	config := Config
+	defer func() { Config = config }()
+	Config.Services = []string{"srv"}
+	Config.Namespaces = []string{"test"}
+	Config.Images = []string{"repo/srv"}
+
+	// requests of unknown services are rejected without outbound requests
+	r := Request{Service: "other", Namespace: "test", Tag: "0.1", Image: "repo/other", Repository: "org/other", Commit: "abc", Expire: 1 << 40}
+	if _, err := checkRequest(r); err == nil || calls != 0 {
+		t.Errorf("Fail TestCheckRequestAllowlist, unknown service error %v, %d outbound requests\n", err, calls)
+	}
+	r = Request{Service: "srv", Namespace: "prod", Tag: "0.1", Image: "repo/srv", Repository: "org/srv", Commit: "abc", Expire: 1 << 40}
+	if _, err := checkRequest(r); err == nil || !strings.Contains(err.Error(), "unknown namespace") || calls != 0 {
+		t.Errorf("Fail TestCheckRequestAllowlist, unknown namespace error %v, %d outbound requests\n", err, calls)
+	}
 }
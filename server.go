@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -15,26 +19,124 @@ import (
 	_ "net/http/pprof" // profiler, see https://golang.org/pkg/net/http/pprof/
 )
 
-// helper function to check auth token and compare it with given image request
-func auth(r *http.Request, request Request) bool {
+// helper function to extract bearer token from HTTP request
+func bearerToken(r *http.Request) string {
 	if arr, ok := r.Header["Authorization"]; ok {
 		token := strings.Replace(arr[0], "Bearer ", "", -1)
 		token = strings.Replace(token, "bearer ", "", -1)
-		req, err := decodeToken(token)
-		if err != nil {
-			log.Printf("unable to decode token, error %v\n", err)
-			return false
+		return token
+	}
+	return ""
+}
+
+// helper function to return identifier of given token
+func tokenID(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// helper function to check if given address belongs to trusted proxies
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, p := range Config.TrustedProxies {
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to return identity of the caller of HTTP request, the
+// X-Forwarded-For header is taken into account only for trusted proxies
+func caller(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.String()
+	}
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !trustedProxy(addr) {
+		return addr
+	}
+	// take the right-most address which is not a trusted proxy
+	arr := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for idx := len(arr) - 1; idx >= 0; idx-- {
+		ip := strings.TrimSpace(arr[idx])
+		if ip == "" {
+			continue
+		}
+		addr = ip
+		if !trustedProxy(ip) {
+			break
+		}
+	}
+	return addr
+}
+
+// helper function to record rejected deployment request in history
+func recordRejected(r *http.Request, request Request, err error) {
+	if deployHistory == nil {
+		return
+	}
+	now := time.Now().Unix()
+	rec := DeployRecord{
+		ID:       jobID(),
+		Request:  request,
+		Outcome:  JobRejected,
+		Error:    err.Error(),
+		Started:  now,
+		Finished: now,
+		Caller:   caller(r),
+		TokenID:  tokenID(bearerToken(r)),
+	}
+	if err := deployHistory.Add(rec); err != nil {
+		log.Printf("unable to store record of rejected request, error %v\n", err)
+	}
+}
+
+// helper function to check that auth token is valid and it is issued for given
+// image request, deployment checks of the request are not performed
+func authToken(r *http.Request, request Request) (Request, bool) {
+	req, err := decodeToken(bearerToken(r))
+	if err != nil {
+		log.Printf("unable to decode token, error %v\n", err)
+		return req, false
+	}
+	if req.Expire < time.Now().Unix() {
+		log.Printf("expired token of %s\n", req.workload())
+		return req, false
+	}
+	return req, compareRequests(req, request)
+}
+
+// helper function to check auth token and compare it with given image request,
+// it returns checked request of the token and information gathered by its checks
+func auth(r *http.Request, request Request) (Request, RequestInfo, bool) {
+	if _, ok := r.Header["Authorization"]; ok {
+		req, ok := authToken(r, request)
+		if !ok {
+			return req, RequestInfo{}, false
 		}
 		// check that our request is allowed to be processed
-		if err := checkRequest(req); err != nil {
+		info, err := checkRequest(req)
+		if err != nil {
 			log.Printf("provided request is not allowed, error %v\n", err)
-			return false
-		}
-		if compareRequests(req, request) {
-			return true
+			return req, info, false
 		}
+		return req, info, true
 	}
-	return false
+	return request, RequestInfo{}, false
 }
 
 // RequestHandler represents incoming request handler
@@ -70,16 +172,41 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(status)
 		return
 	}
-	// check if given image request match the token
-	if !auth(r, imgRequest) {
+	// check if given image request match the token, the checked request
+	// of the token is deployed
+	tokenRequest, info, ok := auth(r, imgRequest)
+	if !ok {
 		status = http.StatusUnauthorized
 		log.Println("unauthorized access")
+		recordRejected(r, imgRequest, errors.New("unauthorized request"))
 		w.WriteHeader(status)
 		return
 	}
+	imgRequest = tokenRequest
 
 	// execute request
-	err = exeRequest(imgRequest)
+	job := newJob(imgRequest)
+	job.setInfo(info)
+	job.Caller = caller(r)
+	job.TokenID = tokenID(bearerToken(r))
+	if Config.Async {
+		if err := jobManager.Submit(job); err != nil {
+			status = http.StatusServiceUnavailable
+			log.Printf("unable to queue request: %+v, error %v", imgRequest, err)
+			w.WriteHeader(status)
+			return
+		}
+		status = http.StatusAccepted
+		writeJSON(w, status, job)
+		return
+	}
+	err = jobManager.Run(job)
+	if errors.Is(err, errCoalesced) {
+		status = http.StatusConflict
+		log.Printf("request %+v was superseded by newer request", imgRequest)
+		w.WriteHeader(status)
+		return
+	}
 	if err != nil {
 		status = http.StatusInternalServerError
 		log.Printf("unable to process request: %+v, error %v", imgRequest, err)
@@ -89,6 +216,44 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(status)
 }
 
+// JobsHandler represents jobs API, it provides status of given job or list of all jobs
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	start := time.Now()
+	defer logRequest(w, r, start, &status)
+	if r.Method != "GET" {
+		status = http.StatusBadRequest
+		w.WriteHeader(status)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("%s/jobs", Config.Base))
+	id := strings.Trim(path, "/")
+	if id == "" {
+		writeJSON(w, status, jobManager.Jobs())
+		return
+	}
+	job, ok := jobManager.Get(id)
+	if !ok {
+		status = http.StatusNotFound
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, job)
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, status int, rec interface{}) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("unable to marshal response", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
 // StatusHandler represents incoming request handler
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	status := http.StatusOK
@@ -135,8 +300,42 @@ func TokenHandler(w http.ResponseWriter, r *http.Request) {
 
 // http server implementation
 func server(serverCrt, serverKey string) {
+	// open history store of deployment records
+	var err error
+	deployHistory, err = newHistoryStore(Config.HistoryStore)
+	if err != nil {
+		log.Fatalf("unable to open history store, error %v\n", err)
+	}
+
+	// setup GitHub client
+	ghClient, err = newGitHubClient(Config.GitHub)
+	if err != nil {
+		log.Fatalf("unable to initialize GitHub client, error %v\n", err)
+	}
+	if err := setupSources(Config.Providers); err != nil {
+		log.Fatalf("unable to initialize source providers, error %v\n", err)
+	}
+
+	// setup docker registries
+	if err := setupRegistries(Config.Registry, Config.Registries, Config.DockerConfig); err != nil {
+		log.Fatalf("unable to initialize docker registries, error %v\n", err)
+	}
+
+	// start job manager which executes deployment requests
+	jobManager, err = newJobManager(Config.JobStore, Config.Workers, Config.QueueSize, Config.MaxJobs)
+	if err != nil {
+		log.Fatalf("unable to initialize job manager, error %v\n", err)
+	}
+	jobManager.Start()
+
 	// the request handler
 	http.HandleFunc(fmt.Sprintf("%s/status", Config.Base), StatusHandler)
+	http.HandleFunc(fmt.Sprintf("%s/jobs/", Config.Base), JobsHandler)
+	http.HandleFunc(fmt.Sprintf("%s/history", Config.Base), HistoryHandler)
+	http.HandleFunc(fmt.Sprintf("%s/changelog/", Config.Base), ChangelogHandler)
+	http.HandleFunc(fmt.Sprintf("%s/switchback", Config.Base), SwitchBackHandler)
+	http.HandleFunc(fmt.Sprintf("%s/release", Config.Base), ReleaseHandler)
+	http.HandleFunc(fmt.Sprintf("%s/release/", Config.Base), ReleaseHandler)
 	http.HandleFunc(fmt.Sprintf("%s/token", Config.Base), TokenHandler)
 	http.HandleFunc(fmt.Sprintf("%s/", Config.Base), RequestHandler)
 
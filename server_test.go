@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -56,3 +60,122 @@ func TestPostCall(t *testing.T) {
 	}
 
 }
+
+// TestCaller
+func TestCaller(t *testing.T) {
+	proxies := Config.TrustedProxies
+	defer func() { Config.TrustedProxies = proxies }()
+	Config.TrustedProxies = []string{"10.0.0.0/8"}
+
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "192.168.1.5:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if c := caller(req); c != "192.168.1.5" {
+		t.Errorf("Fail TestCaller, X-Forwarded-For of untrusted client is used %s\n", c)
+	}
+	req.RemoteAddr = "10.1.1.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 5.6.7.8, 10.2.2.2")
+	if c := caller(req); c != "5.6.7.8" {
+		t.Errorf("Fail TestCaller, wrong caller behind trusted proxy %s\n", c)
+	}
+}
+
+// TestRejectedRequestHistory
+func TestRejectedRequestHistory(t *testing.T) {
+	history := deployHistory
+	defer func() { deployHistory = history }()
+	deployHistory, _ = newHistoryStore("")
+
+	r := Request{Service: "srv", Namespace: "test", Tag: "123", Repository: "repo/srv"}
+	data, _ := json.Marshal(r)
+	req := httptest.NewRequest("POST", "/", bytes.NewBuffer(data))
+	req.Header.Set("Authorization", "Bearer xxx")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(RequestHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	out, total := deployHistory.Query(HistoryFilter{Outcome: JobRejected})
+	if total != 1 || out[0].Request.Service != "srv" || out[0].TokenID == "" {
+		t.Errorf("Fail TestRejectedRequestHistory, wrong records %+v\n", out)
+	}
+}
+
+// TestRequestHandler
+func TestRequestHandler(t *testing.T) {
+	config := Config
+	history, mgr := deployHistory, jobManager
+	defer func() {
+		Config = config
+		deployHistory, jobManager = history, mgr
+	}()
+	deployHistory, _ = newHistoryStore("")
+	var err error
+	if jobManager, err = newJobManager("", 1, 10, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	commit := "1130ebd31beeb1a0a4b50e908896e918f2b9be7d"
+	payload := "tree abc\n\nrelease v1.0\n"
+	verification, _ := json.Marshal(GitHubVerification{Verified: true, Reason: "valid", Signature: testSSHSign(key, payload), Payload: payload})
+	fakeGitHub(t, map[string]string{
+		"/repos/org/srv/git/refs/tags/v1.0":    fmt.Sprintf(`{"ref": "refs/tags/v1.0", "object": {"sha": "%s", "type": "commit"}}`, commit),
+		"/repos/org/srv/commits/" + commit:     fmt.Sprintf(`{"sha": "%s"}`, commit),
+		"/repos/org/srv/git/commits/" + commit: fmt.Sprintf(`{"sha": "%s", "verification": %s}`, commit, verification),
+	})
+	reg := fakeRegistry(t)
+	reg.check(t)
+	digest := reg.manifest("org/srv", []string{"v1.0"}, OCIManifest{})
+	image := reg.host + "/org/srv"
+	fakeCommands(t, func(cmd string) ([]byte, error) {
+		switch {
+		case strings.HasPrefix(cmd, "kubectl get deployment srv"):
+			return []byte("image: " + image + ":v0.9\n"), nil
+		case strings.HasPrefix(cmd, "kubectl apply -f"):
+			return []byte("ok"), nil
+		}
+		return nil, errors.New("unexpected command")
+	})
+	Config.Async = false
+	Config.Services = []string{"srv"}
+	Config.Namespaces = []string{"test"}
+	Config.Images = []string{image}
+	Config.Policies = []ServicePolicy{{Service: "srv", Signature: &SignaturePolicy{Required: true, Keys: []string{testAuthorizedKey(key, "release-key")}}}}
+
+	r := Request{Service: "srv", Namespace: "test", Tag: "v1.0", Image: image, Repository: "org/srv", Commit: commit, Expire: 1 << 40}
+	token, err := genToken(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(body Request) int {
+		data, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(data))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(RequestHandler).ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// request body should match the token request
+	other := r
+	other.Tag = "v2.0"
+	if code := post(other); code != http.StatusUnauthorized {
+		t.Errorf("Fail TestRequestHandler, request with other tag returned status %d\n", code)
+	}
+
+	// checked token request is deployed with information gathered by its checks
+	body := r
+	body.Expire = 0
+	if code := post(body); code != http.StatusOK {
+		t.Fatalf("Fail TestRequestHandler, wrong status %d\n", code)
+	}
+	recs, _ := deployHistory.Query(HistoryFilter{Outcome: JobSucceeded})
+	if len(recs) != 1 {
+		t.Fatalf("Fail TestRequestHandler, wrong records %+v\n", recs)
+	}
+	rec := recs[0]
+	if rec.Request != r || rec.Digest != digest || !strings.HasPrefix(rec.Signer, "release-key (SHA256:") {
+		t.Errorf("Fail TestRequestHandler, wrong record %+v\n", rec)
+	}
+}
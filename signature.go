@@ -0,0 +1,569 @@
+package main
+
+// signature module provides verification of signed tags and commits of
+// service repositories
+//
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SignaturePolicy represents signature policy of the service
+type SignaturePolicy struct {
+	Required bool     `json:"required"` // refuse deployment unless tag or commit has verified signature
+	Keys     []string `json:"keys"`     // trusted SSH public keys (authorized_keys format) used for offline verification
+	GPGKeys  []string `json:"gpgKeys"`  // files of trusted armored GPG public keys used for offline verification
+}
+
+// SignatureInfo represents signature of tag or commit reported by source provider
+type SignatureInfo struct {
+	Object    string // signed object: tag or commit
+	Verified  bool   // signature is verified by source provider
+	Reason    string // verification reason reported by source provider
+	Signer    string // signer identity reported by source provider
+	Key       string // signing key reported by source provider, e.g. GPG key id
+	Signature string // armored signature
+	Payload   string // signed payload
+}
+
+// SignatureProvider represents source provider which reports signatures of tags and commits
+type SignatureProvider interface {
+	Signatures(repo, tag, sha string) ([]SignatureInfo, error) // signatures of given tag and commit
+}
+
+// SSH signature namespace used by git
+const sshsigNamespace = "git"
+
+// helper function to check signature of the request according to service policy,
+// it returns identity of the signer. With trusted keys the signature is verified
+// offline and the signer is identified by the key, otherwise the signer is the
+// identity reported by source provider which verified the signature
+func checkSignature(r Request, policy ServicePolicy) (string, error) {
+	sp := policy.Signature
+	if sp == nil || !sp.Required {
+		return "", nil
+	}
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		return "", err
+	}
+	provider, ok := src.(SignatureProvider)
+	if !ok {
+		return "", fmt.Errorf("source provider of %s does not support signature verification", r.Repository)
+	}
+	sigs, err := provider.Signatures(r.Repository, r.Tag, r.Commit)
+	if err != nil {
+		return "", err
+	}
+	var reasons []string
+	for _, sig := range sigs {
+		if len(sp.Keys) > 0 || len(sp.GPGKeys) > 0 {
+			// offline verification against trusted keys
+			if sig.Signature == "" || sig.Payload == "" {
+				reasons = append(reasons, fmt.Sprintf("%s: no signature", sig.Object))
+				continue
+			}
+			signer, err := verifyOffline(sig, sp)
+			if err != nil {
+				reasons = append(reasons, fmt.Sprintf("%s: %v", sig.Object, err))
+				continue
+			}
+			return signer, nil
+		}
+		if sig.Verified {
+			return fmt.Sprintf("%s, verified by source provider", keyIdentity(sig.Signer, sig.Key)), nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", sig.Object, sig.Reason))
+	}
+	return "", fmt.Errorf("no verified signature of %s@%s (%s)", r.Repository, r.Tag, strings.Join(reasons, ", "))
+}
+
+// helper function to verify signature against trusted keys of signature policy
+func verifyOffline(sig SignatureInfo, sp *SignaturePolicy) (string, error) {
+	if strings.Contains(sig.Signature, "-----BEGIN PGP SIGNATURE-----") {
+		if len(sp.GPGKeys) == 0 {
+			return "", errors.New("no trusted GPG keys")
+		}
+		return verifyGPGSignature([]byte(sig.Payload), sig.Signature, sp.GPGKeys)
+	}
+	if len(sp.Keys) == 0 {
+		return "", errors.New("no trusted SSH keys")
+	}
+	return verifySSHSignature([]byte(sig.Payload), sig.Signature, sp.Keys)
+}
+
+// helper function to verify GPG signature of given payload against trusted
+// public keys with gpg using temporary keyring, it returns user id and
+// fingerprint of the key which made the signature
+func verifyGPGSignature(payload []byte, armored string, keyFiles []string) (string, error) {
+	dir, err := ioutil.TempDir("", "imagebot-gpg-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	args := append([]string{"--homedir", dir, "--batch", "--import"}, keyFiles...)
+	if _, err := runCommand("gpg", args...); err != nil {
+		return "", fmt.Errorf("unable to import trusted GPG keys, %v", err)
+	}
+	sigFile := filepath.Join(dir, "payload.sig")
+	dataFile := filepath.Join(dir, "payload")
+	if err := ioutil.WriteFile(sigFile, []byte(armored), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(dataFile, payload, 0600); err != nil {
+		return "", err
+	}
+	out, err := runCommand("gpg", "--homedir", dir, "--batch", "--status-fd", "1", "--verify", sigFile, dataFile)
+	var uid, fingerprint string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "GOODSIG":
+			uid = strings.Join(fields[3:], " ")
+		case "VALIDSIG":
+			// the last field is fingerprint of the primary key
+			fingerprint = fields[len(fields)-1]
+		}
+	}
+	if err != nil || uid == "" || fingerprint == "" {
+		return "", errors.New("signature is not made by trusted key")
+	}
+	return keyIdentity(uid, fingerprint), nil
+}
+
+// helper function to read SSH wire format string
+func sshString(data []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, errors.New("short ssh data")
+	}
+	size := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < size {
+		return nil, nil, errors.New("short ssh data")
+	}
+	return data[4 : 4+size], data[4+size:], nil
+}
+
+// helper function to write SSH wire format string
+func sshBytes(data []byte) []byte {
+	out := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	return append(out, data...)
+}
+
+// sshSignature represents SSH signature (sshsig) of git object
+type sshSignature struct {
+	publicKey []byte
+	namespace string
+	reserved  []byte
+	hashAlg   string
+	signature []byte
+}
+
+// helper function to parse armored SSH signature
+func parseSSHSignature(armored string) (sshSignature, error) {
+	var sig sshSignature
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, "-----BEGIN SSH SIGNATURE-----") {
+		return sig, errors.New("not an SSH signature")
+	}
+	var body string
+	for _, line := range strings.Split(armored, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-----") {
+			continue
+		}
+		body += line
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return sig, err
+	}
+	if !bytes.HasPrefix(data, []byte("SSHSIG")) || len(data) < 10 {
+		return sig, errors.New("invalid SSH signature")
+	}
+	if version := binary.BigEndian.Uint32(data[6:]); version != 1 {
+		return sig, fmt.Errorf("unsupported SSH signature version %d", version)
+	}
+	rest := data[10:]
+	var ns, alg []byte
+	fields := []*[]byte{&sig.publicKey, &ns, &sig.reserved, &alg, &sig.signature}
+	for _, f := range fields {
+		if *f, rest, err = sshString(rest); err != nil {
+			return sig, err
+		}
+	}
+	sig.namespace = string(ns)
+	sig.hashAlg = string(alg)
+	return sig, nil
+}
+
+// helper function to verify SSH signature of given payload against trusted
+// public keys, it returns comment and fingerprint of the key which made the signature
+func verifySSHSignature(payload []byte, armored string, keys []string) (string, error) {
+	sig, err := parseSSHSignature(armored)
+	if err != nil {
+		return "", err
+	}
+	if sig.namespace != sshsigNamespace {
+		return "", fmt.Errorf("wrong SSH signature namespace %s", sig.namespace)
+	}
+	var h hash.Hash
+	switch sig.hashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", fmt.Errorf("unsupported SSH signature hash %s", sig.hashAlg)
+	}
+	h.Write(payload)
+	var signed []byte
+	signed = append(signed, []byte("SSHSIG")...)
+	signed = append(signed, sshBytes([]byte(sig.namespace))...)
+	signed = append(signed, sshBytes(sig.reserved)...)
+	signed = append(signed, sshBytes([]byte(sig.hashAlg))...)
+	signed = append(signed, sshBytes(h.Sum(nil))...)
+
+	for _, key := range keys {
+		arr := strings.Fields(key)
+		if len(arr) < 2 {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(arr[1])
+		if err != nil || !bytes.Equal(blob, sig.publicKey) {
+			continue
+		}
+		if err := verifySSHBlob(blob, sig.signature, signed); err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(blob)
+		fingerprint := fmt.Sprintf("SHA256:%s", base64.RawStdEncoding.EncodeToString(sum[:]))
+		return keyIdentity(strings.Join(arr[2:], " "), fingerprint), nil
+	}
+	return "", errors.New("signature is not made by trusted key")
+}
+
+// helper function to verify SSH signature blob made by given public key blob
+func verifySSHBlob(pub, sig, data []byte) error {
+	keyType, rest, err := sshString(pub)
+	if err != nil {
+		return err
+	}
+	sigType, sigRest, err := sshString(sig)
+	if err != nil {
+		return err
+	}
+	sigBytes, _, err := sshString(sigRest)
+	if err != nil {
+		return err
+	}
+	switch string(keyType) {
+	case "ssh-ed25519":
+		key, _, err := sshString(rest)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return errors.New("invalid ed25519 public key")
+		}
+		if string(sigType) != "ssh-ed25519" || !ed25519.Verify(ed25519.PublicKey(key), data, sigBytes) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	case "ssh-rsa":
+		e, rest, err := sshString(rest)
+		if err != nil {
+			return err
+		}
+		n, _, err := sshString(rest)
+		if err != nil {
+			return err
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		switch string(sigType) {
+		case "rsa-sha2-512":
+			sum := sha512.Sum512(data)
+			return rsa.VerifyPKCS1v15(key, crypto.SHA512, sum[:], sigBytes)
+		case "rsa-sha2-256":
+			sum := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sigBytes)
+		}
+		return fmt.Errorf("unsupported rsa signature type %s", sigType)
+	}
+	return fmt.Errorf("unsupported SSH key type %s", keyType)
+}
+
+// helper function to format identity of signing key and its owner
+func keyIdentity(owner, key string) string {
+	if owner == "" {
+		return key
+	}
+	if key == "" {
+		return owner
+	}
+	return fmt.Sprintf("%s (%s)", owner, key)
+}
+
+// helper function to return fingerprint of SSH key or issuer of GPG key
+// which made given armored signature, it is empty if signature can't be parsed
+func signatureKey(armored string) string {
+	if sig, err := parseSSHSignature(armored); err == nil {
+		sum := sha256.Sum256(sig.publicKey)
+		return fmt.Sprintf("SHA256:%s", base64.RawStdEncoding.EncodeToString(sum[:]))
+	}
+	data, err := dearmorPGP(armored)
+	if err != nil {
+		return ""
+	}
+	return pgpIssuer(data)
+}
+
+// helper function to decode armored PGP signature
+func dearmorPGP(armored string) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(armored), "\n")
+	if len(lines) < 3 || strings.TrimSpace(lines[0]) != "-----BEGIN PGP SIGNATURE-----" {
+		return nil, errors.New("not a PGP signature")
+	}
+	var body string
+	headers := true
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		switch {
+		case headers:
+			// armor headers are separated from body by empty line
+			if line == "" || !strings.Contains(line, ":") {
+				headers = false
+				body += line
+			}
+		case strings.HasPrefix(line, "-----"):
+			return base64.StdEncoding.DecodeString(body)
+		case strings.HasPrefix(line, "="):
+			// checksum line
+		default:
+			body += line
+		}
+	}
+	return nil, errors.New("invalid PGP signature armor")
+}
+
+// helper function to return issuer of PGP signature packet, i.e. issuer
+// fingerprint or key id from its subpackets
+func pgpIssuer(data []byte) string {
+	if len(data) < 2 || data[0]&0x80 == 0 {
+		return ""
+	}
+	// skip packet header, new or old format
+	var body []byte
+	if data[0]&0x40 != 0 {
+		if data[0]&0x3f != 2 {
+			return ""
+		}
+		switch l := int(data[1]); {
+		case l < 192:
+			body = data[2:]
+		case l < 224 && len(data) > 2:
+			body = data[3:]
+		case l == 255 && len(data) > 5:
+			body = data[6:]
+		default:
+			return ""
+		}
+	} else {
+		size := 1 << (data[0] & 0x03)
+		if (data[0]>>2)&0x0f != 2 || size > 4 || len(data) < 1+size {
+			return ""
+		}
+		body = data[1+size:]
+	}
+	// version 4 signature: version, type, key and hash algorithms
+	// followed by hashed and unhashed subpackets
+	if len(body) < 6 || body[0] != 4 {
+		return ""
+	}
+	var keyID string
+	rest := body[4:]
+	for i := 0; i < 2 && len(rest) >= 2; i++ {
+		size := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 2+size {
+			return ""
+		}
+		sub := rest[2 : 2+size]
+		rest = rest[2+size:]
+		for len(sub) > 0 {
+			var l, off int
+			switch {
+			case sub[0] < 192:
+				l, off = int(sub[0]), 1
+			case sub[0] < 255 && len(sub) > 1:
+				l, off = (int(sub[0])-192)<<8+int(sub[1])+192, 2
+			case len(sub) > 4:
+				l, off = int(binary.BigEndian.Uint32(sub[1:])), 5
+			default:
+				return keyID
+			}
+			if l < 1 || len(sub) < off+l {
+				return keyID
+			}
+			typ, val := sub[off]&0x7f, sub[off+1:off+l]
+			sub = sub[off+l:]
+			switch {
+			case typ == 33 && len(val) > 1:
+				// issuer fingerprint: key version and fingerprint
+				return fmt.Sprintf("%X", val[1:])
+			case typ == 16 && len(val) == 8:
+				keyID = fmt.Sprintf("%X", val)
+			}
+		}
+	}
+	return keyID
+}
+
+// helper function to format identity of signer
+func signerIdentity(name, email string) string {
+	if email == "" {
+		return name
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+// Signatures implements SignatureProvider interface, tagger and committer of
+// GitHub objects are supplied by their authors, therefore signer is identified
+// by the key which made verified signature
+func (p *GitHubProvider) Signatures(repo, tag, sha string) ([]SignatureInfo, error) {
+	c := p.github()
+	var sigs []SignatureInfo
+	obj, err := p.refObject(repo, fmt.Sprintf("tags/%s", tag))
+	if err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	if obj.Type == "tag" {
+		var rec GitHubTag
+		rurl := fmt.Sprintf("%s/repos/%s/git/tags/%s", c.api(), repo, obj.Sha)
+		if err := c.get(rurl, &rec); err != nil {
+			return nil, err
+		}
+		v := rec.Verification
+		sigs = append(sigs, SignatureInfo{
+			Object: "tag", Verified: v.Verified, Reason: v.Reason,
+			Key:       signatureKey(v.Signature),
+			Signature: v.Signature, Payload: v.Payload,
+		})
+	}
+	var rec GitHubCommit
+	rurl := fmt.Sprintf("%s/repos/%s/git/commits/%s", c.api(), repo, sha)
+	if err := c.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	v := rec.Verification
+	sigs = append(sigs, SignatureInfo{
+		Object: "commit", Verified: v.Verified, Reason: v.Reason,
+		Key:       signatureKey(v.Signature),
+		Signature: v.Signature, Payload: v.Payload,
+	})
+	return sigs, nil
+}
+
+// GiteaVerification represents signature verification of gitea object
+type GiteaVerification struct {
+	Verified  bool   `json:"verified"`
+	Reason    string `json:"reason"`
+	Signature string `json:"signature"`
+	Payload   string `json:"payload"`
+	Signer    struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"signer"`
+}
+
+// helper function to convert gitea verification into signature info
+func (v GiteaVerification) info(object string) SignatureInfo {
+	return SignatureInfo{
+		Object: object, Verified: v.Verified, Reason: v.Reason,
+		Signer:    signerIdentity(v.Signer.Name, v.Signer.Email),
+		Signature: v.Signature, Payload: v.Payload,
+	}
+}
+
+// Signatures implements SignatureProvider interface
+func (p *GiteaProvider) Signatures(repo, tag, sha string) ([]SignatureInfo, error) {
+	var sigs []SignatureInfo
+	var t GiteaTag
+	rurl := fmt.Sprintf("%s/repos/%s/tags/%s", p.client.api(), repo, url.PathEscape(tag))
+	if err := p.client.get(rurl, &t); err != nil && !errors.Is(err, errNotFound) {
+		return nil, err
+	}
+	// tag id differs from commit sha for annotated tags only
+	if t.ID != "" && t.ID != t.Commit.Sha {
+		var rec struct {
+			Verification GiteaVerification `json:"verification"`
+		}
+		rurl := fmt.Sprintf("%s/repos/%s/git/tags/%s", p.client.api(), repo, t.ID)
+		if err := p.client.get(rurl, &rec); err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, rec.Verification.info("tag"))
+	}
+	var rec struct {
+		Commit struct {
+			Verification GiteaVerification `json:"verification"`
+		} `json:"commit"`
+	}
+	rurl = fmt.Sprintf("%s/repos/%s/git/commits/%s", p.client.api(), repo, url.PathEscape(sha))
+	if err := p.client.get(rurl, &rec); err != nil {
+		return nil, err
+	}
+	sigs = append(sigs, rec.Commit.Verification.info("commit"))
+	return sigs, nil
+}
+
+// Signatures implements SignatureProvider interface, GitLab reports
+// verification status of commit signatures only
+func (p *GitLabProvider) Signatures(repo, tag, sha string) ([]SignatureInfo, error) {
+	var rec struct {
+		SignatureType      string `json:"signature_type"`
+		VerificationStatus string `json:"verification_status"`
+		GpgKeyUserName     string `json:"gpg_key_user_name"`
+		GpgKeyUserEmail    string `json:"gpg_key_user_email"`
+		GpgKeyPrimaryKeyid string `json:"gpg_key_primary_keyid"`
+		Key                struct {
+			Title string `json:"title"`
+		} `json:"key"`
+	}
+	rurl := fmt.Sprintf("%s/repository/commits/%s/signature", p.project(repo), url.PathEscape(sha))
+	err := p.client.get(rurl, &rec)
+	if errors.Is(err, errNotFound) {
+		return []SignatureInfo{{Object: "commit", Reason: "unsigned"}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer := signerIdentity(rec.GpgKeyUserName, rec.GpgKeyUserEmail)
+	key := rec.GpgKeyPrimaryKeyid
+	if rec.SignatureType == "SSH" {
+		signer, key = "", rec.Key.Title
+	}
+	info := SignatureInfo{
+		Object:   "commit",
+		Verified: rec.VerificationStatus == "verified",
+		Reason:   rec.VerificationStatus,
+		Signer:   signer,
+		Key:      key,
+	}
+	return []SignatureInfo{info}, nil
+}
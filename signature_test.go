@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function to create armored SSH signature of given payload
+func testSSHSign(key ed25519.PrivateKey, payload string) string {
+	pub := key.Public().(ed25519.PublicKey)
+	pubBlob := append(sshBytes([]byte("ssh-ed25519")), sshBytes(pub)...)
+	sum := sha512.Sum512([]byte(payload))
+	var signed []byte
+	signed = append(signed, []byte("SSHSIG")...)
+	signed = append(signed, sshBytes([]byte("git"))...)
+	signed = append(signed, sshBytes(nil)...)
+	signed = append(signed, sshBytes([]byte("sha512"))...)
+	signed = append(signed, sshBytes(sum[:])...)
+	sigBlob := append(sshBytes([]byte("ssh-ed25519")), sshBytes(ed25519.Sign(key, signed))...)
+
+	data := []byte("SSHSIG\x00\x00\x00\x01")
+	data = append(data, sshBytes(pubBlob)...)
+	data = append(data, sshBytes([]byte("git"))...)
+	data = append(data, sshBytes(nil)...)
+	data = append(data, sshBytes([]byte("sha512"))...)
+	data = append(data, sshBytes(sigBlob)...)
+	body := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for len(body) > 70 {
+		lines = append(lines, body[:70])
+		body = body[70:]
+	}
+	lines = append(lines, body)
+	return fmt.Sprintf("-----BEGIN SSH SIGNATURE-----\n%s\n-----END SSH SIGNATURE-----\n", strings.Join(lines, "\n"))
+}
+
+// helper function to return authorized_keys entry of given key
+func testAuthorizedKey(key ed25519.PrivateKey, comment string) string {
+	pub := key.Public().(ed25519.PublicKey)
+	blob := append(sshBytes([]byte("ssh-ed25519")), sshBytes(pub)...)
+	return fmt.Sprintf("ssh-ed25519 %s %s", base64.StdEncoding.EncodeToString(blob), comment)
+}
+
+// TestSSHSignature
+func TestSSHSignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	payload := "object abc\ntype commit\ntag v1.0\n\nrelease v1.0\n"
+	sig := testSSHSign(key, payload)
+	signer, err := verifySSHSignature([]byte(payload), sig, []string{testAuthorizedKey(other, "other"), testAuthorizedKey(key, "dev@example.com")})
+	if err != nil || !strings.HasPrefix(signer, "dev@example.com (SHA256:") {
+		t.Errorf("Fail TestSSHSignature, signer %s error %v\n", signer, err)
+	}
+	if _, err := verifySSHSignature([]byte(payload+"x"), sig, []string{testAuthorizedKey(key, "dev")}); err == nil {
+		t.Errorf("Fail TestSSHSignature, modified payload is accepted\n")
+	}
+	if _, err := verifySSHSignature([]byte(payload), sig, []string{testAuthorizedKey(other, "other")}); err == nil {
+		t.Errorf("Fail TestSSHSignature, untrusted key is accepted\n")
+	}
+}
+
+// helper function to create GPG key in temporary keyring, it returns file of
+// armored public key and function to sign payload with the key
+func testGPGKey(t *testing.T, uid string) (string, func(payload string) string) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg is not available")
+	}
+	dir := t.TempDir()
+	gpg := func(args ...string) []byte {
+		cmd := exec.Command("gpg", append([]string{"--homedir", dir, "--batch", "--passphrase", ""}, args...)...)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %v: %v", args, err)
+		}
+		return out
+	}
+	gpg("--quick-gen-key", uid, "ed25519", "sign", "never")
+	keyFile := filepath.Join(dir, "key.asc")
+	ioutil.WriteFile(keyFile, gpg("--armor", "--export"), 0600)
+	sign := func(payload string) string {
+		fname := filepath.Join(dir, "payload")
+		ioutil.WriteFile(fname, []byte(payload), 0600)
+		return string(gpg("--armor", "--detach-sign", "-o", "-", fname))
+	}
+	return keyFile, sign
+}
+
+// TestGPGSignature
+func TestGPGSignature(t *testing.T) {
+	keyFile, sign := testGPGKey(t, "Release <release@example.com>")
+	otherFile, _ := testGPGKey(t, "Other <other@example.com>")
+	payload := "object abc\ntype commit\ntag v1.0\n\nrelease v1.0\n"
+	sig := sign(payload)
+	signer, err := verifyGPGSignature([]byte(payload), sig, []string{otherFile, keyFile})
+	if err != nil || !strings.HasPrefix(signer, "Release <release@example.com> (") {
+		t.Errorf("Fail TestGPGSignature, signer %s error %v\n", signer, err)
+	}
+	if key := signatureKey(sig); key == "" || !strings.HasSuffix(signer, "("+key+")") {
+		t.Errorf("Fail TestGPGSignature, signature key %s of signer %s\n", key, signer)
+	}
+	if _, err := verifyGPGSignature([]byte(payload+"x"), sig, []string{keyFile}); err == nil {
+		t.Errorf("Fail TestGPGSignature, modified payload is accepted\n")
+	}
+	if _, err := verifyGPGSignature([]byte(payload), sig, []string{otherFile}); err == nil {
+		t.Errorf("Fail TestGPGSignature, untrusted key is accepted\n")
+	}
+	policy := &SignaturePolicy{Required: true, Keys: []string{"ssh-ed25519 AAAA"}}
+	if _, err := verifyOffline(SignatureInfo{Signature: sig, Payload: payload}, policy); err == nil || !strings.Contains(err.Error(), "no trusted GPG keys") {
+		t.Errorf("Fail TestGPGSignature, GPG signature without trusted GPG keys, error %v\n", err)
+	}
+}
+
+// TestCheckSignature
+func TestCheckSignature(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	payload := "object 1130ebd\ntype commit\ntag v1.0\ntagger Dev <dev@example.com>\n\nv1.0\n"
+	verification, _ := json.Marshal(GitHubVerification{Verified: true, Reason: "valid", Signature: testSSHSign(key, payload), Payload: payload})
+	fakeGitHub(t, map[string]string{
+		"/repos/org/srv/git/refs/tags/v1.0":  `{"ref": "refs/tags/v1.0", "object": {"sha": "aaa", "type": "tag"}}`,
+		"/repos/org/srv/git/tags/aaa":        fmt.Sprintf(`{"tag": "v1.0", "sha": "aaa", "tagger": {"name": "Mallory", "email": "dev@example.com"}, "verification": %s}`, verification),
+		"/repos/org/srv/git/commits/1130ebd": `{"sha": "1130ebd", "verification": {"verified": false, "reason": "unsigned"}}`,
+		"/repos/org/srv/git/refs/tags/v2.0":  `{"ref": "refs/tags/v2.0", "object": {"sha": "1130ebd", "type": "commit"}}`,
+	})
+	r := Request{Service: "srv", Repository: "org/srv", Tag: "v1.0", Commit: "1130ebd"}
+	tests := []struct {
+		tag    string
+		policy SignaturePolicy
+		signer string
+		fail   bool
+	}{
+		{tag: "v1.0", policy: SignaturePolicy{Required: true}, signer: signatureKey(testSSHSign(key, payload)) + ", verified by source provider"},
+		{tag: "v1.0", policy: SignaturePolicy{Required: true, Keys: []string{testAuthorizedKey(key, "release-key")}}, signer: "release-key (SHA256:"},
+		{tag: "v2.0", policy: SignaturePolicy{Required: true}, fail: true},
+		{tag: "v2.0", policy: SignaturePolicy{}},
+	}
+	for _, tt := range tests {
+		r.Tag = tt.tag
+		policy := tt.policy
+		signer, err := checkSignature(r, ServicePolicy{Signature: &policy})
+		if tt.fail {
+			if err == nil || !strings.Contains(err.Error(), "unsigned") {
+				t.Errorf("Fail TestCheckSignature, tag %s wrong error %v\n", tt.tag, err)
+			}
+			continue
+		}
+		if err != nil || !strings.HasPrefix(signer, tt.signer) || strings.Contains(signer, "Mallory") {
+			t.Errorf("Fail TestCheckSignature, tag %s signer %s error %v\n", tt.tag, signer, err)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+// slsa module provides verification of SLSA build provenance attestations
+// of service images
+//
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SLSAPolicy represents build provenance policy of the service images
+type SLSAPolicy struct {
+	Required  bool     `json:"required"`  // refuse deployment unless image has verified provenance
+	Keys      []string `json:"keys"`      // trusted public keys of attestations, default cosign keys of the policy
+	Builders  []string `json:"builders"`  // trusted builder ids, trailing * matches any suffix
+	Workflows []string `json:"workflows"` // trusted workflow paths of the build, trailing * matches any suffix
+}
+
+// DSSEEnvelope represents DSSE envelope of in-toto attestation
+type DSSEEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// InTotoStatement represents in-toto statement with SLSA provenance predicate
+type InTotoStatement struct {
+	Type    string `json:"_type"`
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// SLSAMaterial represents source material of the build
+type SLSAMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// SLSAWorkflow represents workflow which started the build of SLSA v1 provenance
+type SLSAWorkflow struct {
+	Repository string `json:"repository"` // repository URL of the workflow
+	Ref        string `json:"ref"`        // git ref of the workflow
+	Path       string `json:"path"`       // workflow path within repository
+}
+
+// SLSAProvenance represents fields of SLSA v0.2 and v1 provenance predicates
+// used to verify the build
+type SLSAProvenance struct {
+	// SLSA v0.2
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	Invocation struct {
+		ConfigSource struct {
+			SLSAMaterial
+			EntryPoint string `json:"entryPoint"`
+		} `json:"configSource"`
+	} `json:"invocation"`
+
+	// SLSA v1
+	BuildDefinition struct {
+		ExternalParameters struct {
+			Workflow SLSAWorkflow `json:"workflow"`
+		} `json:"externalParameters"`
+		ResolvedDependencies []SLSAMaterial `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+	} `json:"runDetails"`
+}
+
+// in-toto payload type and SLSA predicate types
+const (
+	inTotoPayloadType = "application/vnd.in-toto+json"
+	slsaPredicateV02  = "https://slsa.dev/provenance/v0.2"
+	slsaPredicateV1   = "https://slsa.dev/provenance/v1"
+)
+
+// helper function to return DSSE pre-authentication encoding of the payload
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// helper function to return builder id of provenance
+func (p SLSAProvenance) builder() string {
+	if p.RunDetails.Builder.ID != "" {
+		return p.RunDetails.Builder.ID
+	}
+	return p.Builder.ID
+}
+
+// helper function to return source the build was invoked from and path of
+// the build workflow. Other materials, e.g. dependencies of the build, do not
+// identify the source and are not considered: v0.2 provenance provides it as
+// invocation config source, while v1 provenance provides workflow of external
+// parameters and its checkout among resolved dependencies
+func (p SLSAProvenance) source(predicateType string) (SLSAMaterial, string, error) {
+	if predicateType == slsaPredicateV02 {
+		src := p.Invocation.ConfigSource
+		if src.URI == "" {
+			return SLSAMaterial{}, "", errors.New("provenance has no config source")
+		}
+		return src.SLSAMaterial, src.EntryPoint, nil
+	}
+	w := p.BuildDefinition.ExternalParameters.Workflow
+	if w.Repository == "" {
+		return SLSAMaterial{}, "", errors.New("provenance has no workflow")
+	}
+	for _, m := range p.BuildDefinition.ResolvedDependencies {
+		uri := strings.TrimPrefix(m.URI, "git+")
+		arr := strings.SplitN(uri, "@", 2)
+		if sourceURL(arr[0]) != sourceURL(w.Repository) {
+			continue
+		}
+		if w.Ref != "" && len(arr) == 2 && arr[1] != w.Ref {
+			continue
+		}
+		return m, w.Path, nil
+	}
+	return SLSAMaterial{}, "", fmt.Errorf("provenance has no source dependency of workflow repository %s", w.Repository)
+}
+
+// helper function to normalize source repository URL for comparison
+func sourceURL(uri string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSuffix(uri, "/")), ".git")
+}
+
+// helper function to check if material refers to given repository of source
+// host and commit, e.g. git+https://github.com/org/srv@refs/tags/v1 with sha1 digest
+func (m SLSAMaterial) match(host, repo, commit string) bool {
+	if !sourceMatches(m.URI, host, repo) {
+		return false
+	}
+	for _, key := range []string{"sha1", "gitCommit"} {
+		if m.Digest[key] != "" && m.Digest[key] == commit {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if source URI refers to given repository of source
+// host, e.g. git+https://github.com/org/srv.git@refs/heads/main and
+// git@github.com:org/srv.git refer to org/srv of github.com
+func sourceMatches(uri, host, repo string) bool {
+	uri = strings.TrimPrefix(strings.ToLower(uri), "git+")
+	for _, scheme := range []string{"https://", "http://", "ssh://", "git://"} {
+		uri = strings.TrimPrefix(uri, scheme)
+	}
+	if strings.HasPrefix(uri, "git@") {
+		uri = strings.Replace(strings.TrimPrefix(uri, "git@"), ":", "/", 1)
+	}
+	uri = strings.SplitN(uri, "@", 2)[0]
+	uri = strings.TrimSuffix(strings.TrimSuffix(uri, "/"), ".git")
+	return host != "" && uri == strings.ToLower(host+"/"+repo)
+}
+
+// helper function to check if builder id or workflow path matches one of
+// trusted patterns
+func trusted(id string, patterns []string) bool {
+	for _, b := range patterns {
+		if id == b || (strings.HasSuffix(b, "*") && strings.HasPrefix(id, strings.TrimSuffix(b, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to verify DSSE envelope against trusted keys, it returns
+// statement of the envelope
+func verifyEnvelope(data []byte, keys []interface{}) (InTotoStatement, error) {
+	var st InTotoStatement
+	var env DSSEEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return st, errors.New("invalid DSSE envelope")
+	}
+	if env.PayloadType != inTotoPayloadType {
+		return st, fmt.Errorf("unsupported payload type %s", env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return st, errors.New("invalid DSSE payload")
+	}
+	pae := dssePAE(env.PayloadType, payload)
+	verified := false
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		for _, key := range keys {
+			if verifyPayload(key, pae, sig) {
+				verified = true
+			}
+		}
+	}
+	if !verified {
+		return st, errors.New("signature does not match trusted keys")
+	}
+	if err := json.Unmarshal(payload, &st); err != nil {
+		return st, errors.New("invalid in-toto statement")
+	}
+	return st, nil
+}
+
+// helper function to check provenance statement against the request and image digest
+func checkStatement(st InTotoStatement, r Request, digest, host string, sp *SLSAPolicy) error {
+	if st.PredicateType != slsaPredicateV02 && st.PredicateType != slsaPredicateV1 {
+		return fmt.Errorf("unsupported predicate type %s", st.PredicateType)
+	}
+	subject := false
+	for _, s := range st.Subject {
+		if "sha256:"+s.Digest["sha256"] == digest {
+			subject = true
+		}
+	}
+	if !subject {
+		return fmt.Errorf("attestation subject is not %s", digest)
+	}
+	var p SLSAProvenance
+	if err := json.Unmarshal(st.Predicate, &p); err != nil {
+		return errors.New("invalid provenance predicate")
+	}
+	if !trusted(p.builder(), sp.Builders) {
+		return fmt.Errorf("untrusted builder %s", p.builder())
+	}
+	src, workflow, err := p.source(st.PredicateType)
+	if err != nil {
+		return err
+	}
+	if !trusted(strings.TrimPrefix(workflow, "/"), sp.Workflows) {
+		return fmt.Errorf("untrusted workflow %s", workflow)
+	}
+	if !src.match(host, r.Repository, r.Commit) {
+		return fmt.Errorf("image is not built from %s@%s", r.Repository, r.Commit)
+	}
+	return nil
+}
+
+// helper function to check SLSA provenance of requested image according to
+// service policy, digest of the image is resolved unless it is provided
+func checkSLSA(r Request, policy ServicePolicy, digest string) error {
+	sp := policy.SLSA
+	if sp == nil || !sp.Required {
+		return nil
+	}
+	if len(sp.Builders) == 0 {
+		return errors.New("no trusted builders")
+	}
+	if len(sp.Workflows) == 0 {
+		return errors.New("no trusted workflows")
+	}
+	pems := sp.Keys
+	if len(pems) == 0 && policy.Cosign != nil {
+		pems = policy.Cosign.Keys
+	}
+	var keys []interface{}
+	for _, k := range pems {
+		key, err := parsePublicKey(k)
+		if err != nil {
+			return fmt.Errorf("invalid attestation key, error %v", err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return errors.New("no trusted attestation keys")
+	}
+	host, err := sourceHost(r, policy)
+	if err != nil {
+		return err
+	}
+	c, name := imageRegistry(r.Image)
+	if digest == "" {
+		if digest, err = c.ManifestDigest(name, r.Tag); err != nil {
+			return err
+		}
+	}
+	m, err := cosignArtifact(c, name, digest, "att")
+	if errors.Is(err, errImageNotFound) {
+		return fmt.Errorf("image %s@%s has no attestations", r.Image, digest)
+	}
+	if err != nil {
+		return err
+	}
+	var reasons []string
+	for _, layer := range m.Layers {
+		data, err := layerBlob(c, name, layer)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", layer.Digest, err))
+			continue
+		}
+		st, err := verifyEnvelope(data, keys)
+		if err == nil {
+			err = checkStatement(st, r, digest, host, sp)
+		}
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", layer.Digest, err))
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid SLSA provenance of %s@%s (%s)", r.Image, digest, strings.Join(reasons, ", "))
+}
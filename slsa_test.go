@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// helper function to create SLSA v0.2 provenance predicate
+func slsaPredicateV02Of(builder, repo, commit, workflow string) string {
+	return fmt.Sprintf(`{
+		"builder": {"id": "%s"},
+		"invocation": {"configSource": {"uri": "git+https://github.com/%s@refs/tags/0.1", "digest": {"sha1": "%s"}, "entryPoint": "%s"}},
+		"materials": [{"uri": "git+https://github.com/org/srv@refs/tags/0.1", "digest": {"sha1": "abc"}}]
+	}`, builder, repo, commit, workflow)
+}
+
+// helper function to create SLSA v1 provenance predicate
+func slsaPredicateV1Of(builder, repo, commit, workflow string) string {
+	return fmt.Sprintf(`{
+		"buildDefinition": {
+			"externalParameters": {"workflow": {"repository": "https://github.com/%s", "ref": "refs/tags/0.1", "path": "%s"}},
+			"resolvedDependencies": [
+				{"uri": "git+https://github.com/%s@refs/tags/0.1", "digest": {"gitCommit": "%s"}},
+				{"uri": "git+https://github.com/org/srv@refs/heads/main", "digest": {"gitCommit": "abc"}}
+			]
+		},
+		"runDetails": {"builder": {"id": "%s"}}
+	}`, repo, workflow, repo, commit, builder)
+}
+
+// helper function to create SLSA provenance attestation of image digest signed with given key
+func slsaAttestation(t *testing.T, reg *fakeRegistryServer, key *ecdsa.PrivateKey, digest, predicateType, predicate string) OCIManifest {
+	statement := fmt.Sprintf(`{
+		"_type": "https://in-toto.io/Statement/v0.1",
+		"subject": [{"name": "org/srv", "digest": {"sha256": "%s"}}],
+		"predicateType": "%s",
+		"predicate": %s
+	}`, strings.TrimPrefix(digest, "sha256:"), predicateType, predicate)
+	sum := sha256.Sum256(dssePAE(inTotoPayloadType, []byte(statement)))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := DSSEEnvelope{PayloadType: inTotoPayloadType, Payload: base64.StdEncoding.EncodeToString([]byte(statement))}
+	env.Signatures = append(env.Signatures, struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	}{Sig: base64.StdEncoding.EncodeToString(sig)})
+	data, _ := json.Marshal(env)
+	layer := reg.blob("application/vnd.dsse.envelope.v1+json", data)
+	return OCIManifest{Config: reg.blob("application/vnd.oci.image.config.v1+json", []byte("{}")), Layers: []OCIDescriptor{layer}}
+}
+
+// TestCheckSLSA
+func TestCheckSLSA(t *testing.T) {
+	reg := fakeRegistry(t)
+	key, pub := cosignKey(t)
+	other, _ := cosignKey(t)
+	builder := "https://github.com/slsa-framework/slsa-github-generator/.github/workflows/generator_container_slsa3.yml@refs/tags/v1.9.0"
+	config := reg.blob("application/vnd.oci.image.config.v1+json", []byte(`{"config": {}}`))
+	workflow := ".github/workflows/release.yml"
+	v02 := func(builder, repo, commit, workflow string) (string, string) {
+		return slsaPredicateV02, slsaPredicateV02Of(builder, repo, commit, workflow)
+	}
+	v1 := func(builder, repo, commit, workflow string) (string, string) {
+		return slsaPredicateV1, slsaPredicateV1Of(builder, repo, commit, workflow)
+	}
+	tests := []struct {
+		tag                             string
+		predicate                       func(builder, repo, commit, workflow string) (string, string)
+		builder, repo, commit, workflow string
+		key                             *ecdsa.PrivateKey
+		err                             string
+	}{
+		{"0.1", v02, builder, "org/srv", "abc", workflow, key, ""},
+		{"0.2", v02, builder, "org/srv", "abc", workflow, other, "does not match trusted keys"},
+		{"0.3", v02, "https://example.com/builder", "org/srv", "abc", workflow, key, "untrusted builder"},
+		{"0.4", v02, builder, "org/other", "abc", workflow, key, "is not built from org/srv@abc"},
+		{"0.5", v02, builder, "org/srv", "def", workflow, key, "is not built from org/srv@abc"},
+		{"0.6", nil, "", "", "", "", nil, "has no attestations"},
+		{"0.7", v02, builder, "org/srv", "abc", ".github/workflows/test.yml", key, "untrusted workflow"},
+		{"0.8", v1, builder, "org/srv", "abc", workflow, key, ""},
+		{"0.9", v1, builder, "org/other", "abc", workflow, key, "is not built from org/srv@abc"},
+		{"0.10", v1, builder, "org/srv", "abc", ".github/workflows/test.yml", key, "untrusted workflow"},
+	}
+	for idx, tt := range tests {
+		digest := reg.manifest("org/srv", []string{tt.tag}, OCIManifest{Config: config, Annotations: map[string]string{"v": tt.tag}})
+		if tt.key != nil {
+			predicateType, predicate := tt.predicate(tt.builder, tt.repo, tt.commit, tt.workflow)
+			reg.manifest("org/srv", []string{cosignTag(digest, "att")}, slsaAttestation(t, reg, tt.key, digest, predicateType, predicate))
+		}
+		policy := ServicePolicy{
+			Service: "srv",
+			Cosign:  &CosignPolicy{Keys: []string{pub}},
+			SLSA: &SLSAPolicy{
+				Required:  true,
+				Builders:  []string{"https://github.com/slsa-framework/slsa-github-generator/*"},
+				Workflows: []string{workflow},
+			},
+		}
+		r := Request{Service: "srv", Image: reg.host + "/org/srv", Tag: tt.tag, Repository: "org/srv", Commit: "abc"}
+		err := checkSLSA(r, policy, "")
+		if tt.err == "" && err != nil {
+			t.Errorf("Fail TestCheckSLSA, test %d, error %v\n", idx, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Fail TestCheckSLSA, test %d, wrong error %v\n", idx, err)
+		}
+	}
+}
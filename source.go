@@ -0,0 +1,427 @@
+package main
+
+// source module provides source code providers used to verify service
+// repositories: GitHub, GitLab, Gitea and Bitbucket
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceProvider represents source code hosting provider of service repositories
+type SourceProvider interface {
+	ResolveTag(repo, tag string) (string, error)       // resolve tag of the repository into commit SHA
+	ResolveBranch(repo, branch string) (string, error) // resolve branch of the repository into commit SHA
+	VerifyCommit(repo, sha string) (string, error)     // verify commit exists in the repository and return its full SHA
+}
+
+// SourceConfig represents configuration of source provider
+type SourceConfig struct {
+	Name         string   `json:"name"`         // provider name used by service policies
+	Type         string   `json:"type"`         // provider type: github, gitlab, gitea or bitbucket
+	URL          string   `json:"url"`          // provider API URL
+	Token        string   `json:"token"`        // provider access token
+	Username     string   `json:"username"`     // user name for basic authentication, e.g. Bitbucket app password user
+	Timeout      int      `json:"timeout"`      // HTTP timeout in seconds, default 30
+	Repositories []string `json:"repositories"` // repository prefixes served by provider, e.g. org/ or group/subgroup/
+}
+
+// source represents configured source provider
+type source struct {
+	config   SourceConfig
+	provider SourceProvider
+}
+
+// sources keeps configured source providers
+var sources []source
+
+// helper function to create source provider of given configuration
+func newSourceProvider(config SourceConfig) (SourceProvider, error) {
+	switch config.Type {
+	case "github":
+		client, err := newGitHubClient(GitHubConfig{
+			URL:      config.URL,
+			Token:    config.Token,
+			Username: config.Username,
+			Timeout:  config.Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &GitHubProvider{client: client}, nil
+	case "gitlab":
+		if config.URL == "" {
+			config.URL = "https://gitlab.com/api/v4"
+		}
+		return &GitLabProvider{client: newSourceClient(config)}, nil
+	case "gitea":
+		if config.URL == "" {
+			return nil, fmt.Errorf("gitea provider %s requires url", config.Name)
+		}
+		return &GiteaProvider{client: newSourceClient(config)}, nil
+	case "bitbucket":
+		if config.URL == "" {
+			config.URL = "https://api.bitbucket.org/2.0"
+		}
+		return &BitbucketProvider{client: newSourceClient(config)}, nil
+	}
+	return nil, fmt.Errorf("unknown source provider type %s", config.Type)
+}
+
+// SourceClient represents HTTP client of source provider API, unlike GitHub
+// client it does not rely on GitHub specific headers and rate limits
+type SourceClient struct {
+	config SourceConfig
+	client *http.Client
+}
+
+// number of retries of failed source provider requests
+const sourceRetries = 3
+
+// sourceSleep is used to wait between retries of source provider requests
+var sourceSleep = time.Sleep
+
+// helper function to create source provider client of given configuration
+func newSourceClient(config SourceConfig) *SourceClient {
+	timeout := 30 * time.Second
+	if config.Timeout > 0 {
+		timeout = time.Duration(config.Timeout) * time.Second
+	}
+	return &SourceClient{config: config, client: &http.Client{Timeout: timeout}}
+}
+
+// helper function to return source provider API URL
+func (c *SourceClient) api() string {
+	return strings.TrimSuffix(c.config.URL, "/")
+}
+
+// helper function to get source provider API end-point and decode its JSON
+// response, failed or throttled (status 429) requests are retried with backoff
+func (c *SourceClient) get(rurl string, rec interface{}) error {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", rurl, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		if c.config.Username != "" {
+			req.SetBasicAuth(c.config.Username, c.config.Token)
+		} else if c.config.Token != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.Token))
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if attempt < sourceRetries {
+				log.Printf("source request %s failed, error %v, retry in %v", rurl, err, backoff)
+				sourceSleep(backoff)
+				backoff *= 2
+				continue
+			}
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if Config.Verbose > 0 {
+			log.Println("request GET", rurl, "status", resp.StatusCode, "response", string(body))
+		}
+		if (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) && attempt < sourceRetries {
+			wait := backoff
+			if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+				wait = time.Duration(sec) * time.Second
+			}
+			log.Printf("source request %s returned status %d, retry in %v", rurl, resp.StatusCode, wait)
+			sourceSleep(wait)
+			backoff *= 2
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s: %w", rurl, errNotFound)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned status %d", rurl, resp.StatusCode)
+		}
+		return json.Unmarshal(body, rec)
+	}
+}
+
+// helper function to setup source providers of given configurations
+func setupSources(configs []SourceConfig) error {
+	var out []source
+	for _, c := range configs {
+		p, err := newSourceProvider(c)
+		if err != nil {
+			return err
+		}
+		out = append(out, source{config: c, provider: p})
+	}
+	sources = out
+	return nil
+}
+
+// helper function to find source provider of the request, the provider is
+// chosen by name in service policy, by repository prefix or GitHub is used
+func sourceProvider(r Request, policy ServicePolicy) (SourceProvider, error) {
+	if policy.Provider != "" {
+		for _, s := range sources {
+			if s.config.Name == policy.Provider {
+				return s.provider, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown source provider %s", policy.Provider)
+	}
+	for _, s := range sources {
+		for _, prefix := range s.config.Repositories {
+			// prefix matches whole path segments, e.g. org/ but not org-tools/
+			prefix = strings.TrimSuffix(prefix, "/")
+			if r.Repository == prefix || strings.HasPrefix(r.Repository, prefix+"/") {
+				return s.provider, nil
+			}
+		}
+	}
+	return &GitHubProvider{}, nil
+}
+
+// helper function to return web host of source provider of the request which
+// is used in source URLs of images, e.g. github.com for GitHub API
+// https://api.github.com or gitlab.example.com for GitLab API
+// https://gitlab.example.com/api/v4
+func sourceHost(r Request, policy ServicePolicy) (string, error) {
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		return "", err
+	}
+	var api string
+	switch p := src.(type) {
+	case *GitHubProvider:
+		api = githubAPI
+		if c := p.github(); c != nil {
+			api = c.api()
+		}
+	case *GitLabProvider:
+		api = p.client.api()
+	case *GiteaProvider:
+		api = p.client.api()
+	case *BitbucketProvider:
+		api = p.client.api()
+	}
+	u, err := url.Parse(api)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("unable to determine host of source provider of %s", r.Repository)
+	}
+	return strings.ToLower(strings.TrimPrefix(u.Host, "api.")), nil
+}
+
+// helper function to get commit of the request, the request tag is looked up
+// among repository tags and, if service policy allows, among its branches;
+// policy may also allow request commit which is not referenced by any ref
+func getCommit(r Request) (string, error) {
+	policy := findPolicy(r)
+	src, err := sourceProvider(r, policy)
+	if err != nil {
+		return "", err
+	}
+	sha, err := src.ResolveTag(r.Repository, r.Tag)
+	if errors.Is(err, errNotFound) && policy.AllowBranches {
+		sha, err = src.ResolveBranch(r.Repository, r.Tag)
+	}
+	if errors.Is(err, errNotFound) && policy.AllowCommits && r.Commit != "" {
+		// request tag should be the commit itself or its short form
+		tag, commit := strings.ToLower(r.Tag), strings.ToLower(r.Commit)
+		if len(tag) < minCommitPrefix || !strings.HasPrefix(commit, tag) {
+			return "", fmt.Errorf("tag %s is neither a ref of %s nor commit %s", r.Tag, r.Repository, r.Commit)
+		}
+		if sha, err = src.VerifyCommit(r.Repository, r.Commit); err != nil {
+			return "", err
+		}
+		return sha, ownCommit(src, r.Repository, policy, sha)
+	}
+	return sha, err
+}
+
+// min length of short commit SHA used as request tag
+const minCommitPrefix = 7
+
+// helper function to check that commit belongs to the repository itself, i.e.
+// it is reachable from default branch or protected branches of the service
+// policy. GitHub and GitLab serve commits of forks via API of the parent
+// repository since they share git objects, other providers keep forks in
+// separate repositories
+func ownCommit(src SourceProvider, repo string, policy ServicePolicy, sha string) error {
+	provider, ok := src.(AncestryProvider)
+	if !ok {
+		return nil
+	}
+	branch, err := provider.DefaultBranch(repo)
+	if err != nil {
+		return err
+	}
+	branches := []string{branch}
+	if bp := policy.Protected; bp != nil {
+		protected, err := bp.protected(func() ([]string, error) { return provider.Branches(repo) })
+		if err != nil {
+			return err
+		}
+		branches = append(branches, protected...)
+	}
+	seen := make(map[string]bool)
+	for _, branch := range branches {
+		if seen[branch] {
+			continue
+		}
+		seen[branch] = true
+		ok, err := provider.IsAncestor(repo, sha, branch)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("commit %s is not reachable from %s branches of %s, it may belong to a fork", sha, strings.Join(branches, ", "), repo)
+}
+
+// GitLabProvider represents GitLab source provider
+type GitLabProvider struct {
+	client *SourceClient
+}
+
+// GitLabCommit represents GitLab commit
+type GitLabCommit struct {
+	ID string `json:"id"`
+}
+
+// GitLabRef represents GitLab tag or branch
+type GitLabRef struct {
+	Name   string       `json:"name"`
+	Commit GitLabCommit `json:"commit"`
+}
+
+// helper function to return GitLab project URL
+func (p *GitLabProvider) project(repo string) string {
+	return fmt.Sprintf("%s/projects/%s", p.client.api(), url.PathEscape(repo))
+}
+
+// ResolveTag implements SourceProvider interface
+func (p *GitLabProvider) ResolveTag(repo, tag string) (string, error) {
+	var rec GitLabRef
+	rurl := fmt.Sprintf("%s/repository/tags/%s", p.project(repo), url.PathEscape(tag))
+	err := p.client.get(rurl, &rec)
+	return rec.Commit.ID, err
+}
+
+// ResolveBranch implements SourceProvider interface
+func (p *GitLabProvider) ResolveBranch(repo, branch string) (string, error) {
+	var rec GitLabRef
+	rurl := fmt.Sprintf("%s/repository/branches/%s", p.project(repo), url.PathEscape(branch))
+	err := p.client.get(rurl, &rec)
+	return rec.Commit.ID, err
+}
+
+// VerifyCommit implements SourceProvider interface
+func (p *GitLabProvider) VerifyCommit(repo, sha string) (string, error) {
+	var rec GitLabCommit
+	rurl := fmt.Sprintf("%s/repository/commits/%s", p.project(repo), url.PathEscape(sha))
+	err := p.client.get(rurl, &rec)
+	return rec.ID, err
+}
+
+// GiteaProvider represents Gitea source provider
+type GiteaProvider struct {
+	client *SourceClient
+}
+
+// GiteaTag represents Gitea tag
+type GiteaTag struct {
+	Name   string `json:"name"`
+	ID     string `json:"id"`
+	Commit struct {
+		Sha string `json:"sha"`
+	} `json:"commit"`
+}
+
+// GiteaBranch represents Gitea branch
+type GiteaBranch struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+// ResolveTag implements SourceProvider interface
+func (p *GiteaProvider) ResolveTag(repo, tag string) (string, error) {
+	var rec GiteaTag
+	rurl := fmt.Sprintf("%s/repos/%s/tags/%s", p.client.api(), repo, url.PathEscape(tag))
+	err := p.client.get(rurl, &rec)
+	return rec.Commit.Sha, err
+}
+
+// ResolveBranch implements SourceProvider interface
+func (p *GiteaProvider) ResolveBranch(repo, branch string) (string, error) {
+	var rec GiteaBranch
+	rurl := fmt.Sprintf("%s/repos/%s/branches/%s", p.client.api(), repo, url.PathEscape(branch))
+	err := p.client.get(rurl, &rec)
+	return rec.Commit.ID, err
+}
+
+// VerifyCommit implements SourceProvider interface
+func (p *GiteaProvider) VerifyCommit(repo, sha string) (string, error) {
+	var rec GitHubCommit
+	rurl := fmt.Sprintf("%s/repos/%s/git/commits/%s", p.client.api(), repo, url.PathEscape(sha))
+	err := p.client.get(rurl, &rec)
+	return rec.Sha, err
+}
+
+// BitbucketProvider represents Bitbucket Cloud source provider
+type BitbucketProvider struct {
+	client *SourceClient
+}
+
+// BitbucketRef represents Bitbucket tag or branch
+type BitbucketRef struct {
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// ResolveTag implements SourceProvider interface
+func (p *BitbucketProvider) ResolveTag(repo, tag string) (string, error) {
+	var rec BitbucketRef
+	rurl := fmt.Sprintf("%s/repositories/%s/refs/tags/%s", p.client.api(), repo, url.PathEscape(tag))
+	err := p.client.get(rurl, &rec)
+	return rec.Target.Hash, err
+}
+
+// ResolveBranch implements SourceProvider interface
+func (p *BitbucketProvider) ResolveBranch(repo, branch string) (string, error) {
+	var rec BitbucketRef
+	rurl := fmt.Sprintf("%s/repositories/%s/refs/branches/%s", p.client.api(), repo, url.PathEscape(branch))
+	err := p.client.get(rurl, &rec)
+	return rec.Target.Hash, err
+}
+
+// VerifyCommit implements SourceProvider interface
+func (p *BitbucketProvider) VerifyCommit(repo, sha string) (string, error) {
+	var rec struct {
+		Hash string `json:"hash"`
+	}
+	rurl := fmt.Sprintf("%s/repositories/%s/commit/%s", p.client.api(), repo, url.PathEscape(sha))
+	err := p.client.get(rurl, &rec)
+	return rec.Hash, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// helper function to serve fake source provider API with given recorded responses
+func fakeSource(t *testing.T, responses map[string]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.EscapedPath()]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "404 Not Found"}`))
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// TestSourceProviders
+func TestSourceProviders(t *testing.T) {
+	sha := "4c2d1a0f6b8e9d7c5a3b1f2e0d9c8b7a6f5e4d3c"
+	gitlab := fakeSource(t, map[string]string{
+		"/api/v4/projects/group%2Fsub%2Fsrv/repository/tags/v1.0":     `{"name": "v1.0", "target": "8d1e", "commit": {"id": "` + sha + `"}}`,
+		"/api/v4/projects/group%2Fsub%2Fsrv/repository/branches/main": `{"name": "main", "commit": {"id": "` + sha + `"}}`,
+		"/api/v4/projects/group%2Fsub%2Fsrv/repository/commits/4c2d1": `{"id": "` + sha + `", "short_id": "4c2d1a0f"}`,
+	})
+	gitea := fakeSource(t, map[string]string{
+		"/api/v1/repos/org/srv/tags/v1.0":         `{"name": "v1.0", "id": "8d1e", "commit": {"sha": "` + sha + `"}}`,
+		"/api/v1/repos/org/srv/branches/main":     `{"name": "main", "commit": {"id": "` + sha + `"}}`,
+		"/api/v1/repos/org/srv/git/commits/4c2d1": `{"sha": "` + sha + `"}`,
+	})
+	bitbucket := fakeSource(t, map[string]string{
+		"/2.0/repositories/team/srv/refs/tags/v1.0":     `{"name": "v1.0", "type": "tag", "target": {"hash": "` + sha + `"}}`,
+		"/2.0/repositories/team/srv/refs/branches/main": `{"name": "main", "type": "branch", "target": {"hash": "` + sha + `"}}`,
+		"/2.0/repositories/team/srv/commit/4c2d1":       `{"hash": "` + sha + `"}`,
+	})
+	tests := []struct {
+		config SourceConfig
+		repo   string
+	}{
+		{SourceConfig{Type: "gitlab", URL: gitlab.URL + "/api/v4"}, "group/sub/srv"},
+		{SourceConfig{Type: "gitea", URL: gitea.URL + "/api/v1"}, "org/srv"},
+		{SourceConfig{Type: "bitbucket", URL: bitbucket.URL + "/2.0", Username: "bot", Token: "secret"}, "team/srv"},
+	}
+	for _, tt := range tests {
+		p, err := newSourceProvider(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out, err := p.ResolveTag(tt.repo, "v1.0"); err != nil || out != sha {
+			t.Errorf("Fail TestSourceProviders, %s tag %s %v\n", tt.config.Type, out, err)
+		}
+		if out, err := p.ResolveBranch(tt.repo, "main"); err != nil || out != sha {
+			t.Errorf("Fail TestSourceProviders, %s branch %s %v\n", tt.config.Type, out, err)
+		}
+		if out, err := p.VerifyCommit(tt.repo, "4c2d1"); err != nil || out != sha {
+			t.Errorf("Fail TestSourceProviders, %s commit %s %v\n", tt.config.Type, out, err)
+		}
+		if _, err := p.ResolveTag(tt.repo, "v2.0"); !errors.Is(err, errNotFound) {
+			t.Errorf("Fail TestSourceProviders, %s unknown tag error %v\n", tt.config.Type, err)
+		}
+	}
+}
+
+// TestSourceSelection
+func TestSourceSelection(t *testing.T) {
+	defer setupSources(nil)
+	err := setupSources([]SourceConfig{
+		{Name: "gitlab", Type: "gitlab", Repositories: []string{"group/"}},
+		{Name: "gitea", Type: "gitea", URL: "https://gitea.test/api/v1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		repo, provider string
+		expect, host   string
+	}{
+		{repo: "group/srv", expect: "*main.GitLabProvider", host: "gitlab.com"},
+		{repo: "org/srv", expect: "*main.GitHubProvider", host: "github.com"},
+		{repo: "group-tools/srv", expect: "*main.GitHubProvider", host: "github.com"},
+		{repo: "group/srv", provider: "gitea", expect: "*main.GiteaProvider", host: "gitea.test"},
+	}
+	for _, tt := range tests {
+		r := Request{Repository: tt.repo}
+		p, err := sourceProvider(r, ServicePolicy{Provider: tt.provider})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := fmt.Sprintf("%T", p); out != tt.expect {
+			t.Errorf("Fail TestSourceSelection, repository %s provider %s, expect %s\n", tt.repo, out, tt.expect)
+		}
+		if host, err := sourceHost(r, ServicePolicy{Provider: tt.provider}); err != nil || host != tt.host {
+			t.Errorf("Fail TestSourceSelection, repository %s host %s, expect %s, error %v\n", tt.repo, host, tt.host, err)
+		}
+	}
+	if _, err := sourceProvider(Request{}, ServicePolicy{Provider: "xxx"}); err == nil {
+		t.Errorf("Fail TestSourceSelection, unknown provider is accepted\n")
+	}
+}
+
+// TestSourceClient
+func TestSourceClient(t *testing.T) {
+	sourceSleep = func(d time.Duration) {}
+	defer func() { sourceSleep = time.Sleep }()
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if accept := r.Header.Get("Accept"); accept != "application/json" {
+			t.Errorf("Fail TestSourceClient, wrong accept header %s\n", accept)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("Fail TestSourceClient, wrong authorization %s\n", auth)
+		}
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"id": "abc"}`))
+	}))
+	defer ts.Close()
+	c := newSourceClient(SourceConfig{URL: ts.URL, Token: "secret"})
+	var rec GitLabCommit
+	if err := c.get(ts.URL+"/commit", &rec); err != nil || rec.ID != "abc" || calls != 2 {
+		t.Errorf("Fail TestSourceClient, commit %s calls %d error %v\n", rec.ID, calls, err)
+	}
+}
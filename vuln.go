@@ -0,0 +1,270 @@
+package main
+
+// vuln module provides vulnerability gate of service images based on scan
+// reports attached to images in the registry
+//
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// VulnPolicy represents vulnerability policy of the service images
+type VulnPolicy struct {
+	Thresholds    map[string]int `json:"thresholds"`    // max number of vulnerabilities per severity, e.g. {"CRITICAL": 0}
+	Allowlist     []string       `json:"allowlist"`     // accepted vulnerability ids, e.g. CVE-2023-1234
+	Mode          string         `json:"mode"`          // reject (default) or warn
+	Required      bool           `json:"required"`      // refuse images without scan report
+	ArtifactTypes []string       `json:"artifactTypes"` // artifact types of scan reports, default Trivy and Grype reports
+}
+
+// Vulnerability represents vulnerability of the scan report
+type Vulnerability struct {
+	ID       string // vulnerability id
+	Severity string // severity in upper case, e.g. CRITICAL
+	Package  string // affected package
+}
+
+// default artifact types of scan reports
+var reportArtifactTypes = []string{
+	"application/vnd.aquasecurity.trivy.report+json",
+	"application/vnd.anchore.grype.report+json",
+	"application/vnd.cncf.notary.vuln.report+json",
+}
+
+// errUnparseableReports is returned when none of scan reports of the image can be parsed
+var errUnparseableReports = errors.New("unparseable scan reports")
+
+// order of vulnerability severities in summaries
+var severities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+// Referrers returns referrers of the manifest with given digest via OCI
+// referrers API, registries without referrers API are queried via referrers tag
+func (c *RegistryClient) Referrers(name, digest string) ([]OCIDescriptor, error) {
+	accept := []string{"application/vnd.oci.image.index.v1+json"}
+	resp, err := c.do("GET", name, "referrers/"+digest, accept)
+	if err != nil {
+		return nil, err
+	}
+	var index OCIManifest
+	if resp.StatusCode == http.StatusOK {
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+			return nil, err
+		}
+		return index.Manifests, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		return nil, c.check(resp, name, digest)
+	}
+	// fallback to referrers tag schema, e.g. sha256-<hex>
+	_, data, err := c.Manifest(name, strings.Replace(digest, ":", "-", 1))
+	if errors.Is(err, errImageNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
+
+// helper function to parse Trivy or Grype JSON report into list of vulnerabilities
+func parseReport(data []byte) ([]Vulnerability, error) {
+	var rec struct {
+		// Trivy report
+		SchemaVersion int `json:"SchemaVersion"`
+		Results       []struct {
+			Vulnerabilities []struct {
+				VulnerabilityID string `json:"VulnerabilityID"`
+				PkgName         string `json:"PkgName"`
+				Severity        string `json:"Severity"`
+			} `json:"Vulnerabilities"`
+		} `json:"Results"`
+		// Grype report
+		Matches []struct {
+			Vulnerability struct {
+				ID       string `json:"id"`
+				Severity string `json:"severity"`
+			} `json:"vulnerability"`
+			Artifact struct {
+				Name string `json:"name"`
+			} `json:"artifact"`
+		} `json:"matches"`
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.SchemaVersion == 0 && rec.Results == nil && rec.Matches == nil {
+		return nil, errors.New("unknown scan report format")
+	}
+	var out []Vulnerability
+	for _, res := range rec.Results {
+		for _, v := range res.Vulnerabilities {
+			out = append(out, Vulnerability{ID: v.VulnerabilityID, Severity: strings.ToUpper(v.Severity), Package: v.PkgName})
+		}
+	}
+	for _, m := range rec.Matches {
+		out = append(out, Vulnerability{ID: m.Vulnerability.ID, Severity: strings.ToUpper(m.Vulnerability.Severity), Package: m.Artifact.Name})
+	}
+	return out, nil
+}
+
+// helper function to fetch vulnerabilities of all scan reports attached to
+// the image. Anyone with push access may attach a report, e.g. a newer clean
+// one, therefore reports are not picked by their annotations and the image
+// is evaluated against vulnerabilities of all of them. Every layer of report
+// artifact is parsed and reports without parseable layer are skipped, it
+// returns number of skipped reports; errImageNotFound is returned if image has
+// no scan report and errUnparseableReports if all reports are skipped
+func scanReports(c *RegistryClient, name, digest string, types []string) ([]Vulnerability, int, error) {
+	refs, err := c.Referrers(name, digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	var reports []OCIDescriptor
+	for _, ref := range refs {
+		for _, t := range types {
+			if ref.ArtifactType == t {
+				reports = append(reports, ref)
+				break
+			}
+		}
+	}
+	if len(reports) == 0 {
+		return nil, 0, errImageNotFound
+	}
+	var out []Vulnerability
+	skipped := 0
+	for _, ref := range reports {
+		_, data, err := c.Manifest(name, ref.Digest)
+		if err != nil {
+			return nil, 0, err
+		}
+		var m OCIManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Printf("unable to parse scan report %s of %s, error %v", ref.Digest, name, err)
+			skipped++
+			continue
+		}
+		parsed := false
+		for _, layer := range m.Layers {
+			blob, err := layerBlob(c, name, layer)
+			if err != nil {
+				return nil, 0, err
+			}
+			vulns, err := parseReport(blob)
+			if err != nil {
+				log.Printf("unable to parse layer %s of scan report %s of %s, error %v", layer.Digest, ref.Digest, name, err)
+				continue
+			}
+			parsed = true
+			out = append(out, vulns...)
+		}
+		if !parsed {
+			skipped++
+		}
+	}
+	if skipped == len(reports) {
+		return nil, skipped, fmt.Errorf("%w: %d scan reports of %s@%s", errUnparseableReports, skipped, name, digest)
+	}
+	return out, skipped, nil
+}
+
+// helper function to evaluate vulnerabilities against thresholds and allowlist
+// of the policy, it returns summary of vulnerabilities and list of violations
+func evaluateVulns(vulns []Vulnerability, vp *VulnPolicy) (string, []string) {
+	allowed := make(map[string]bool)
+	for _, id := range vp.Allowlist {
+		allowed[strings.ToUpper(id)] = true
+	}
+	seen := make(map[string]bool)
+	ids := make(map[string][]string)
+	for _, v := range vulns {
+		key := v.ID + "/" + v.Package
+		if allowed[strings.ToUpper(v.ID)] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		sev := v.Severity
+		if sev == "" || sev == "NEGLIGIBLE" {
+			sev = "UNKNOWN"
+		}
+		ids[sev] = append(ids[sev], v.ID)
+	}
+	var summary, violations []string
+	for _, sev := range severities {
+		if len(ids[sev]) > 0 {
+			summary = append(summary, fmt.Sprintf("%s: %d", sev, len(ids[sev])))
+		}
+		max, ok := vp.Thresholds[sev]
+		if !ok {
+			max, ok = vp.Thresholds[strings.ToLower(sev)]
+		}
+		if ok && len(ids[sev]) > max {
+			list := ids[sev]
+			if len(list) > 5 {
+				list = append(append([]string{}, list[:5]...), "...")
+			}
+			violations = append(violations, fmt.Sprintf("%d %s vulnerabilities exceed threshold %d (%s)", len(ids[sev]), sev, max, strings.Join(list, ", ")))
+		}
+	}
+	if len(summary) == 0 {
+		return "no vulnerabilities", violations
+	}
+	return strings.Join(summary, ", "), violations
+}
+
+// helper function to check vulnerabilities of requested image according to
+// service policy, it returns summary of vulnerabilities reported in the job,
+// in warn mode violations are only reported in the summary, as well as skipped
+// unparseable reports
+func checkVulns(r Request, policy ServicePolicy, digest string) (string, error) {
+	vp := policy.Vulnerabilities
+	if vp == nil {
+		return "", nil
+	}
+	c, name := imageRegistry(r.Image)
+	if digest == "" {
+		var err error
+		if digest, err = c.ManifestDigest(name, r.Tag); err != nil {
+			return "", err
+		}
+	}
+	types := vp.ArtifactTypes
+	if len(types) == 0 {
+		types = reportArtifactTypes
+	}
+	vulns, skipped, err := scanReports(c, name, digest, types)
+	if errors.Is(err, errImageNotFound) {
+		if vp.Required {
+			return "", fmt.Errorf("image %s@%s has no scan report", r.Image, digest)
+		}
+		return "", nil
+	}
+	if errors.Is(err, errUnparseableReports) && !vp.Required {
+		return fmt.Sprintf("WARNING, %v", err), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	summary, violations := evaluateVulns(vulns, vp)
+	if len(violations) > 0 {
+		msg := fmt.Sprintf("image %s has vulnerabilities: %s", imageRef(r.Image, r.Tag), strings.Join(violations, "; "))
+		if vp.Mode != "warn" {
+			return "", errors.New(msg)
+		}
+		summary = "WARNING, " + msg
+	}
+	if skipped > 0 {
+		summary = strings.TrimPrefix(fmt.Sprintf("%s, %d unparseable scan reports skipped", summary, skipped), ", ")
+	}
+	return summary, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// trivy and grype reports used in tests
+const (
+	trivyReport = `{"SchemaVersion": 2, "Results": [{"Target": "srv", "Vulnerabilities": [
+		{"VulnerabilityID": "CVE-2023-0001", "PkgName": "openssl", "Severity": "CRITICAL"},
+		{"VulnerabilityID": "CVE-2023-0002", "PkgName": "zlib", "Severity": "HIGH"},
+		{"VulnerabilityID": "CVE-2023-0002", "PkgName": "zlib", "Severity": "HIGH"}
+	]}]}`
+	grypeReport = `{"matches": [
+		{"vulnerability": {"id": "CVE-2023-0003", "severity": "Critical"}, "artifact": {"name": "glibc"}},
+		{"vulnerability": {"id": "CVE-2023-0004", "severity": "Low"}, "artifact": {"name": "bash"}}
+	]}`
+)
+
+// TestEvaluateVulns
+func TestEvaluateVulns(t *testing.T) {
+	vulns, err := parseReport([]byte(trivyReport))
+	if err != nil || len(vulns) != 3 {
+		t.Fatalf("Fail TestEvaluateVulns, wrong trivy report %+v, error %v\n", vulns, err)
+	}
+	grype, err := parseReport([]byte(grypeReport))
+	if err != nil || len(grype) != 2 || grype[0].Severity != "CRITICAL" {
+		t.Fatalf("Fail TestEvaluateVulns, wrong grype report %+v, error %v\n", grype, err)
+	}
+	if _, err := parseReport([]byte(`{"foo": 1}`)); err == nil {
+		t.Errorf("Fail TestEvaluateVulns, unknown report is parsed")
+	}
+	vp := &VulnPolicy{Thresholds: map[string]int{"CRITICAL": 0, "high": 1}}
+	summary, violations := evaluateVulns(append(vulns, grype...), vp)
+	if summary != "CRITICAL: 2, HIGH: 1, LOW: 1" || len(violations) != 1 || !strings.Contains(violations[0], "CVE-2023-0001, CVE-2023-0003") {
+		t.Errorf("Fail TestEvaluateVulns, summary %s, violations %v\n", summary, violations)
+	}
+	vp.Allowlist = []string{"cve-2023-0001", "CVE-2023-0003"}
+	if summary, violations := evaluateVulns(append(vulns, grype...), vp); len(violations) != 0 || summary != "HIGH: 1, LOW: 1" {
+		t.Errorf("Fail TestEvaluateVulns, allowlist is ignored, summary %s, violations %v\n", summary, violations)
+	}
+}
+
+// TestCheckVulns
+func TestCheckVulns(t *testing.T) {
+	reg := fakeRegistry(t)
+	config := reg.blob("application/vnd.oci.image.config.v1+json", []byte(`{"config": {}}`))
+	// attach report artifacts with given layers to the image of the tag
+	attachLayers := func(tag, artifactType string, reports ...[]string) {
+		digest := reg.manifest("org/srv", []string{tag}, OCIManifest{Config: config, Annotations: map[string]string{"v": tag}})
+		if len(reports) == 0 {
+			return
+		}
+		var refs []OCIDescriptor
+		for idx, report := range reports {
+			var layers []OCIDescriptor
+			for _, data := range report {
+				layers = append(layers, reg.blob("application/json", []byte(data)))
+			}
+			art := reg.manifest("org/srv", nil, OCIManifest{
+				Config:  reg.blob("application/vnd.oci.empty.v1+json", []byte("{}")),
+				Layers:  layers,
+				Subject: &OCIDescriptor{Digest: digest},
+			})
+			created := map[string]string{"org.opencontainers.image.created": fmt.Sprintf("2024-01-0%dT00:00:00Z", idx+1)}
+			refs = append(refs, OCIDescriptor{MediaType: "application/vnd.oci.image.manifest.v1+json", ArtifactType: artifactType, Digest: art, Annotations: created})
+		}
+		// referrers tag schema used by registries without referrers API
+		reg.manifest("org/srv", []string{strings.Replace(digest, ":", "-", 1)}, OCIManifest{
+			MediaType: "application/vnd.oci.image.index.v1+json",
+			Manifests: refs,
+		})
+	}
+	attach := func(tag, artifactType string, reports ...string) {
+		var list [][]string
+		for _, report := range reports {
+			list = append(list, []string{report})
+		}
+		attachLayers(tag, artifactType, list...)
+	}
+	attach("0.1", "application/vnd.aquasecurity.trivy.report+json", trivyReport)
+	attach("0.2", "application/vnd.anchore.grype.report+json", `{"matches": []}`)
+	attach("0.3", "")
+	attach("0.4", "application/vnd.example.sbom+json", trivyReport)
+	// newer clean report does not hide vulnerabilities of other reports
+	attach("0.5", "application/vnd.aquasecurity.trivy.report+json", trivyReport, `{"SchemaVersion": 2, "Results": []}`)
+	// report is read from any layer of the artifact
+	attachLayers("0.6", "application/vnd.aquasecurity.trivy.report+json", []string{"summary", trivyReport})
+	// unparseable reports are skipped but can not satisfy required report
+	attach("0.7", "application/vnd.aquasecurity.trivy.report+json", "not a report")
+	attach("0.8", "application/vnd.aquasecurity.trivy.report+json", "not a report", `{"SchemaVersion": 2, "Results": []}`)
+
+	vp := &VulnPolicy{Thresholds: map[string]int{"CRITICAL": 0}, Required: true}
+	policy := ServicePolicy{Service: "srv", Vulnerabilities: vp}
+	tests := map[string]string{
+		"0.1": "1 CRITICAL vulnerabilities exceed threshold 0 (CVE-2023-0001)",
+		"0.2": "",
+		"0.3": "has no scan report",
+		"0.4": "has no scan report",
+		"0.5": "1 CRITICAL vulnerabilities exceed threshold 0 (CVE-2023-0001)",
+		"0.6": "1 CRITICAL vulnerabilities exceed threshold 0 (CVE-2023-0001)",
+		"0.7": "unparseable scan reports: 1 scan reports",
+		"0.8": "",
+	}
+	for tag, msg := range tests {
+		r := Request{Service: "srv", Image: reg.host + "/org/srv", Tag: tag, Repository: "org/srv", Commit: "abc"}
+		_, err := checkVulns(r, policy, "")
+		if msg == "" && err != nil {
+			t.Errorf("Fail TestCheckVulns, tag %s, error %v\n", tag, err)
+		}
+		if msg != "" && (err == nil || !strings.Contains(err.Error(), msg)) {
+			t.Errorf("Fail TestCheckVulns, tag %s, wrong error %v\n", tag, err)
+		}
+	}
+
+	// skipped reports are reported in the summary
+	r := Request{Service: "srv", Image: reg.host + "/org/srv", Tag: "0.8", Repository: "org/srv", Commit: "abc"}
+	if summary, err := checkVulns(r, policy, ""); err != nil || summary != "no vulnerabilities, 1 unparseable scan reports skipped" {
+		t.Errorf("Fail TestCheckVulns, wrong summary of skipped report %s, error %v\n", summary, err)
+	}
+	vp.Required = false
+	r.Tag = "0.7"
+	if summary, err := checkVulns(r, policy, ""); err != nil || !strings.HasPrefix(summary, "WARNING, unparseable scan reports") {
+		t.Errorf("Fail TestCheckVulns, wrong summary of unparseable reports %s, error %v\n", summary, err)
+	}
+
+	// warn mode reports vulnerabilities in the job
+	vp.Mode = "warn"
+	r = Request{Service: "srv", Image: reg.host + "/org/srv", Tag: "0.1", Repository: "org/srv", Commit: "abc", Expire: 1 << 40}
+	summary, err := checkVulns(r, policy, "")
+	if err != nil {
+		t.Fatalf("Fail TestCheckVulns, warn mode refused image, error %v\n", err)
+	}
+	if !strings.HasPrefix(summary, "WARNING") || !strings.Contains(summary, "CVE-2023-0001") {
+		t.Errorf("Fail TestCheckVulns, wrong vulnerabilities summary %s\n", summary)
+	}
+}